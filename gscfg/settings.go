@@ -12,9 +12,9 @@ import (
 // make a copy of this file, rename to settings.go
 // then set the correct value for these follow variables
 var (
-	monitorEstablished = false
-	ServerPort         = 3001
-	// LogFile              = ""
+	monitorEstablished   = false
+	ServerPort           = 3001
+	LogFile              = ""
 	Daemon               = "yes"
 	RedisServer          = ":6379"
 	ServerID             = ""
@@ -30,8 +30,92 @@ var (
 	ProxyTarget  = "test.5206767.net"
 	ProxyScheme  = "http"
 	RoomTypeName string
+
+	// 会话抓包文件目录，单个文件大小(MB)以及保留的文件个数
+	CaptureDir      = "captures"
+	CaptureMaxSize  = 64
+	CaptureMaxFiles = 10
+
+	// websocket保活(秒)：空闲超过IdleTimeout关闭，超过PingIdle开始ping，ping间隔PingInterval
+	IdleTimeout  = 90
+	PingIdle     = 45
+	PingInterval = 30
+
+	// 测得往返时延后是否推送给客户端
+	PushRTT = false
+
+	// tcp客户端(4字节长度前缀的ProxyMessage)的监听地址，例如":3902"，为空时不接受tcp客户端
+	ClientTCPAddr = ""
+	// 可靠udp客户端的监听地址，例如":3903"，为空时不接受udp客户端
+	ClientUDPAddr = ""
+
+	// websocket的permessage-deflate压缩：压缩级别(-2~9)，小于阈值(字节)的消息不压缩
+	Compression          = false
+	CompressionLevel     = 1
+	CompressionThreshold = 256
+
+	// websocket的消息大小以及缓冲区限制(字节)，WSRoutes按/game/:uuid/ws/:wtype中的wtype覆盖；
+	// http请求头的大小限制(字节)
+	WSReadLimit       = 1024
+	WSReadBufferSize  = 2048
+	WSWriteBufferSize = 4096
+	WSRoutes          map[string]WSLimits
+	MaxHeaderBytes    = 1 << 8
+
+	// 游戏服务器一端的保活(秒)：tcp keepalive间隔(0系统默认，负数关闭)，
+	// 读超时(0不检查)，心跳消息码(0不发送)以及心跳间隔
+	UpstreamKeepAlive         = 0
+	UpstreamReadTimeout       = 0
+	UpstreamHeartbeatMsg      = 0
+	UpstreamHeartbeatInterval = 15
+
+	// 日志级别(debug/info/warn/error)，格式(text/json)，
+	// 日志文件大小(MB)以及保留的文件个数，新会话输出逐包日志的采样率
+	LogLevel      = "info"
+	LogFormat     = "text"
+	LogMaxSize    = 100
+	LogMaxFiles   = 10
+	LogSampleRate = 0.0
+
+	// OTLP/HTTP的trace导出地址，例如"otel-collector:4318"，为空时不导出
+	OTLPEndpoint = ""
+
+	// http转发规则，为空时把POST /t9user/Login转发到ProxyScheme://ProxyTarget
+	Routes []HTTPRoute
+	// 转发请求体的大小限制(KB)，幂等请求连接失败时的重试次数(负数不重试)
+	ForwardMaxBody = 1024
+	ForwardRetries = 2
+	// 前面的负载均衡等代理的IP或者CIDR，只有来自这些地址的请求转发时保留X-Forwarded-For
+	TrustedProxies []string
+	// 转发回复缓存的存储：redis或者memory，以及内存缓存的条目上限
+	CacheBackend    = "memory"
+	CacheMaxEntries = 1024
+	// 上游连续失败BreakerFailures次后熔断BreakerCooldown秒，BreakerFailures为负数时不熔断
+	BreakerFailures = 5
+	BreakerCooldown = 10
 )
 
+// WSLimits websocket的限制，为0的字段使用全局配置
+type WSLimits struct {
+	ReadLimit       int `json:"readLimit"`
+	ReadBufferSize  int `json:"readBufferSize"`
+	WriteBufferSize int `json:"writeBufferSize"`
+}
+
+// HTTPRoute 一条http转发规则：Method(为空匹配所有)+Path(httprouter格式)转发到Upstream，
+// Rewrite改写路径，Timeout为超时秒数，AddHeaders/RemoveHeaders修改请求头，
+// CacheTTL大于0时缓存GET请求的回复(秒)
+type HTTPRoute struct {
+	Method        string            `json:"method"`
+	Path          string            `json:"path"`
+	Upstream      string            `json:"upstream"`
+	Rewrite       string            `json:"rewrite"`
+	Timeout       int               `json:"timeout"`
+	AddHeaders    map[string]string `json:"addHeaders"`
+	RemoveHeaders []string          `json:"removeHeaders"`
+	CacheTTL      int               `json:"cacheTTL"`
+}
+
 var (
 	loadedCfgFilePath = ""
 )
@@ -69,8 +153,8 @@ func ReLoadConfigFile() bool {
 // ParseConfigFile 解析配置
 func ParseConfigFile(filepath string) bool {
 	type Params struct {
-		ServerPort int `json:"port"`
-		// LogFile           string `json:"log_file"`
+		ServerPort  int    `json:"port"`
+		LogFile     string `json:"log_file"`
 		Daemon      string `json:"daemon"`
 		RedisServer string `json:"redis_server"`
 		ServreID    string `json:"guid"`
@@ -92,6 +176,53 @@ func ParseConfigFile(filepath string) bool {
 		ProxyScheme string `json:"proxyScheme"`
 
 		RoomTypeName string `json:"roomTypeName"`
+
+		CaptureDir      string `json:"captureDir"`
+		CaptureMaxSize  int    `json:"captureMaxSize"`
+		CaptureMaxFiles int    `json:"captureMaxFiles"`
+
+		IdleTimeout  int `json:"idleTimeout"`
+		PingIdle     int `json:"pingIdle"`
+		PingInterval int `json:"pingInterval"`
+
+		PushRTT bool `json:"pushRTT"`
+
+		ClientTCPAddr string `json:"clientTCPAddr"`
+		ClientUDPAddr string `json:"clientUDPAddr"`
+
+		Compression          bool `json:"compression"`
+		CompressionLevel     int  `json:"compressionLevel"`
+		CompressionThreshold int  `json:"compressionThreshold"`
+
+		WSReadLimit       int                 `json:"wsReadLimit"`
+		WSReadBufferSize  int                 `json:"wsReadBufferSize"`
+		WSWriteBufferSize int                 `json:"wsWriteBufferSize"`
+		WSRoutes          map[string]WSLimits `json:"wsRoutes"`
+		MaxHeaderBytes    int                 `json:"maxHeaderBytes"`
+
+		UpstreamKeepAlive         int `json:"upstreamKeepAlive"`
+		UpstreamReadTimeout       int `json:"upstreamReadTimeout"`
+		UpstreamHeartbeatMsg      int `json:"upstreamHeartbeatMsg"`
+		UpstreamHeartbeatInterval int `json:"upstreamHeartbeatInterval"`
+
+		LogLevel      string  `json:"logLevel"`
+		LogFormat     string  `json:"logFormat"`
+		LogMaxSize    int     `json:"logMaxSize"`
+		LogMaxFiles   int     `json:"logMaxFiles"`
+		LogSampleRate float64 `json:"logSampleRate"`
+
+		OTLPEndpoint string `json:"otlpEndpoint"`
+
+		Routes         []HTTPRoute `json:"routes"`
+		ForwardMaxBody int         `json:"forwardMaxBody"`
+		ForwardRetries int         `json:"forwardRetries"`
+		TrustedProxies []string    `json:"trustedProxies"`
+
+		CacheBackend    string `json:"cacheBackend"`
+		CacheMaxEntries int    `json:"cacheMaxEntries"`
+
+		BreakerFailures int `json:"breakerFailures"`
+		BreakerCooldown int `json:"breakerCooldown"`
 	}
 
 	loadedCfgFilePath = filepath
@@ -116,9 +247,61 @@ func ParseConfigFile(filepath string) bool {
 	log.Println("-------------------Configure params are:-------------------")
 	log.Printf("%+v\n", params)
 
-	// if params.LogFile != "" {
-	// 	LogFile = params.LogFile
-	// }
+	if params.LogFile != "" {
+		LogFile = params.LogFile
+	}
+
+	if params.LogLevel != "" {
+		LogLevel = params.LogLevel
+	}
+
+	if params.LogFormat != "" {
+		LogFormat = params.LogFormat
+	}
+
+	if params.LogMaxSize > 0 {
+		LogMaxSize = params.LogMaxSize
+	}
+
+	if params.LogMaxFiles > 0 {
+		LogMaxFiles = params.LogMaxFiles
+	}
+
+	if params.LogSampleRate > 0 {
+		LogSampleRate = params.LogSampleRate
+	}
+
+	if params.OTLPEndpoint != "" {
+		OTLPEndpoint = params.OTLPEndpoint
+	}
+
+	Routes = params.Routes
+
+	if params.ForwardMaxBody > 0 {
+		ForwardMaxBody = params.ForwardMaxBody
+	}
+
+	if params.ForwardRetries != 0 {
+		ForwardRetries = params.ForwardRetries
+	}
+
+	TrustedProxies = params.TrustedProxies
+
+	if params.CacheBackend != "" {
+		CacheBackend = params.CacheBackend
+	}
+
+	if params.CacheMaxEntries > 0 {
+		CacheMaxEntries = params.CacheMaxEntries
+	}
+
+	if params.BreakerFailures != 0 {
+		BreakerFailures = params.BreakerFailures
+	}
+
+	if params.BreakerCooldown > 0 {
+		BreakerCooldown = params.BreakerCooldown
+	}
 
 	if params.Daemon != "" {
 		Daemon = params.Daemon
@@ -182,6 +365,84 @@ func ParseConfigFile(filepath string) bool {
 		DbPort = params.DbPort
 	}
 
+	if params.CaptureDir != "" {
+		CaptureDir = params.CaptureDir
+	}
+
+	if params.CaptureMaxSize > 0 {
+		CaptureMaxSize = params.CaptureMaxSize
+	}
+
+	if params.CaptureMaxFiles > 0 {
+		CaptureMaxFiles = params.CaptureMaxFiles
+	}
+
+	if params.IdleTimeout > 0 {
+		IdleTimeout = params.IdleTimeout
+	}
+
+	if params.PingIdle > 0 {
+		PingIdle = params.PingIdle
+	}
+
+	if params.PingInterval > 0 {
+		PingInterval = params.PingInterval
+	}
+
+	PushRTT = params.PushRTT
+
+	if params.ClientTCPAddr != "" {
+		ClientTCPAddr = params.ClientTCPAddr
+	}
+
+	if params.ClientUDPAddr != "" {
+		ClientUDPAddr = params.ClientUDPAddr
+	}
+
+	Compression = params.Compression
+
+	if params.CompressionLevel != 0 {
+		CompressionLevel = params.CompressionLevel
+	}
+
+	if params.CompressionThreshold > 0 {
+		CompressionThreshold = params.CompressionThreshold
+	}
+
+	if params.WSReadLimit > 0 {
+		WSReadLimit = params.WSReadLimit
+	}
+
+	if params.WSReadBufferSize > 0 {
+		WSReadBufferSize = params.WSReadBufferSize
+	}
+
+	if params.WSWriteBufferSize > 0 {
+		WSWriteBufferSize = params.WSWriteBufferSize
+	}
+
+	WSRoutes = params.WSRoutes
+
+	if params.MaxHeaderBytes > 0 {
+		MaxHeaderBytes = params.MaxHeaderBytes
+	}
+
+	if params.UpstreamKeepAlive != 0 {
+		UpstreamKeepAlive = params.UpstreamKeepAlive
+	}
+
+	if params.UpstreamReadTimeout > 0 {
+		UpstreamReadTimeout = params.UpstreamReadTimeout
+	}
+
+	if params.UpstreamHeartbeatMsg > 0 {
+		UpstreamHeartbeatMsg = params.UpstreamHeartbeatMsg
+	}
+
+	if params.UpstreamHeartbeatInterval > 0 {
+		UpstreamHeartbeatInterval = params.UpstreamHeartbeatInterval
+	}
+
 	if ServerID == "" {
 		log.Println("Server id 'guid' must not be empty!")
 		return false
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"xhmj/proxy"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+const (
+	formatAuto  = "auto"
+	formatProxy = "proxy"
+	formatGame  = "game"
+	formatWS    = "ws"
+)
+
+// dumpItem 解码出来的一个包
+type dumpItem struct {
+	Source  string `json:"src,omitempty"`
+	Kind    string `json:"kind"`
+	Ops     int32  `json:"ops,omitempty"`
+	Msg     uint16 `json:"msg,omitempty"`
+	Flag    byte   `json:"flag,omitempty"`
+	Size    int    `json:"size,omitempty"`
+	Gzip    bool   `json:"gzip,omitempty"`
+	Body    string `json:"body,omitempty"`
+	BodyLen int    `json:"bodyLen"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (item *dumpItem) setBody(body []byte) {
+	item.BodyLen = len(body)
+	if bodyLimit > 0 && len(body) > bodyLimit {
+		body = body[:bodyLimit]
+	}
+
+	item.Body = hex.EncodeToString(body)
+}
+
+// decodeData 按format解码一段数据，auto时先尝试游戏包格式，再尝试websocket帧，最后当作ProxyMessage
+func decodeData(src string, data []byte, format string) []*dumpItem {
+	if format == formatAuto {
+		switch {
+		case looksLikeGame(data):
+			format = formatGame
+		case looksLikeWebsocket(data):
+			format = formatWS
+		default:
+			format = formatProxy
+		}
+	}
+
+	switch format {
+	case formatGame:
+		return decodeGameStream(src, data)
+	case formatWS:
+		return decodeWebsocketStream(src, data)
+	default:
+		return []*dumpItem{decodeProxyMessage(src, data)}
+	}
+}
+
+// looksLikeGame 数据开头是否是一个完整且hash正确的游戏包
+func looksLikeGame(data []byte) bool {
+	_, _, _, err := proxy.ReadGamePacket(bytes.NewReader(data))
+	return err == nil
+}
+
+func looksLikeWebsocket(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("GET ")) || bytes.HasPrefix(data, []byte("HTTP/")) {
+		return true
+	}
+
+	// FIN + binary frame
+	return len(data) >= 2 && data[0] == 0x82
+}
+
+func decodeProxyMessage(src string, data []byte) *dumpItem {
+	item := &dumpItem{Source: src, Kind: formatProxy}
+
+	gmsg := &proxy.ProxyMessage{}
+	err := proto.Unmarshal(data, gmsg)
+	if err != nil {
+		item.Error = err.Error()
+		item.setBody(data)
+		return item
+	}
+
+	item.Ops = gmsg.GetOps()
+	if item.Ops > 255 {
+		item.Msg = uint16(item.Ops >> 8)
+	}
+
+	item.setBody(gmsg.GetData())
+
+	return item
+}
+
+// decodeGameStream 用proxy.ReadGamePacket逐个解码游戏包，出错的包带上错误信息以及原始数据
+func decodeGameStream(src string, data []byte) []*dumpItem {
+	var items []*dumpItem
+
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		item := &dumpItem{Source: src, Kind: formatGame}
+		items = append(items, item)
+
+		offset := len(data) - r.Len()
+		msg, flag, body, err := proxy.ReadGamePacket(r)
+		raw := data[offset : len(data)-r.Len()]
+		if err != nil {
+			// 读到结尾还不完整的是被截断的包，其余的带上整个原始包（包括包头）
+			if err == io.ErrUnexpectedEOF && r.Len() == 0 {
+				err = fmt.Errorf("truncated packet, %d bytes left", len(raw))
+			}
+			// 包头中的大小不可信，之后的数据无法分割，全部作为这个包的数据
+			if err == proxy.ErrGamePacketTooBig && len(raw) == proxy.PacketHeaderSize {
+				raw = data[offset:]
+				r.Reset(nil)
+			}
+			item.Error = err.Error()
+			item.setBody(raw)
+			continue
+		}
+
+		item.Msg = msg
+		item.Flag = flag
+		item.Size = len(raw) - proxy.PacketHeaderSize
+		item.Gzip = (flag & proxy.FlagCompressed) != 0
+		item.setBody(body)
+	}
+
+	return items
+}
+
+// decodeWebsocketStream 解码websocket帧，跳过开头的http握手，二进制帧按ProxyMessage解码
+func decodeWebsocketStream(src string, data []byte) []*dumpItem {
+	if bytes.HasPrefix(data, []byte("GET ")) || bytes.HasPrefix(data, []byte("HTTP/")) {
+		idx := bytes.Index(data, []byte("\r\n\r\n"))
+		if idx < 0 {
+			return nil
+		}
+
+		data = data[idx+4:]
+	}
+
+	var items []*dumpItem
+	for len(data) > 0 {
+		if len(data) < 2 {
+			items = append(items, &dumpItem{Source: src, Kind: formatWS, Error: "truncated frame"})
+			break
+		}
+
+		opcode := data[0] & 0x0f
+		masked := (data[1] & 0x80) != 0
+		length := uint64(data[1] & 0x7f)
+		pos := 2
+
+		switch length {
+		case 126:
+			if len(data) < pos+2 {
+				length = ^uint64(0)
+				break
+			}
+			length = uint64(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+		case 127:
+			if len(data) < pos+8 {
+				length = ^uint64(0)
+				break
+			}
+			length = binary.BigEndian.Uint64(data[pos:])
+			pos += 8
+		}
+
+		var mask []byte
+		if masked && len(data) >= pos+4 {
+			mask = data[pos : pos+4]
+			pos += 4
+		}
+
+		if length > uint64(len(data)-pos) {
+			items = append(items, &dumpItem{Source: src, Kind: formatWS, Error: "truncated frame"})
+			break
+		}
+
+		payload := make([]byte, length)
+		copy(payload, data[pos:pos+int(length)])
+		data = data[pos+int(length):]
+
+		for i := range payload {
+			if mask != nil {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case 0x0, 0x2:
+			items = append(items, decodeProxyMessage(src, payload))
+		default:
+			item := &dumpItem{Source: src, Kind: wsOpcodeName(opcode)}
+			item.setBody(payload)
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func wsOpcodeName(opcode byte) string {
+	switch opcode {
+	case 0x1:
+		return "ws-text"
+	case 0x8:
+		return "ws-close"
+	case 0x9:
+		return "ws-ping"
+	case 0xa:
+		return "ws-pong"
+	}
+
+	return fmt.Sprintf("ws-op%d", opcode)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"testing"
+	"xhmj/proxy"
+)
+
+// testdata中的两个抓包内容相同：pcapng为大端并且数据包在第二个接口上。
+// websocket握手以及一个掩码帧；上行两个游戏包（第二个压缩）被拆成两段并且有一次重传；
+// 下行一个正常包、一个hash错误的包以及最后被截断的包
+var fixtureDump = []string{
+	"10.0.0.1:50000->10.0.0.2:3001 [proxy] ops:256256 (msg:1001) body(5):68656c6c6f",
+	"10.0.0.2:40000->10.0.0.3:5000 [game] msg:1001 flag:0x00 size:5 body(5):68656c6c6f",
+	"10.0.0.2:40000->10.0.0.3:5000 [game] msg:1002 flag:0x40 size:56 gzip body(31):636f6d7072657373656420626f647920636f6d7072657373656420626f6479",
+	"10.0.0.3:5000->10.0.0.2:40000 [game] msg:1003 flag:0x00 size:5 body(5):7265706c79",
+	"10.0.0.3:5000->10.0.0.2:40000 [game] body(18):ec03000006000000be6199069d726f6b656e ERROR:game packet hash not match",
+	"10.0.0.3:5000->10.0.0.2:40000 [game] body(15):ed03000007000000a675c60a637574 ERROR:truncated packet, 15 bytes left",
+}
+
+func TestDecodeCapture(t *testing.T) {
+	for _, file := range []string{"testdata/game.pcap", "testdata/game.pcapng"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !isPcap(data) {
+			t.Fatalf("%s: not recognized as capture", file)
+		}
+
+		flows, err := readPcapFlows(data)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+
+		var lines []string
+		for _, flow := range flows {
+			// 与-port 5000相同，websocket流按auto识别
+			f := formatAuto
+			if flow.srcPort == 5000 || flow.dstPort == 5000 {
+				f = formatGame
+			}
+
+			for _, item := range decodeData(flow.name, flow.data, f) {
+				lines = append(lines, formatItem(item))
+			}
+		}
+
+		if len(lines) != len(fixtureDump) {
+			t.Fatalf("%s: got %d items:\n%q", file, len(lines), lines)
+		}
+
+		for i := range lines {
+			if lines[i] != fixtureDump[i] {
+				t.Errorf("%s item %d:\ngot  %s\nwant %s", file, i, lines[i], fixtureDump[i])
+			}
+		}
+	}
+}
+
+func TestDecodeGameAuto(t *testing.T) {
+	// 十六进制输入按auto识别为游戏包
+	packet, err := proxy.EncodeGamePacket(1001, 0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := decodeHex(hex.EncodeToString(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := decodeData("", data, formatAuto)
+	if len(items) != 1 || items[0].Kind != formatGame || items[0].Msg != 1001 || items[0].Error != "" {
+		t.Fatalf("unexpected items: %+v", items[0])
+	}
+}
+
+func TestDecodeGameTooBig(t *testing.T) {
+	// 解压后超过上限的包被跳过，之后的包正常解码
+	bomb, err := proxy.EncodeGamePacket(1001, proxy.FlagCompressed, make([]byte, 17<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := proxy.EncodeGamePacket(1002, 0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 包头中的大小不可信时不分配内存，之后的数据全部作为出错的包
+	var bad [proxy.PacketHeaderSize + 3]byte
+	binary.LittleEndian.PutUint32(bad[4:], 0xffffffff)
+
+	data := append(append(append([]byte(nil), bomb...), hello...), bad[:]...)
+	items := decodeGameStream("", data)
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	if items[0].Error != proxy.ErrGamePacketTooBig.Error() || items[1].Msg != 1002 || items[1].Error != "" {
+		t.Fatalf("unexpected items: %+v %+v", items[0], items[1])
+	}
+	if items[2].Error != proxy.ErrGamePacketTooBig.Error() || items[2].BodyLen != len(bad) {
+		t.Fatalf("unexpected item: %+v", items[2])
+	}
+}
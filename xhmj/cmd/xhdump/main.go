@@ -0,0 +1,193 @@
+// xhdump 解码代理的ProxyMessage以及游戏服务器的12字节包头格式
+//
+// 输入可以是命令行的十六进制串(-x)、文件（二进制、十六进制文本或者pcap/pcapng抓包）或者标准输入，
+// 输出为可读文本或者每行一个JSON对象(-json)
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	hexInput   = ""
+	format     = formatAuto
+	gamePort   = 0
+	jsonOutput = false
+	bodyLimit  = 64
+)
+
+func init() {
+	flag.StringVar(&hexInput, "x", "", "hex string to decode")
+	flag.StringVar(&format, "f", formatAuto, "input format: auto, proxy, game or ws")
+	flag.IntVar(&gamePort, "port", 0, "pcap: tcp port of game server, flows on this port are decoded as game packets, others as websocket")
+	flag.BoolVar(&jsonOutput, "json", false, "output one JSON object per packet")
+	flag.IntVar(&bodyLimit, "n", 64, "max body bytes to print, 0 means all")
+}
+
+func main() {
+	flag.Parse()
+
+	switch format {
+	case formatAuto, formatProxy, formatGame, formatWS:
+	default:
+		log.Fatal("unknown format:", format)
+	}
+
+	if hexInput != "" {
+		data, err := decodeHex(hexInput)
+		if err != nil {
+			log.Fatal("invalid hex input:", err)
+		}
+
+		printItems(decodeData("", data, format))
+		return
+	}
+
+	if flag.NArg() == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal("read stdin failed:", err)
+		}
+
+		dumpInput("stdin", data)
+		return
+	}
+
+	for _, file := range flag.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("read file failed:", err)
+		}
+
+		dumpInput(file, data)
+	}
+}
+
+func dumpInput(name string, data []byte) {
+	if isPcap(data) {
+		dumpPcap(data)
+		return
+	}
+
+	if isHexText(data) {
+		decoded, err := decodeHex(string(data))
+		if err == nil {
+			data = decoded
+		}
+	}
+
+	printItems(decodeData(name, data, format))
+}
+
+func dumpPcap(data []byte) {
+	flows, err := readPcapFlows(data)
+	if err != nil {
+		log.Fatal("parse pcap failed:", err)
+	}
+
+	for _, flow := range flows {
+		f := format
+		if gamePort != 0 {
+			if int(flow.srcPort) == gamePort || int(flow.dstPort) == gamePort {
+				f = formatGame
+			} else {
+				f = formatWS
+			}
+		}
+
+		printItems(decodeData(flow.name, flow.data, f))
+	}
+}
+
+// isHexText 是否是十六进制文本，允许空白、冒号以及0x前缀
+func isHexText(data []byte) bool {
+	s := strings.TrimSpace(string(data))
+	if len(s) == 0 {
+		return false
+	}
+
+	s = strings.Replace(s, "0x", "", -1)
+	for _, c := range s {
+		if unicode.IsSpace(c) || c == ':' {
+			continue
+		}
+
+		if !unicode.Is(unicode.ASCII_Hex_Digit, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func decodeHex(s string) ([]byte, error) {
+	s = strings.Replace(s, "0x", "", -1)
+	s = strings.Map(func(c rune) rune {
+		if unicode.IsSpace(c) || c == ':' {
+			return -1
+		}
+		return c
+	}, s)
+
+	return hex.DecodeString(s)
+}
+
+func printItems(items []*dumpItem) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+
+	for _, item := range items {
+		if jsonOutput {
+			enc.Encode(item)
+			continue
+		}
+
+		fmt.Println(formatItem(item))
+	}
+}
+
+func formatItem(item *dumpItem) string {
+	var sb strings.Builder
+	if item.Source != "" {
+		fmt.Fprintf(&sb, "%s ", item.Source)
+	}
+
+	fmt.Fprintf(&sb, "[%s]", item.Kind)
+
+	switch item.Kind {
+	case formatProxy:
+		fmt.Fprintf(&sb, " ops:%d", item.Ops)
+		if item.Ops > 255 {
+			fmt.Fprintf(&sb, " (msg:%d)", item.Msg)
+		}
+	case formatGame:
+		if item.Error != "" {
+			break
+		}
+
+		fmt.Fprintf(&sb, " msg:%d flag:0x%02x size:%d", item.Msg, item.Flag, item.Size)
+		if item.Gzip {
+			sb.WriteString(" gzip")
+		}
+	}
+
+	fmt.Fprintf(&sb, " body(%d):%s", item.BodyLen, item.Body)
+	if len(item.Body)/2 < item.BodyLen {
+		sb.WriteString("...")
+	}
+
+	if item.Error != "" {
+		fmt.Fprintf(&sb, " ERROR:%s", item.Error)
+	}
+
+	return sb.String()
+}
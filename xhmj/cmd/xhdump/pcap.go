@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// tcpFlow 一个方向上的tcp数据流，按抓包顺序拼接payload
+type tcpFlow struct {
+	name    string
+	srcPort uint16
+	dstPort uint16
+	data    []byte
+	nextSeq uint32
+	started bool
+}
+
+const (
+	pcapngBlockSection   = 0x0a0d0d0a
+	pcapngBlockInterface = 0x00000001
+	pcapngBlockSimple    = 0x00000003
+	pcapngBlockEnhanced  = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+)
+
+func isPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
+	magic := binary.LittleEndian.Uint32(data)
+	switch magic {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, pcapngBlockSection:
+		return true
+	}
+
+	return false
+}
+
+// readPcapFlows 解析pcap或者pcapng格式文件，提取tcp数据流，重传的数据会被跳过
+func readPcapFlows(data []byte) ([]*tcpFlow, error) {
+	fb := &flowBuilder{flows: make(map[string]*tcpFlow)}
+
+	var err error
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == pcapngBlockSection {
+		err = readPcapng(data, fb.add)
+	} else {
+		err = readClassicPcap(data, fb.add)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return fb.ordered, nil
+}
+
+// readClassicPcap 经典libpcap格式，整个文件只有一种链路类型
+func readClassicPcap(data []byte, frameFn func(linkType uint32, frame []byte)) error {
+	if len(data) < 24 {
+		return errors.New("pcap file too short")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := binary.LittleEndian.Uint32(data)
+	if magic == 0xd4c3b2a1 || magic == 0x4d3cb2a1 {
+		order = binary.BigEndian
+	}
+
+	linkType := order.Uint32(data[20:])
+	data = data[24:]
+
+	for len(data) >= 16 {
+		inclLen := int(order.Uint32(data[8:]))
+		data = data[16:]
+		if inclLen > len(data) {
+			break
+		}
+
+		frameFn(linkType, data[:inclLen])
+		data = data[inclLen:]
+	}
+
+	return nil
+}
+
+// readPcapng pcapng格式，每个section有自己的字节序，每个接口有自己的链路类型
+func readPcapng(data []byte, frameFn func(linkType uint32, frame []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint32
+
+	for len(data) >= 12 {
+		// section头的类型正反读都一样，字节序由其中的magic决定，之后重新登记接口
+		if binary.LittleEndian.Uint32(data) == pcapngBlockSection {
+			switch binary.LittleEndian.Uint32(data[8:]) {
+			case pcapngByteOrderMagic:
+				order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				order = binary.BigEndian
+			default:
+				return errors.New("invalid pcapng byte order magic")
+			}
+			linkTypes = nil
+		}
+
+		blockType := order.Uint32(data)
+		blockLen := int(order.Uint32(data[4:]))
+		if blockLen < 12 || blockLen%4 != 0 || blockLen > len(data) {
+			// 最后一个块不完整，保留前面的数据
+			break
+		}
+
+		body := data[8 : blockLen-4]
+		data = data[blockLen:]
+
+		switch blockType {
+		case pcapngBlockInterface:
+			if len(body) < 2 {
+				return errors.New("invalid pcapng interface block")
+			}
+			linkTypes = append(linkTypes, uint32(order.Uint16(body)))
+		case pcapngBlockEnhanced:
+			if len(body) < 20 {
+				continue
+			}
+
+			iface := int(order.Uint32(body))
+			capLen := int(order.Uint32(body[12:]))
+			if iface >= len(linkTypes) || capLen > len(body)-20 {
+				continue
+			}
+
+			frameFn(linkTypes[iface], body[20:20+capLen])
+		case pcapngBlockSimple:
+			// 没有截取长度，按原始长度与块大小取小的
+			if len(body) < 4 || len(linkTypes) == 0 {
+				continue
+			}
+
+			capLen := int(order.Uint32(body))
+			if capLen > len(body)-4 {
+				capLen = len(body) - 4
+			}
+
+			frameFn(linkTypes[0], body[4:4+capLen])
+		}
+	}
+
+	return nil
+}
+
+// flowBuilder 把抓到的帧按方向拼接成tcp数据流
+type flowBuilder struct {
+	flows   map[string]*tcpFlow
+	ordered []*tcpFlow
+}
+
+func (fb *flowBuilder) add(linkType uint32, frame []byte) {
+	ipPacket, ok := stripLinkLayer(frame, linkType)
+	if !ok {
+		return
+	}
+
+	src, dst, segment, ok := parseIP(ipPacket)
+	if !ok {
+		return
+	}
+
+	if len(segment) < 20 {
+		return
+	}
+
+	srcPort := binary.BigEndian.Uint16(segment[0:])
+	dstPort := binary.BigEndian.Uint16(segment[2:])
+	seq := binary.BigEndian.Uint32(segment[4:])
+	offset := int(segment[12]>>4) * 4
+	if offset < 20 || offset > len(segment) {
+		return
+	}
+
+	payload := segment[offset:]
+	if len(payload) == 0 {
+		return
+	}
+
+	name := fmt.Sprintf("%s:%d->%s:%d", src, srcPort, dst, dstPort)
+	flow, ok := fb.flows[name]
+	if !ok {
+		flow = &tcpFlow{name: name, srcPort: srcPort, dstPort: dstPort}
+		fb.flows[name] = flow
+		fb.ordered = append(fb.ordered, flow)
+	}
+
+	flow.append(seq, payload)
+}
+
+func (f *tcpFlow) append(seq uint32, payload []byte) {
+	if f.started {
+		diff := int32(f.nextSeq - seq)
+		if diff >= int32(len(payload)) {
+			// 重传
+			return
+		}
+
+		if diff > 0 {
+			payload = payload[diff:]
+		}
+	}
+
+	f.started = true
+	f.data = append(f.data, payload...)
+	f.nextSeq = seq + uint32(len(payload))
+}
+
+func stripLinkLayer(frame []byte, linkType uint32) ([]byte, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		// 802.1Q vlan
+		if etherType == 0x8100 && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+
+		return frame, etherType == 0x0800 || etherType == 0x86dd
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+
+		return frame[16:], true
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil, false
+		}
+
+		return frame[4:], true
+	case linkTypeRaw:
+		return frame, true
+	}
+
+	return nil, false
+}
+
+// parseIP 解析IPv4/IPv6头，只返回tcp段
+func parseIP(packet []byte) (net.IP, net.IP, []byte, bool) {
+	if len(packet) < 1 {
+		return nil, nil, nil, false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, nil, nil, false
+		}
+
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		if packet[9] != 6 || ihl < 20 || total < ihl || total > len(packet) {
+			return nil, nil, nil, false
+		}
+
+		return net.IP(packet[12:16]), net.IP(packet[16:20]), packet[ihl:total], true
+	case 6:
+		if len(packet) < 40 {
+			return nil, nil, nil, false
+		}
+
+		// 不处理扩展头
+		payloadLen := int(binary.BigEndian.Uint16(packet[4:]))
+		if packet[6] != 6 || 40+payloadLen > len(packet) {
+			return nil, nil, nil, false
+		}
+
+		return net.IP(packet[8:24]), net.IP(packet[24:40]), packet[40 : 40+payloadLen], true
+	}
+
+	return nil, nil, nil, false
+}
@@ -0,0 +1,316 @@
+// xhload websocket代理压测工具
+//
+// 启动一个内置的回显游戏服务器（proxytest.GameServer，12字节包头格式），然后模拟N个客户端通过代理连接到该服务器，
+// 按配置的包组合发送游戏消息，统计吞吐、延迟分位数以及错误数
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"xhmj/proxy"
+	"xhmj/proxy/proxytest"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	proxyURL     = "ws://127.0.0.1:3001/game/load/ws/play"
+	clientCount  = 100
+	duration     = 30 * time.Second
+	rampUp       = 5 * time.Second
+	rate         = 10.0
+	mixSpec      = "2:64:8,3:512:2"
+	webMode      = false
+	echoAddr     = "127.0.0.1:0"
+	echoTarget   = ""
+	echoCompress = false
+)
+
+func init() {
+	flag.StringVar(&proxyURL, "url", proxyURL, "proxy websocket URL")
+	flag.IntVar(&clientCount, "n", clientCount, "number of simulated clients")
+	flag.DurationVar(&duration, "d", duration, "test duration")
+	flag.DurationVar(&rampUp, "ramp", rampUp, "time to spread client connections over")
+	flag.Float64Var(&rate, "rate", rate, "packets per second per client")
+	flag.StringVar(&mixSpec, "mix", mixSpec, "packet mix, comma separated msg:size:weight")
+	flag.BoolVar(&webMode, "web", false, "use web=1 custom OPPing/OPPong keepalive instead of native ping/pong")
+	flag.StringVar(&echoAddr, "echo", echoAddr, "listen address of the built-in echo game server")
+	flag.StringVar(&echoTarget, "target", "", "target address the proxy dials for the echo server, default to the echo listen address")
+	flag.BoolVar(&echoCompress, "compress", false, "echo server replies with gzip compressed packets")
+}
+
+// packetKind 包组合中的一种包
+type packetKind struct {
+	msg    uint16
+	size   int
+	weight int
+}
+
+func parseMix(spec string) ([]packetKind, error) {
+	var kinds []packetKind
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid mix item:%s", item)
+		}
+
+		msg, err1 := strconv.Atoi(parts[0])
+		size, err2 := strconv.Atoi(parts[1])
+		weight, err3 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || err3 != nil || msg <= 0 || msg > 0xffff || weight <= 0 {
+			return nil, fmt.Errorf("invalid mix item:%s", item)
+		}
+
+		// 包体前8字节用于存放发送时间
+		if size < 8 {
+			size = 8
+		}
+
+		kinds = append(kinds, packetKind{msg: uint16(msg), size: size, weight: weight})
+	}
+
+	if len(kinds) == 0 {
+		return nil, errors.New("empty packet mix")
+	}
+
+	return kinds, nil
+}
+
+func pickKind(kinds []packetKind, rnd *rand.Rand) packetKind {
+	total := 0
+	for _, k := range kinds {
+		total += k.weight
+	}
+
+	n := rnd.Intn(total)
+	for _, k := range kinds {
+		if n < k.weight {
+			return k
+		}
+		n -= k.weight
+	}
+
+	return kinds[len(kinds)-1]
+}
+
+// checkFlags 数值参数的合法性，rate决定发送间隔，不能为0或者负数
+func checkFlags() error {
+	switch {
+	case clientCount <= 0:
+		return fmt.Errorf("invalid -n %d, must be positive", clientCount)
+	case duration <= 0:
+		return fmt.Errorf("invalid -d %v, must be positive", duration)
+	case rampUp < 0:
+		return fmt.Errorf("invalid -ramp %v, must not be negative", rampUp)
+	case !(rate > 0) || time.Duration(float64(time.Second)/rate) <= 0:
+		return fmt.Errorf("invalid -rate %v, must be positive and at most %d", rate, int64(time.Second))
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	err := checkFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kinds, err := parseMix(mixSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 内置的回显游戏服务器
+	gs, err := proxytest.ListenGameServer(echoAddr)
+	if err != nil {
+		log.Fatal("start echo server failed:", err)
+	}
+	gs.Compress = echoCompress
+	defer gs.Close()
+
+	target := echoTarget
+	if target == "" {
+		target = gs.Addr()
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		log.Fatal("invalid proxy url:", err)
+	}
+
+	query := u.Query()
+	query.Set("target", target)
+	if webMode {
+		query.Set("web", "1")
+	}
+	u.RawQuery = query.Encode()
+
+	log.Printf("echo server at %s, %d clients -> %s", gs.Addr(), clientCount, u.String())
+
+	stats := &loadStats{}
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+
+	for i := 0; i < clientCount; i++ {
+		wg.Add(1)
+
+		var delay time.Duration
+		if clientCount > 1 {
+			delay = rampUp * time.Duration(i) / time.Duration(clientCount)
+		}
+
+		go func(id int, delay time.Duration) {
+			defer wg.Done()
+
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+
+			runClient(id, u.String(), kinds, stats, stop)
+		}(i, delay)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	deadline := time.After(duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			log.Println(stats.progress(time.Since(start)))
+		case <-deadline:
+			break loop
+		}
+	}
+
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	fmt.Print(stats.report(time.Since(start)))
+}
+
+func runClient(id int, wsURL string, kinds []packetKind, stats *loadStats, stop chan struct{}) {
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		atomic.AddInt64(&stats.dialErrors, 1)
+		log.Printf("client %d dial failed:%v", id, err)
+		return
+	}
+
+	stats.addConnected()
+	defer atomic.AddInt64(&stats.connected, -1)
+
+	if !webMode {
+		ws.SetPingHandler(func(msg string) error {
+			atomic.AddInt64(&stats.pingsAnswer, 1)
+			return ws.WriteControl(websocket.PongMessage, []byte(msg), time.Now().Add(5*time.Second))
+		})
+	}
+
+	writeLock := &sync.Mutex{}
+	write := func(buf []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		return ws.WriteMessage(websocket.BinaryMessage, buf)
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		readLoop(ws, write, stats, stop)
+	}()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	interval := time.Duration(float64(time.Second) / rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			ws.Close()
+			<-readDone
+			return
+		case <-readDone:
+			ws.Close()
+			return
+		case <-ticker.C:
+		}
+
+		kind := pickKind(kinds, rnd)
+		data := make([]byte, kind.size)
+		binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+		rnd.Read(data[8:])
+
+		ops := int32(kind.msg) << 8
+		buf, _ := proto.Marshal(&proxy.ProxyMessage{Ops: &ops, Data: data})
+		err := write(buf)
+		if err != nil {
+			atomic.AddInt64(&stats.sendErrors, 1)
+			ws.Close()
+			<-readDone
+			return
+		}
+
+		atomic.AddInt64(&stats.sent, 1)
+		atomic.AddInt64(&stats.sentBytes, int64(len(buf)))
+	}
+}
+
+func readLoop(ws *websocket.Conn, write func([]byte) error, stats *loadStats, stop chan struct{}) {
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				atomic.AddInt64(&stats.readErrors, 1)
+			}
+			return
+		}
+
+		gmsg := &proxy.ProxyMessage{}
+		err = proto.Unmarshal(message, gmsg)
+		if err != nil {
+			atomic.AddInt64(&stats.readErrors, 1)
+			continue
+		}
+
+		ops := gmsg.GetOps()
+		data := gmsg.GetData()
+		switch {
+		case ops > 255:
+			atomic.AddInt64(&stats.received, 1)
+			atomic.AddInt64(&stats.recvBytes, int64(len(message)))
+			if len(data) >= 8 {
+				sentAt := int64(binary.LittleEndian.Uint64(data))
+				stats.addLatency(time.Duration(time.Now().UnixNano() - sentAt))
+			}
+		case ops == int32(proxy.MessageCode_OPPing):
+			// web模式下代理发送自定义ping，需要回复pong
+			pong := int32(proxy.MessageCode_OPPong)
+			buf, _ := proto.Marshal(&proxy.ProxyMessage{Ops: &pong, Data: data})
+			if write(buf) == nil {
+				atomic.AddInt64(&stats.pingsAnswer, 1)
+			}
+		}
+	}
+}
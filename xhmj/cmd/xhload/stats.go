@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadStats 压测统计，计数用原子操作，延迟样本加锁收集
+type loadStats struct {
+	connected   int64 // 当前连接数
+	connects    int64 // 成功建立的连接总数
+	peak        int64 // 同时在线的最大连接数
+	dialErrors  int64
+	sendErrors  int64
+	readErrors  int64
+	sent        int64
+	received    int64
+	sentBytes   int64
+	recvBytes   int64
+	pingsAnswer int64
+
+	lock      sync.Mutex
+	latencies []time.Duration
+}
+
+// addConnected 连接成功，同时更新总数以及峰值
+func (st *loadStats) addConnected() {
+	atomic.AddInt64(&st.connects, 1)
+	n := atomic.AddInt64(&st.connected, 1)
+	for {
+		peak := atomic.LoadInt64(&st.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&st.peak, peak, n) {
+			return
+		}
+	}
+}
+
+func (st *loadStats) addLatency(d time.Duration) {
+	st.lock.Lock()
+	st.latencies = append(st.latencies, d)
+	st.lock.Unlock()
+}
+
+func (st *loadStats) progress(elapsed time.Duration) string {
+	return fmt.Sprintf("%6.1fs conns:%d sent:%d recv:%d errors:%d",
+		elapsed.Seconds(),
+		atomic.LoadInt64(&st.connected),
+		atomic.LoadInt64(&st.sent),
+		atomic.LoadInt64(&st.received),
+		st.errors())
+}
+
+func (st *loadStats) errors() int64 {
+	return atomic.LoadInt64(&st.dialErrors) + atomic.LoadInt64(&st.sendErrors) + atomic.LoadInt64(&st.readErrors)
+}
+
+func (st *loadStats) report(elapsed time.Duration) string {
+	st.lock.Lock()
+	lat := make([]time.Duration, len(st.latencies))
+	copy(lat, st.latencies)
+	st.lock.Unlock()
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+
+	secs := elapsed.Seconds()
+	s := fmt.Sprintf("duration:        %.1fs\n", secs)
+	s += fmt.Sprintf("connected:       %d, peak:%d\n", st.connects, st.peak)
+	s += fmt.Sprintf("sent:            %d packets, %.1f pkt/s, %.1f KiB/s\n",
+		st.sent, float64(st.sent)/secs, float64(st.sentBytes)/1024/secs)
+	s += fmt.Sprintf("received:        %d packets, %.1f pkt/s, %.1f KiB/s\n",
+		st.received, float64(st.received)/secs, float64(st.recvBytes)/1024/secs)
+	s += fmt.Sprintf("pings answered:  %d\n", st.pingsAnswer)
+	s += fmt.Sprintf("errors:          dial:%d send:%d read:%d\n", st.dialErrors, st.sendErrors, st.readErrors)
+
+	if len(lat) > 0 {
+		s += fmt.Sprintf("latency:         p50:%v p90:%v p99:%v max:%v\n",
+			percentile(lat, 0.50), percentile(lat, 0.90), percentile(lat, 0.99), lat[len(lat)-1])
+	}
+
+	return s
+}
+
+// percentile sorted必须已经升序排列
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
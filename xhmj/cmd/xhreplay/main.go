@@ -0,0 +1,343 @@
+// xhreplay 回放代理抓包文件中的一个会话
+//
+// client模式：作为客户端，把会话中客户端发出的包（dir=up）重新发往游戏服务器，
+// 可以直连游戏服务器的tcp端口，也可以通过代理的websocket地址发送
+//
+// server模式：作为游戏服务器，监听tcp端口，把会话中游戏服务器发出的包（dir=down）
+// 回放给连接上来的客户端（通常是代理）
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"xhmj/proxy"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	mode       = "client"
+	sessionKey = ""
+	tcpAddr    = ""
+	wsURL      = ""
+	listenAddr = ":9000"
+	speed      = 1.0
+)
+
+func init() {
+	flag.StringVar(&mode, "m", "client", "replay mode: client or server")
+	flag.StringVar(&sessionKey, "sid", "", "session to replay as RUN/SID (see the run field in capture), "+
+		"a bare SID if it is unique across runs, empty means the first session in capture")
+	flag.StringVar(&tcpAddr, "tcp", "", "client mode: game server tcp address")
+	flag.StringVar(&wsURL, "ws", "", "client mode: proxy websocket URL, e.g. ws://host:3001/game/x/ws/play?target=ip:port")
+	flag.StringVar(&listenAddr, "l", ":9000", "server mode: tcp listen address")
+	flag.Float64Var(&speed, "speed", 1.0, "replay speed factor, 0 means as fast as possible")
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: xhreplay [options] capture.jsonl [capture.jsonl ...]")
+	}
+
+	var dir string
+	switch mode {
+	case "client":
+		dir = proxy.DirUpstream.String()
+	case "server":
+		dir = proxy.DirDownstream.String()
+	default:
+		log.Fatal("unknown mode:", mode)
+	}
+
+	records, key, err := loadSession(flag.Args(), sessionKey, dir)
+	if err != nil {
+		log.Fatal("load capture failed:", err)
+	}
+
+	if len(records) == 0 {
+		log.Fatal("no packet found in capture")
+	}
+
+	log.Printf("replay session %s, %d packets, mode:%s", key, len(records), mode)
+
+	if mode == "client" {
+		replayAsClient(records)
+	} else {
+		replayAsServer(records)
+	}
+}
+
+// loadSession 读取抓包文件，过滤出指定会话指定方向的记录，按时间排序（滚动后的文件可以按任意顺序给出）；
+// key为RUN/SID，只给出SID时该SID必须只出现在一次启动中，为空时选择时间最早的会话；返回实际选择的会话
+func loadSession(files []string, key string, dir string) ([]*proxy.CaptureRecord, string, error) {
+	var all []*proxy.CaptureRecord
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, "", err
+		}
+
+		reader := proxy.NewCaptureReader(f)
+		for {
+			rec, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return nil, "", err
+			}
+
+			all = append(all, rec)
+		}
+
+		f.Close()
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.Before(all[j].Time)
+	})
+
+	key, err := resolveSessionKey(all, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var records []*proxy.CaptureRecord
+	for _, rec := range all {
+		if rec.SessionKey() == key && rec.Dir == dir {
+			records = append(records, rec)
+		}
+	}
+
+	return records, key, nil
+}
+
+// resolveSessionKey 把-sid参数转换为RUN/SID
+func resolveSessionKey(records []*proxy.CaptureRecord, key string) (string, error) {
+	if key == "" {
+		if len(records) == 0 {
+			return "", nil
+		}
+		return records[0].SessionKey(), nil
+	}
+
+	if strings.Contains(key, "/") {
+		return key, nil
+	}
+
+	sid, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid session:%s", key)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		k := rec.SessionKey()
+		if rec.SID == sid && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+
+	switch len(keys) {
+	case 0:
+		return "", fmt.Errorf("session %d not found", sid)
+	case 1:
+		return keys[0], nil
+	}
+
+	return "", fmt.Errorf("session %d appears in multiple runs, use one of: %s", sid, strings.Join(keys, " "))
+}
+
+// waitFor 按原始时间间隔（除以speed）等待
+func waitFor(prev, cur *proxy.CaptureRecord) {
+	if prev == nil || speed <= 0 {
+		return
+	}
+
+	diff := cur.Time.Sub(prev.Time)
+	if diff > 0 {
+		time.Sleep(time.Duration(float64(diff) / speed))
+	}
+}
+
+func replayAsClient(records []*proxy.CaptureRecord) {
+	switch {
+	case wsURL != "":
+		replayViaWebsocket(records)
+	case tcpAddr != "":
+		replayViaTCP(records)
+	default:
+		log.Fatal("client mode requires -ws or -tcp")
+	}
+}
+
+func replayViaWebsocket(records []*proxy.CaptureRecord) {
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		log.Fatal("dial websocket failed:", err)
+	}
+	defer ws.Close()
+
+	go func() {
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				log.Println("websocket read error:", err)
+				return
+			}
+
+			gmsg := &proxy.ProxyMessage{}
+			err = proto.Unmarshal(message, gmsg)
+			if err != nil {
+				log.Println("decode ProxyMessage failed:", err)
+				continue
+			}
+
+			log.Printf("<- ops:%d, size:%d", gmsg.GetOps(), len(gmsg.GetData()))
+		}
+	}()
+
+	var prev *proxy.CaptureRecord
+	for _, rec := range records {
+		waitFor(prev, rec)
+		prev = rec
+
+		ops := rec.Ops
+		gmsg := &proxy.ProxyMessage{Ops: &ops, Data: rec.Data}
+		buf, err := proto.Marshal(gmsg)
+		if err != nil {
+			log.Fatal("marshal ProxyMessage failed:", err)
+		}
+
+		err = ws.WriteMessage(websocket.BinaryMessage, buf)
+		if err != nil {
+			log.Fatal("websocket write failed:", err)
+		}
+
+		log.Printf("-> ops:%d, size:%d", rec.Ops, len(rec.Data))
+	}
+
+	// 留一点时间接收回复
+	time.Sleep(time.Second)
+	log.Println("replay completed")
+}
+
+func replayViaTCP(records []*proxy.CaptureRecord) {
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		log.Fatal("dial tcp failed:", err)
+	}
+	defer conn.Close()
+
+	go drainGamePackets(conn)
+
+	var prev *proxy.CaptureRecord
+	for _, rec := range records {
+		// 只有游戏消息才会发往游戏服务器，ping/pong等代理消息忽略
+		if rec.Ops <= 255 {
+			continue
+		}
+
+		waitFor(prev, rec)
+		prev = rec
+
+		buf, err := proxy.EncodeGamePacket(uint16(rec.Ops>>8), 0, rec.Data)
+		if err != nil {
+			log.Fatal("encode game packet failed:", err)
+		}
+
+		_, err = conn.Write(buf)
+		if err != nil {
+			log.Fatal("tcp write failed:", err)
+		}
+
+		log.Printf("-> msg:%d, size:%d", rec.Ops>>8, len(rec.Data))
+	}
+
+	time.Sleep(time.Second)
+	log.Println("replay completed")
+}
+
+func replayAsServer(records []*proxy.CaptureRecord) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal("listen failed:", err)
+	}
+
+	log.Println("replay server listen at:", listenAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal("accept failed:", err)
+		}
+
+		log.Println("accept client:", conn.RemoteAddr())
+		go drainGamePackets(conn)
+		serveReplay(conn, records)
+		conn.Close()
+	}
+}
+
+func serveReplay(conn net.Conn, records []*proxy.CaptureRecord) {
+	var prev *proxy.CaptureRecord
+	for _, rec := range records {
+		if rec.Ops <= 255 {
+			continue
+		}
+
+		waitFor(prev, rec)
+		prev = rec
+
+		var flag byte
+		if rec.Header != nil {
+			flag = rec.Header.Flag
+		}
+
+		buf, err := proxy.EncodeGamePacket(uint16(rec.Ops>>8), flag, rec.Data)
+		if err != nil {
+			log.Println("encode game packet failed:", err)
+			return
+		}
+
+		_, err = conn.Write(buf)
+		if err != nil {
+			log.Println("tcp write failed:", err)
+			return
+		}
+
+		log.Printf("-> msg:%d, flag:%d, size:%d", rec.Ops>>8, flag, len(rec.Data))
+	}
+
+	// 等待客户端断开，避免回放结束马上关闭连接
+	time.Sleep(time.Second)
+	log.Println("replay completed for:", conn.RemoteAddr())
+}
+
+func drainGamePackets(conn net.Conn) {
+	for {
+		msg, flag, body, err := proxy.ReadGamePacket(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("tcp read error:", err)
+			}
+			return
+		}
+
+		log.Printf("<- msg:%d, flag:%d, size:%d", msg, flag, len(body))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xhmj/proxy"
+)
+
+// writeCapture 把记录写成抓包文件
+func writeCapture(t *testing.T, filename string, records ...*proxy.CaptureRecord) {
+	t.Helper()
+
+	var buf []byte
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	err := os.WriteFile(filename, buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSession(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec := func(sec int, run string, sid uint64, d string, data string) *proxy.CaptureRecord {
+		return &proxy.CaptureRecord{Time: start.Add(time.Duration(sec) * time.Second), Run: run, SID: sid,
+			Dir: d, Ops: 3 << 8, Data: []byte(data)}
+	}
+
+	// 两次启动都有会话1；滚动后的旧文件在前
+	older := filepath.Join(dir, "capture.jsonl.1")
+	current := filepath.Join(dir, "capture.jsonl")
+	writeCapture(t, older,
+		rec(1, "runA", 1, "up", "a1"),
+		rec(2, "runA", 1, "down", "a1 reply"),
+		rec(3, "runA", 2, "up", "a2"),
+		rec(4, "runA", 1, "up", "a3"))
+	writeCapture(t, current,
+		rec(10, "runB", 1, "up", "b1"),
+		rec(11, "runB", 1, "up", "b2"))
+
+	data := func(records []*proxy.CaptureRecord) string {
+		var s []string
+		for _, r := range records {
+			s = append(s, string(r.Data))
+		}
+		return strings.Join(s, ",")
+	}
+
+	// 文件顺序颠倒时仍然按时间回放
+	records, key, err := loadSession([]string{current, older}, "", "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "runA/1" || data(records) != "a1,a3" {
+		t.Fatalf("unexpected first session %s:%s", key, data(records))
+	}
+
+	records, _, err = loadSession([]string{current, older}, "runB/1", "up")
+	if err != nil || data(records) != "b1,b2" {
+		t.Fatalf("unexpected runB session:%s %v", data(records), err)
+	}
+
+	records, key, err = loadSession([]string{current, older}, "2", "up")
+	if err != nil || key != "runA/2" || data(records) != "a2" {
+		t.Fatalf("unexpected bare sid session %s:%s %v", key, data(records), err)
+	}
+
+	records, _, err = loadSession([]string{older}, "runA/1", "down")
+	if err != nil || data(records) != "a1 reply" {
+		t.Fatalf("unexpected downstream records:%s %v", data(records), err)
+	}
+
+	// 会话1出现在两次启动中，只给SID时不合并
+	_, _, err = loadSession([]string{current, older}, "1", "up")
+	if err == nil || !strings.Contains(err.Error(), "runA/1") || !strings.Contains(err.Error(), "runB/1") {
+		t.Fatalf("expected ambiguous session error, got %v", err)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"gscfg"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"time"
 	"xhmj/proxy"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +18,14 @@ var (
 	cfgFilepath   = ""
 	etcdServerURL = ""
 	serverUUID    = ""
+
+	opsCounter = proxy.NewOpsCounter()
+
+	proxyServer *proxy.Server
+)
+
+const (
+	shutdownTimeout = 10 * time.Second
 )
 
 func init() {
@@ -63,6 +73,25 @@ func main() {
 		//}
 	}
 
+	err := proxy.SetupLogging(proxy.LogConfig{
+		Level:    gscfg.LogLevel,
+		Format:   gscfg.LogFormat,
+		File:     gscfg.LogFile,
+		MaxSize:  gscfg.LogMaxSize,
+		MaxFiles: gscfg.LogMaxFiles,
+	})
+	if err != nil {
+		log.Fatal("setup logging failed:", err)
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if gscfg.OTLPEndpoint != "" {
+		shutdownTracing, err = proxy.SetupTracing(context.Background(), gscfg.OTLPEndpoint, gscfg.ServerID)
+		if err != nil {
+			log.Fatal("setup tracing failed:", err)
+		}
+	}
+
 	log.Println("try to start mjserver...")
 
 	// if config.Daemon == "yes" && config.LogFile != "" {
@@ -70,7 +99,16 @@ func main() {
 	// 	signal.Notify(sighup, syscall.SIGHUP)
 	// }
 
-	proxy.CreateHTTPServer()
+	proxyServer = proxy.New(newProxyConfig(),
+		// 拦截器链，按顺序对每个解码后的包（两个方向）调用
+		proxy.WithInterceptors(opsCounter),
+	)
+
+	err = proxyServer.Start(context.Background())
+	if err != nil {
+		log.Fatal("start proxy server failed:", err)
+	}
+
 	log.Println("start mjserver ok!")
 
 	if gscfg.Daemon == "yes" {
@@ -78,9 +116,125 @@ func main() {
 	} else {
 		waitInput()
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = proxyServer.Shutdown(ctx)
+	if err != nil {
+		log.Println("shutdown proxy server failed:", err)
+	}
+
+	// 导出剩余的span
+	err = shutdownTracing(ctx)
+	if err != nil {
+		log.Println("shutdown tracing failed:", err)
+	}
 	return
 }
 
+// newProxyConfig 把gscfg中的配置转换为代理的配置
+func newProxyConfig() *proxy.Config {
+	return &proxy.Config{
+		ServerID:        gscfg.ServerID,
+		ServerPort:      gscfg.ServerPort,
+		RedisServer:     gscfg.RedisServer,
+		ClientTCPAddr:   gscfg.ClientTCPAddr,
+		ClientUDPAddr:   gscfg.ClientUDPAddr,
+		ProxyScheme:     gscfg.ProxyScheme,
+		ProxyTarget:     gscfg.ProxyTarget,
+		CaptureDir:      gscfg.CaptureDir,
+		CaptureMaxSize:  gscfg.CaptureMaxSize,
+		CaptureMaxFiles: gscfg.CaptureMaxFiles,
+		IdleTimeout:     time.Duration(gscfg.IdleTimeout) * time.Second,
+		PingIdle:        time.Duration(gscfg.PingIdle) * time.Second,
+		PingInterval:    time.Duration(gscfg.PingInterval) * time.Second,
+		PushRTT:         gscfg.PushRTT,
+		LogSampleRate:   gscfg.LogSampleRate,
+
+		Compression:          gscfg.Compression,
+		CompressionLevel:     gscfg.CompressionLevel,
+		CompressionThreshold: gscfg.CompressionThreshold,
+
+		WS: newWSLimits(gscfg.WSLimits{
+			ReadLimit:       gscfg.WSReadLimit,
+			ReadBufferSize:  gscfg.WSReadBufferSize,
+			WriteBufferSize: gscfg.WSWriteBufferSize,
+		}),
+		WSRoutes:       newWSRouteLimits(),
+		MaxHeaderBytes: gscfg.MaxHeaderBytes,
+
+		UpstreamKeepAlive:         time.Duration(gscfg.UpstreamKeepAlive) * time.Second,
+		UpstreamReadTimeout:       time.Duration(gscfg.UpstreamReadTimeout) * time.Second,
+		UpstreamHeartbeatMsg:      uint16(gscfg.UpstreamHeartbeatMsg),
+		UpstreamHeartbeatInterval: time.Duration(gscfg.UpstreamHeartbeatInterval) * time.Second,
+
+		Routes:         newProxyRoutes(),
+		ForwardMaxBody: int64(gscfg.ForwardMaxBody) << 10,
+		ForwardRetries: gscfg.ForwardRetries,
+		TrustedProxies: gscfg.TrustedProxies,
+
+		CacheBackend:    gscfg.CacheBackend,
+		CacheMaxEntries: gscfg.CacheMaxEntries,
+		BreakerFailures: gscfg.BreakerFailures,
+		BreakerCooldown: time.Duration(gscfg.BreakerCooldown) * time.Second,
+	}
+}
+
+func newWSLimits(l gscfg.WSLimits) proxy.WSLimits {
+	return proxy.WSLimits{
+		ReadLimit:       int64(l.ReadLimit),
+		ReadBufferSize:  l.ReadBufferSize,
+		WriteBufferSize: l.WriteBufferSize,
+	}
+}
+
+// newWSRouteLimits 把gscfg中按wtype的websocket限制转换为代理的配置
+func newWSRouteLimits() map[string]proxy.WSLimits {
+	routes := make(map[string]proxy.WSLimits, len(gscfg.WSRoutes))
+	for wtype, l := range gscfg.WSRoutes {
+		routes[wtype] = newWSLimits(l)
+	}
+
+	return routes
+}
+
+// newProxyRoutes 把gscfg中的转发规则转换为代理的转发规则，没有配置时按proxyScheme/proxyTarget转发登录，
+// 重新加载配置后proxyTarget的修改也因此生效
+func newProxyRoutes() []proxy.Route {
+	if len(gscfg.Routes) == 0 {
+		return proxy.DefaultRoutes(gscfg.ProxyScheme, gscfg.ProxyTarget)
+	}
+
+	routes := make([]proxy.Route, 0, len(gscfg.Routes))
+	for _, r := range gscfg.Routes {
+		routes = append(routes, proxy.Route{
+			Method:        r.Method,
+			Path:          r.Path,
+			Upstream:      r.Upstream,
+			Rewrite:       r.Rewrite,
+			Timeout:       time.Duration(r.Timeout) * time.Second,
+			AddHeaders:    r.AddHeaders,
+			RemoveHeaders: r.RemoveHeaders,
+			CacheTTL:      time.Duration(r.CacheTTL) * time.Second,
+		})
+	}
+
+	return routes
+}
+
+// reloadConfig 重新加载配置文件，并更新可以在运行时修改的代理配置
+func reloadConfig() {
+	if !gscfg.ReLoadConfigFile() {
+		return
+	}
+
+	err := proxyServer.SetRoutes(newProxyRoutes())
+	if err != nil {
+		log.Println("reload forward routes failed, keep the previous routes:", err)
+	}
+}
+
 func waitInput() {
 	var cmd string
 	for {
@@ -100,6 +254,13 @@ func waitInput() {
 		case "gd":
 			pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
 			break
+		case "reload":
+			reloadConfig()
+			break
+		case "ops":
+			log.Println("upstream ops count:", opsCounter.Snapshot(proxy.DirUpstream))
+			log.Println("downstream ops count:", opsCounter.Snapshot(proxy.DirDownstream))
+			break
 		default:
 			break
 		}
@@ -1,50 +1,260 @@
 package proxy
 
 import (
+	"container/heap"
+	"context"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	keeperAwakeTime = 5 * time.Second
-	diff2Close      = 90
+	defaultIdleTimeout  = 90 * time.Second // 超过该时间没有收到数据，认为客户端已经断开
+	defaultPingIdle     = 45 * time.Second // 超过该时间没有收到数据，开始发送ping
+	defaultPingInterval = 30 * time.Second // 两次ping之间的最小间隔
+
+	pingWorkers   = 4    // 发送ping的goroutine数量，某个会话写阻塞不影响其他会话
+	pingQueueSize = 1024 // 待发送ping的队列长度，队列满时本轮跳过，下次到期再发
 )
 
-func startAliveKeeper() {
-	go doAliveKeep()
+// keepEntry 一个会话在保活堆中的条目，deadline为下次需要检查的时间
+type keepEntry struct {
+	holder       *pairHolder
+	deadline     time.Time
+	lastPingTime time.Time
+	index        int
+}
+
+// keepHeap 按deadline排序的最小堆
+type keepHeap []*keepEntry
+
+func (h keepHeap) Len() int           { return len(h) }
+func (h keepHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h keepHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *keepHeap) Push(x interface{}) {
+	e := x.(*keepEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *keepHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// aliveKeeper websocket保活：每个会话一个截止时间，保存在最小堆中，
+// 只在最早的截止时间到达时唤醒，而不是周期性地扫描所有会话；
+// 收到数据时只更新会话的lastReceivedTime，到期时再重新计算截止时间
+type aliveKeeper struct {
+	lock    sync.Mutex
+	entries keepHeap
+	wakeup  chan struct{}
+	pings   chan *pairHolder
+
+	idleTimeout  time.Duration
+	pingIdle     time.Duration
+	pingInterval time.Duration
+}
+
+func newAliveKeeper(cfg *Config) *aliveKeeper {
+	k := &aliveKeeper{
+		wakeup:       make(chan struct{}, 1),
+		pings:        make(chan *pairHolder, pingQueueSize),
+		idleTimeout:  cfg.IdleTimeout,
+		pingIdle:     cfg.PingIdle,
+		pingInterval: cfg.PingInterval,
+	}
+
+	if k.idleTimeout <= 0 {
+		k.idleTimeout = defaultIdleTimeout
+	}
+
+	if k.pingIdle <= 0 {
+		k.pingIdle = defaultPingIdle
+	}
+
+	if k.pingInterval <= 0 {
+		k.pingInterval = defaultPingInterval
+	}
+
+	return k
+}
+
+// add 会话开始时加入保活
+func (k *aliveKeeper) add(ph *pairHolder) {
+	e := &keepEntry{holder: ph}
+	e.deadline = k.nextDeadline(e, time.Now())
+
+	k.lock.Lock()
+	heap.Push(&k.entries, e)
+	ph.keepEntry = e
+	first := e.index == 0
+	k.lock.Unlock()
+
+	if first {
+		k.notify()
+	}
+}
+
+// remove 会话结束时移出保活
+func (k *aliveKeeper) remove(ph *pairHolder) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	e := ph.keepEntry
+	if e != nil && e.index >= 0 {
+		heap.Remove(&k.entries, e.index)
+	}
+	ph.keepEntry = nil
+}
+
+func (k *aliveKeeper) notify() {
+	select {
+	case k.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// nextDeadline 根据最后收到数据以及最后发送ping的时间计算下次检查时间
+func (k *aliveKeeper) nextDeadline(e *keepEntry, now time.Time) time.Time {
+	last := e.holder.lastReceived()
+	deadline := last.Add(k.idleTimeout)
+
+	ping := last.Add(k.pingIdle)
+	if next := e.lastPingTime.Add(k.pingInterval); next.After(ping) {
+		ping = next
+	}
+
+	if ping.Before(deadline) {
+		deadline = ping
+	}
+
+	if !deadline.After(now) {
+		// 至少间隔一点时间，避免忙等
+		deadline = now.Add(time.Second)
+	}
+
+	return deadline
 }
 
-func doAliveKeep() {
+func (k *aliveKeeper) run(ctx context.Context) {
 	defer func() {
 		if r := recover(); r != nil {
 			debug.PrintStack()
-			log.Printf("-----This DoAliveKeep GR will die, Recovered in doAliveKeep:%v\n", r)
+			log.Printf("-----This aliveKeeper GR will die, Recovered in aliveKeeper.run:%v\n", r)
 		}
 	}()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
 	for {
-		// 每间隔keeperAwakeTime唤醒一次，唤醒后检查usersMap中的websocket
-		// 最后一个消息的接收时间
-		time.Sleep(keeperAwakeTime)
-
-		now := time.Now()
-		// 如果时间大于90s，则认为客户端已经断开，直接关闭websocket
-		for e := pairHolderList.Front(); e != nil; e = e.Next() {
-			v := e.Value.(*pairHolder)
-
-			diff := now.Sub(v.lastReceivedTime)
-			if diff > diff2Close*time.Second {
-				log.Printf("user not response exceed %ds, close its ws\n", diff2Close)
-				v.closeWebsocket()
-			} else if diff >= diff2Close/2*time.Second {
-				// 如果时间大于30s，则发送一个ping消息
-				diff = now.Sub(v.lastPingTime)
-				if diff >= diff2Close/3*time.Second {
-					v.sendPing()
-					v.lastPingTime = now
-				}
+		k.lock.Lock()
+		wait := time.Hour
+		if len(k.entries) > 0 {
+			wait = time.Until(k.entries[0].deadline)
+		}
+		k.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
 		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-k.wakeup:
+		case <-timer.C:
+			k.expire(time.Now())
+		}
 	}
 }
+
+// expire 处理所有到期的会话：超时的关闭，空闲的发送ping，然后重新计算截止时间
+func (k *aliveKeeper) expire(now time.Time) {
+	var toClose []*pairHolder
+
+	k.lock.Lock()
+	for len(k.entries) > 0 && !k.entries[0].deadline.After(now) {
+		e := k.entries[0]
+		ph := e.holder
+
+		idle := now.Sub(ph.lastReceived())
+		if idle > k.idleTimeout {
+			heap.Pop(&k.entries)
+			ph.keepEntry = nil
+			toClose = append(toClose, ph)
+			continue
+		}
+
+		if idle >= k.pingIdle && now.Sub(e.lastPingTime) >= k.pingInterval {
+			e.lastPingTime = now
+			k.dispatchPing(ph)
+		}
+
+		e.deadline = k.nextDeadline(e, now)
+		heap.Fix(&k.entries, 0)
+	}
+	k.lock.Unlock()
+
+	for _, ph := range toClose {
+		ph.log.Printf("user not response exceed %v, close its ws", k.idleTimeout)
+		ph.close()
+	}
+}
+
+// dispatchPing 不阻塞地把ping交给发送goroutine，同一会话同时最多一个待发送的ping
+func (k *aliveKeeper) dispatchPing(ph *pairHolder) {
+	if !atomic.CompareAndSwapInt32(&ph.pinging, 0, 1) {
+		return
+	}
+
+	select {
+	case k.pings <- ph:
+	default:
+		atomic.StoreInt32(&ph.pinging, 0)
+	}
+}
+
+func (k *aliveKeeper) pingWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ph := <-k.pings:
+			ph.sendPing()
+			atomic.StoreInt32(&ph.pinging, 0)
+		}
+	}
+}
+
+func (s *Server) startAliveKeeper() {
+	defer s.wg.Done()
+
+	for i := 0; i < pingWorkers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.keeper.pingWorker(s.ctx)
+		}()
+	}
+
+	s.keeper.run(s.ctx)
+}
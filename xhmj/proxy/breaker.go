@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 10 * time.Second
+
+	// 游戏服务器地址来自客户端，熔断器按需创建：关闭并且空闲超过breakerIdleTimeout的熔断器被清理，
+	// 数量达到maxBreakers后新的上游使用不登记的熔断器
+	breakerIdleTimeout = 10 * time.Minute
+	maxBreakers        = 1024
+)
+
+var (
+	errCircuitOpen = errors.New("upstream circuit open")
+)
+
+// breakerState 熔断器状态
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // 正常放行
+	breakerOpen                         // 直接失败，冷却时间后进入半开
+	breakerHalfOpen                     // 只放行一个探测请求，成功则关闭，失败则重新打开
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// breaker 一个上游的熔断器：连续失败failures次后打开，
+// 打开期间直接返回errCircuitOpen，不再等待上游超时
+type breaker struct {
+	lock sync.Mutex
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	rejected uint64
+	lastUsed time.Time
+
+	threshold int
+	cooldown  time.Duration
+}
+
+// allow 是否放行请求，放行后必须调用done报告结果
+func (b *breaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastUsed = time.Now()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.rejected++
+			return errCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+// done 报告请求结果，返回之前以及之后的状态
+func (b *breaker) done(ok bool) (from, to breakerState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	from = b.state
+	b.probing = false
+	if ok {
+		b.state = breakerClosed
+		b.failures = 0
+		return from, b.state
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+
+	return from, b.state
+}
+
+// idle 关闭并且长时间没有请求，可以清理
+func (b *breaker) idle(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state == breakerClosed && !b.probing && now.Sub(b.lastUsed) > breakerIdleTimeout
+}
+
+func (b *breaker) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// breakerInfo 熔断器状态，用于管理接口以及统计
+type breakerInfo struct {
+	Upstream string     `json:"upstream"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+	Rejected uint64     `json:"rejected"`
+
+	state breakerState
+}
+
+func (b *breaker) info(upstream string) breakerInfo {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bi := breakerInfo{
+		Upstream: upstream,
+		State:    b.state.String(),
+		Failures: b.failures,
+		Rejected: b.rejected,
+		state:    b.state,
+	}
+
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		bi.OpenedAt = &openedAt
+	}
+
+	return bi
+}
+
+// breakerSet 按上游地址（http转发为scheme://host，游戏服务器为tcp://host:port）区分的熔断器
+type breakerSet struct {
+	lock      sync.Mutex
+	breakers  map[string]*breaker
+	lastSweep time.Time
+
+	threshold int
+	cooldown  time.Duration
+}
+
+// newBreakerSet BreakerFailures为负数时不熔断，返回nil
+func newBreakerSet(cfg *Config) *breakerSet {
+	if cfg.BreakerFailures < 0 {
+		return nil
+	}
+
+	bs := &breakerSet{
+		breakers:  make(map[string]*breaker),
+		threshold: cfg.BreakerFailures,
+		cooldown:  cfg.BreakerCooldown,
+	}
+
+	if bs.threshold == 0 {
+		bs.threshold = defaultBreakerFailures
+	}
+
+	if bs.cooldown <= 0 {
+		bs.cooldown = defaultBreakerCooldown
+	}
+
+	return bs
+}
+
+func (bs *breakerSet) get(upstream string) *breaker {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	b, ok := bs.breakers[upstream]
+	if ok {
+		return b
+	}
+
+	b = &breaker{threshold: bs.threshold, cooldown: bs.cooldown, lastUsed: time.Now()}
+
+	now := time.Now()
+	if len(bs.breakers) >= maxBreakers || now.Sub(bs.lastSweep) > breakerIdleTimeout {
+		bs.sweep(now)
+	}
+
+	if len(bs.breakers) < maxBreakers {
+		bs.breakers[upstream] = b
+	}
+
+	return b
+}
+
+// lookup 已经登记的熔断器，不存在时返回nil
+func (bs *breakerSet) lookup(upstream string) *breaker {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	return bs.breakers[upstream]
+}
+
+// sweep 清理空闲的熔断器，调用者持有bs.lock
+func (bs *breakerSet) sweep(now time.Time) {
+	bs.lastSweep = now
+	for k, b := range bs.breakers {
+		if b.idle(now) {
+			delete(bs.breakers, k)
+		}
+	}
+}
+
+// call 经过熔断器执行fn，fn返回的ok表示上游是否正常
+func (bs *breakerSet) call(upstream string, fn func() bool) error {
+	if bs == nil {
+		fn()
+		return nil
+	}
+
+	b := bs.get(upstream)
+	err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	from, to := b.done(fn())
+	if from != to {
+		log.Warnf("circuit breaker of %s: %s -> %s", upstream, from, to)
+	}
+
+	return nil
+}
+
+func (bs *breakerSet) infos() []breakerInfo {
+	if bs == nil {
+		return nil
+	}
+
+	bs.lock.Lock()
+	infos := make([]breakerInfo, 0, len(bs.breakers))
+	for k, b := range bs.breakers {
+		infos = append(infos, b.info(k))
+	}
+	bs.lock.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Upstream < infos[j].Upstream })
+	return infos
+}
+
+// breakerTransport 按上游的熔断器转发请求：连接失败、超时以及502/503/504计为失败，
+// 客户端主动取消的请求不计入
+type breakerTransport struct {
+	base     http.RoundTripper
+	breakers *breakerSet
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	upstream := req.URL.Scheme + "://" + req.URL.Host
+	cerr := t.breakers.call(upstream, func() bool {
+		resp, err = t.base.RoundTrip(req)
+		if err != nil {
+			return errors.Is(req.Context().Err(), context.Canceled)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return false
+		}
+
+		return true
+	})
+
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return resp, err
+}
+
+// breakersHandle 熔断器状态，reset=上游地址时把该熔断器恢复为关闭，没有该熔断器时返回404
+func (s *Server) breakersHandle(w http.ResponseWriter, r *http.Request) {
+	if upstream := r.URL.Query().Get("reset"); upstream != "" {
+		var b *breaker
+		if s.breakers != nil {
+			b = s.breakers.lookup(upstream)
+		}
+
+		if b == nil {
+			http.Error(w, "circuit breaker not found: "+upstream, http.StatusNotFound)
+			return
+		}
+
+		b.reset()
+		log.Println("circuit breaker reset by admin:", upstream)
+	}
+
+	infos := s.breakers.infos()
+	if infos == nil {
+		infos = []breakerInfo{}
+	}
+
+	buf, _ := json.Marshal(infos)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -0,0 +1,556 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// cacheKeyPrefix redis中缓存回复的key前缀，多个代理实例共用
+	cacheKeyPrefix = "xhproxy:cache:"
+
+	defaultCacheMaxEntries = 1024
+	maxCachedBody          = 1 << 20 // 超过该大小的回复不缓存
+
+	// cacheStaleTTL 带有ETag/Last-Modified的回复过期后继续保留的时间，用于向上游做条件请求
+	cacheStaleTTL = 10 * time.Minute
+)
+
+// cachedResponse 缓存的回复
+type cachedResponse struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Expires time.Time   `json:"expires"`
+}
+
+func (cr *cachedResponse) fresh() bool {
+	return time.Now().Before(cr.Expires)
+}
+
+// validators 用于向上游做条件请求的ETag以及Last-Modified
+func (cr *cachedResponse) validators() (etag, lastModified string) {
+	return cr.Header.Get("ETag"), cr.Header.Get("Last-Modified")
+}
+
+// responseCache 回复缓存的存储，key为请求的路径以及查询参数，之后是空格以及转发的目标地址，
+// 重新加载后规则的上游或者改写变化时不会用到原来的缓存
+type responseCache interface {
+	get(key string) (*cachedResponse, error)
+	set(key string, cr *cachedResponse, ttl time.Duration) error
+	// purge 删除key以prefix开头的缓存，返回删除的个数
+	purge(prefix string) (int, error)
+}
+
+func newResponseCache(cfg *Config, rds Redis) responseCache {
+	if cfg.CacheBackend == "redis" {
+		return &redisCache{redis: rds}
+	}
+
+	maxEntries := cfg.CacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+
+	return &memoryCache{
+		entries:    make(map[string]*memoryCacheEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+type memoryCacheEntry struct {
+	cr       *cachedResponse
+	expireAt time.Time
+}
+
+// memoryCache 进程内的缓存，条目数超过上限时先清理过期的条目，仍然超过则随机淘汰
+type memoryCache struct {
+	lock       sync.Mutex
+	entries    map[string]*memoryCacheEntry
+	maxEntries int
+}
+
+func (mc *memoryCache) get(key string) (*cachedResponse, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	e, ok := mc.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if time.Now().After(e.expireAt) {
+		delete(mc.entries, key)
+		return nil, nil
+	}
+
+	return e.cr, nil
+}
+
+func (mc *memoryCache) set(key string, cr *cachedResponse, ttl time.Duration) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if _, ok := mc.entries[key]; !ok && len(mc.entries) >= mc.maxEntries {
+		mc.evict()
+	}
+
+	mc.entries[key] = &memoryCacheEntry{cr: cr, expireAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (mc *memoryCache) evict() {
+	now := time.Now()
+	for k, e := range mc.entries {
+		if now.After(e.expireAt) {
+			delete(mc.entries, k)
+		}
+	}
+
+	for k := range mc.entries {
+		if len(mc.entries) < mc.maxEntries {
+			break
+		}
+		delete(mc.entries, k)
+	}
+}
+
+func (mc *memoryCache) purge(prefix string) (int, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	n := 0
+	for k := range mc.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(mc.entries, k)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// redisCache 存放在redis中的缓存，多个代理实例共用
+type redisCache struct {
+	redis Redis
+}
+
+func (rc *redisCache) get(key string) (*cachedResponse, error) {
+	conn := rc.redis.Get()
+	defer conn.Close()
+
+	buf, err := redis.Bytes(conn.Do("GET", cacheKeyPrefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &cachedResponse{}
+	err = json.Unmarshal(buf, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+func (rc *redisCache) set(key string, cr *cachedResponse, ttl time.Duration) error {
+	buf, err := json.Marshal(cr)
+	if err != nil {
+		return err
+	}
+
+	conn := rc.redis.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", cacheKeyPrefix+key, buf, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (rc *redisCache) purge(prefix string) (int, error) {
+	conn := rc.redis.Get()
+	defer conn.Close()
+
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", cacheKeyPrefix+escapeGlob(prefix)+"*", "COUNT", 100))
+		if err != nil {
+			return n, err
+		}
+
+		var keys []string
+		_, err = redis.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return n, err
+		}
+
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, k := range keys {
+				args[i] = k
+			}
+
+			deleted, err := redis.Int(conn.Do("DEL", args...))
+			if err != nil {
+				return n, err
+			}
+			n += deleted
+		}
+
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// escapeGlob 转义redis MATCH模式中的特殊字符，路径中的*、?、[按原样匹配
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+
+	return sb.String()
+}
+
+// flightGroup 合并相同key的并发请求，只有第一个请求访问上游，其他请求等待其结果；
+// 第一个请求的回复不能缓存时（例如private或者带有Set-Cookie）不共用，其他请求各自访问上游
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	cr   *cachedResponse
+}
+
+// do fn返回回复以及该回复是否可以共用
+func (g *flightGroup) do(key string, fn func() (*cachedResponse, bool)) (cr *cachedResponse, shared bool) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		<-c.done
+		if c.cr != nil {
+			return c.cr, true
+		}
+
+		cr, _ = fn()
+		return cr, false
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+
+	cr, share := fn()
+	if share {
+		c.cr = cr
+	}
+	return cr, false
+}
+
+// parseCacheControl 解析Cache-Control头，指令名转为小写
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), "\"")
+	}
+
+	return cc
+}
+
+// cacheable 请求是否可以使用缓存：只缓存不带认证信息以及Cookie的GET请求，
+// 这样的请求也不与其他请求合并
+func cacheable(req *http.Request) bool {
+	return req.Method == "GET" && req.Header.Get("Authorization") == "" && req.Header.Get("Cookie") == ""
+}
+
+// bypassCache 客户端要求不使用缓存，仍然会用上游的回复刷新缓存
+func bypassCache(req *http.Request) bool {
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	_, noStore := cc["no-store"]
+	return noCache || noStore || req.Header.Get("Pragma") == "no-cache"
+}
+
+// responseTTL 回复的缓存时间：只缓存200并且没有Set-Cookie的回复，
+// 上游的Cache-Control禁止缓存时不缓存，max-age/s-maxage小于规则的TTL时以上游为准；
+// 缓存的key不区分请求头，Vary中有Accept-Encoding以外的头时不缓存
+func (fr *forwardRoute) responseTTL(cr *cachedResponse) time.Duration {
+	if cr.Status != http.StatusOK || len(cr.Body) > maxCachedBody || cr.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+
+	for _, v := range cr.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			h = strings.TrimSpace(h)
+			if h != "" && !strings.EqualFold(h, "Accept-Encoding") {
+				return 0
+			}
+		}
+	}
+
+	cc := parseCacheControl(cr.Header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0
+		}
+	}
+
+	ttl := fr.CacheTTL
+	for _, d := range []string{"s-maxage", "max-age"} {
+		v, ok := cc[d]
+		if !ok {
+			continue
+		}
+
+		secs, err := strconv.Atoi(v)
+		if err == nil && time.Duration(secs)*time.Second < ttl {
+			ttl = time.Duration(secs) * time.Second
+		}
+		break
+	}
+
+	return ttl
+}
+
+// cachedForwardHandle 带缓存的转发：新鲜的缓存直接回复；否则合并相同的并发请求访问上游，
+// 过期但带有ETag/Last-Modified的缓存向上游做条件请求，上游回复304时继续使用
+func (s *Server) cachedForwardHandle(fr *forwardRoute, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	target := fr.targetURL(req, ps)
+	key := req.URL.RequestURI() + " " + target.String()
+
+	var stale *cachedResponse
+	if !bypassCache(req) {
+		cr, err := s.cache.get(key)
+		if err != nil {
+			log.Warnf("cache get %s failed:%v", key, err)
+		}
+
+		if cr != nil && cr.fresh() {
+			writeCachedResponse(w, req, cr, "HIT")
+			return
+		}
+		stale = cr
+	}
+
+	cr, shared := s.cacheFlights.do(key, func() (*cachedResponse, bool) {
+		return s.fetchForCache(fr, key, target, w, req, stale)
+	})
+	if cr == nil {
+		// 回复太大，已经直接转发给客户端
+		return
+	}
+
+	status := "MISS"
+	if shared {
+		status = "COALESCED"
+	}
+	writeCachedResponse(w, req, cr, status)
+}
+
+// fetchForCache 访问上游并缓存可以缓存的回复，返回回复以及是否已缓存；请求与发起的客户端解绑，
+// 客户端提前断开不会影响等待同一个结果的其他请求；
+// 回复超过maxCachedBody时不再缓冲，其余部分直接转发给w，返回nil
+func (s *Server) fetchForCache(fr *forwardRoute, key string, target *url.URL, w http.ResponseWriter, req *http.Request, stale *cachedResponse) (*cachedResponse, bool) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), fr.timeout)
+	defer cancel()
+
+	out := req.Clone(ctx)
+	out.Body = http.NoBody
+	out.ContentLength = 0
+
+	// 不转发客户端的Accept-Encoding，缓存的总是未压缩的内容，
+	// 上游压缩时由Transport解压
+	out.Header.Del("Accept-Encoding")
+
+	// 客户端的条件请求由代理根据缓存回答，上游只收到代理自己的条件请求
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if stale != nil {
+		etag, lastModified := stale.validators()
+		if etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			out.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	rec := &responseRecorder{header: make(http.Header), w: w}
+	s.newReverseProxy(fr, target).ServeHTTP(rec, out)
+	if rec.streaming {
+		return nil, false
+	}
+
+	cr := &cachedResponse{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}
+	if stale != nil && cr.Status == http.StatusNotModified {
+		// 上游确认缓存仍然有效，合并上游返回的新头（例如新的Cache-Control）
+		refreshed := *stale
+		refreshed.Header = stale.Header.Clone()
+		for k, v := range cr.Header {
+			refreshed.Header[k] = v
+		}
+		cr = &refreshed
+	}
+
+	ttl := fr.responseTTL(cr)
+	if ttl <= 0 {
+		return cr, false
+	}
+
+	cr.Expires = time.Now().Add(ttl)
+	keep := ttl
+	if etag, lastModified := cr.validators(); etag != "" || lastModified != "" {
+		keep += cacheStaleTTL
+	}
+
+	err := s.cache.set(key, cr, keep)
+	if err != nil {
+		log.Warnf("cache set %s failed:%v", key, err)
+	}
+
+	return cr, true
+}
+
+// writeCachedResponse 回复缓存的内容；客户端的If-None-Match与ETag一致时回复304
+func writeCachedResponse(w http.ResponseWriter, req *http.Request, cr *cachedResponse, status string) {
+	h := w.Header()
+	for k, v := range cr.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("X-Cache", status)
+
+	etag := cr.Header.Get("ETag")
+	if cr.Status == http.StatusOK && etag != "" && etagMatch(req.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(cr.Body)))
+	w.WriteHeader(cr.Status)
+	w.Write(cr.Body)
+}
+
+// etagMatch If-None-Match中是否有etag，按弱比较
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseRecorder 缓冲上游回复的ResponseWriter；缓冲超过maxCachedBody时改为直接写给客户端
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	w         http.ResponseWriter
+	streaming bool
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	if !r.streaming && r.body.Len()+len(p) > maxCachedBody {
+		r.stream()
+	}
+	if r.streaming {
+		return r.w.Write(p)
+	}
+
+	return r.body.Write(p)
+}
+
+// stream 把已经缓冲的部分写给客户端，之后的数据不再缓冲
+func (r *responseRecorder) stream() {
+	r.streaming = true
+
+	h := r.w.Header()
+	for k, v := range r.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", "MISS")
+	r.w.WriteHeader(r.status)
+	r.w.Write(r.body.Bytes())
+	r.body = bytes.Buffer{}
+}
+
+// cachePurgeHandle 清除缓存，prefix为请求路径的前缀，为空时清除所有缓存
+func (s *Server) cachePurgeHandle(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	n, err := s.cache.purge(prefix)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("purge failed:%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("cache purged, prefix:%s, count:%d", prefix, n)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"purged":%d}`, n)
+}
+
+func (s *Server) registerCacheHandlers() {
+	s.monkeySupportHandlers["/cache/purge"] = s.cachePurgeHandle
+}
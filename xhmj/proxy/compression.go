@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"compress/flate"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultCompressionThreshold = 256
+
+// compressionLevel permessage-deflate的压缩级别，为0或者超出范围时使用BestSpeed
+func (s *Server) compressionLevel() int {
+	level := s.cfg.CompressionLevel
+	if level == 0 || level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.BestSpeed
+	}
+
+	return level
+}
+
+func (s *Server) compressionThreshold() int {
+	if s.cfg.CompressionThreshold <= 0 {
+		return defaultCompressionThreshold
+	}
+
+	return s.cfg.CompressionThreshold
+}
+
+// setupCompression 客户端协商了permessage-deflate时设置压缩级别，
+// 没有协商时gorilla/websocket忽略压缩设置
+func (s *Server) setupCompression(ws *websocket.Conn) {
+	if !s.cfg.Compression {
+		return
+	}
+
+	ws.SetCompressionLevel(s.compressionLevel())
+}
+
+// enableWriteCompression 小于阈值的消息不压缩，压缩小包既费CPU又不省流量
+func (ph *pairHolder) enableWriteCompression(size int) {
+	if ph.server.cfg.Compression {
+		ph.ws.EnableWriteCompression(size >= ph.server.compressionThreshold())
+	}
+}
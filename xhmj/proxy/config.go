@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"time"
+)
+
+// Config 代理服务器配置，由调用者注入，代理本身不读取配置文件
+type Config struct {
+	// ServerID 服务器实例ID，用于在redis上登记以及统计在线人数
+	ServerID string
+	// ServerPort 监听端口（未指定WithListener时），同时登记到redis上
+	ServerPort int
+	// RedisServer redis地址，未指定WithRedis时使用
+	RedisServer string
+	// ClientTCPAddr 不为空时（未指定WithTCPListener）在该地址上接受tcp客户端，例如":3902"
+	ClientTCPAddr string
+	// ClientUDPAddr 不为空时（未指定WithUDPConn）在该地址上接受可靠udp客户端，例如":3903"
+	ClientUDPAddr string
+
+	// ProxyScheme/ProxyTarget 没有配置Routes时，POST /t9user/Login转发的目标
+	ProxyScheme string
+	ProxyTarget string
+	// Routes http转发规则，运行时可以通过Server.SetRoutes替换
+	Routes []Route
+	// ForwardMaxBody 转发请求体的大小限制(字节)，为0时为1MB
+	ForwardMaxBody int64
+	// ForwardRetries 幂等请求连接上游失败时的重试次数，为0时为2次，负数不重试
+	ForwardRetries int
+	// TrustedProxies 前面的代理（例如负载均衡）的IP或者CIDR，只有来自这些地址的请求保留其X-Forwarded-For，
+	// 其他请求的X-Forwarded-For可能是客户端伪造的，转发时只带对端地址
+	TrustedProxies []string
+	// CacheBackend 转发回复缓存的存储，"redis"时存放在redis中由多个实例共用，否则存放在内存中；
+	// CacheMaxEntries 内存缓存的条目上限，为0时为1024
+	CacheBackend    string
+	CacheMaxEntries int
+	// BreakerFailures 同一个上游（http转发的目标或者游戏服务器）连续失败该次数后熔断，
+	// 熔断BreakerCooldown后放行一个探测请求；为0时为5次、10秒，BreakerFailures为负数时不熔断
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	// IdleTimeout 超过该时间没有收到客户端数据则关闭会话；
+	// 空闲超过PingIdle后开始发送ping，两次ping至少间隔PingInterval；为0时使用默认值
+	IdleTimeout  time.Duration
+	PingIdle     time.Duration
+	PingInterval time.Duration
+	// UpstreamKeepAlive 到游戏服务器的tcp keepalive间隔，0使用系统默认值，负数关闭
+	UpstreamKeepAlive time.Duration
+	// UpstreamReadTimeout 超过该时间没有收到游戏服务器的数据则认为其无响应，
+	// 告知客户端并结束会话；为0时不检查
+	UpstreamReadTimeout time.Duration
+	// UpstreamHeartbeatMsg 不为0时，游戏服务器空闲超过UpstreamHeartbeatInterval后
+	// 发送该消息码的空包作为心跳，游戏服务器回复的同消息码的包不转发给客户端
+	UpstreamHeartbeatMsg      uint16
+	UpstreamHeartbeatInterval time.Duration
+
+	// Compression 与客户端协商permessage-deflate压缩，CompressionLevel为压缩级别(-2~9)，
+	// 为0时为1(BestSpeed)；小于CompressionThreshold字节的消息不压缩，为0时为256
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// WS websocket的消息大小以及缓冲区限制，WSRoutes按/game/:uuid/ws/:wtype中的wtype
+	// 覆盖其中不为0的字段；MaxHeaderBytes http请求头的大小限制，为0时为256字节，较长的Cookie需要调大
+	WS             WSLimits
+	WSRoutes       map[string]WSLimits
+	MaxHeaderBytes int
+
+	// PushRTT 每次测得往返时延后通过OPRtt推送给客户端，用于显示延迟
+	PushRTT bool
+
+	// LogSampleRate 新会话输出逐包日志的采样率(0~1)，运行时可以通过管理接口修改
+	LogSampleRate float64
+
+	// 会话抓包文件目录，单个文件大小(MB)以及保留的文件个数
+	CaptureDir      string
+	CaptureMaxSize  int
+	CaptureMaxFiles int
+}
@@ -1,59 +1,249 @@
 package proxy
 
 import (
-	"bytes"
-	"fmt"
-	"github.com/julienschmidt/httprouter"
-	log "github.com/sirupsen/logrus"
-	"gscfg"
-	"io"
-	"io/ioutil"
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// forwardHTTPHandle testyy.5206767.net
-func forwardHTTPHandle(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+const (
+	defaultForwardMaxBody = 1 << 20 // 转发请求体的默认大小限制
+	defaultForwardRetries = 2       // 幂等请求连接失败时默认的重试次数
+	forwardRetryDelay     = 50 * time.Millisecond
+)
+
+// newForwardTransport 所有转发规则共用的transport，复用到上游的连接
+func newForwardTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   3 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// newReverseProxy 把请求转发到target的反向代理：去掉hop-by-hop头，设置X-Forwarded-*，
+// 请求以及回复都是流式转发；连接由所有转发共用的transport复用
+func (s *Server) newReverseProxy(fr *forwardRoute, target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// target已经是改写后的完整地址，Host使用上游的地址
+			pr.Out.URL = target
+			pr.Out.Host = ""
+
+			// 只保留可信的前置代理（例如负载均衡）设置的X-Forwarded-For，客户端自己带的可以伪造
+			if s.trustedPeer(pr.In.RemoteAddr) {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+
+			fr.applyHeaders(pr.Out.Header)
+
+			// 带上trace context，登录服务等可以关联到同一个trace
+			injectTrace(pr.Out.Context(), pr.Out.Header)
+		},
+		Transport: &breakerTransport{
+			base:     &retryTransport{base: s.forwardTransport, retries: s.forwardRetries()},
+			breakers: s.breakers,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			span := trace.SpanFromContext(resp.Request.Context())
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			return nil
+		},
+		ErrorHandler: forwardError,
+	}
+}
+
+// forwardHandle 按转发规则把请求转发到上游
+func (s *Server) forwardHandle(fr *forwardRoute) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		s.forwardHTTPHandle(fr, w, req, ps)
+	}
+}
+
+func (s *Server) forwardHTTPHandle(fr *forwardRoute, w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	log.Println("forwardHTTPHandle call:", req.URL.Path)
 
-	// we need to buffer the body if we want to read it here and send it
-	// in the request.
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx, span := s.startSpan(extractTrace(req), "http.forward",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("http.target", req.RequestURI),
+			attribute.String("http.route", fr.Path)))
+	defer span.End()
+
+	maxBody := s.forwardMaxBody()
+	if req.ContentLength > maxBody {
+		span.SetStatus(codes.Error, "request body too large")
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// you can reassign the body if you need to parse it as multipart
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(w, req.Body, maxBody)
+	}
 
-	// create a new url from the raw RequestURI sent by the client
-	url := fmt.Sprintf("%s://%s%s", gscfg.ProxyScheme, gscfg.ProxyTarget, req.RequestURI)
+	if fr.CacheTTL > 0 && cacheable(req) {
+		s.cachedForwardHandle(fr, w, req.WithContext(ctx), ps)
+		return
+	}
 
-	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
+	// 整个转发（包括读取回复）的超时
+	ctx, cancel := context.WithTimeout(ctx, fr.timeout)
+	defer cancel()
+
+	s.newReverseProxy(fr, fr.targetURL(req, ps)).ServeHTTP(w, req.WithContext(ctx))
+}
 
-	// We may want to filter some headers, otherwise we could just use a shallow copy
-	// proxyReq.Header = req.Header
-	proxyReq.Header = make(http.Header)
-	copyHeader(req.Header, proxyReq.Header)
+// forwardError 转发失败：请求体超过限制返回413，上游熔断返回503，超时返回504，其他返回502
+func forwardError(w http.ResponseWriter, req *http.Request, err error) {
+	span := trace.SpanFromContext(req.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	log.Warnf("forward %s %s failed:%v", req.Method, req.URL.Path, err)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errCircuitOpen):
+		http.Error(w, errCircuitOpen.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}
+}
+
+func (s *Server) forwardMaxBody() int64 {
+	if s.cfg.ForwardMaxBody > 0 {
+		return s.cfg.ForwardMaxBody
+	}
+
+	return defaultForwardMaxBody
+}
 
-	httpClient := &http.Client{Timeout: 5 * time.Second}
-	resp, err := httpClient.Do(proxyReq)
+// parseTrustedProxies 解析IP或者CIDR，错误的配置忽略并输出日志
+func parseTrustedProxies(addrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				log.Warnln("invalid trusted proxy:", a)
+				continue
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			log.Warnln("invalid trusted proxy:", a, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// trustedPeer 请求的对端地址是否是可信的前置代理
+func (s *Server) trustedPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+		return false
 	}
-	defer resp.Body.Close()
 
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
+func (s *Server) forwardRetries() int {
+	if s.cfg.ForwardRetries < 0 {
+		return 0
+	}
+
+	if s.cfg.ForwardRetries == 0 {
+		return defaultForwardRetries
+	}
+
+	return s.cfg.ForwardRetries
+}
+
+// retryTransport 幂等并且没有请求体的请求在连接上游失败时重试，
+// 请求体是流式转发的，无法重放，因此带请求体的请求不重试
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil || i >= t.retries || !canRetry(req, err) {
+			return resp, err
+		}
+
+		log.Warnf("forward %s %s failed:%v, retry %d", req.Method, req.URL, err, i+1)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(forwardRetryDelay):
 		}
 	}
 }
+
+func canRetry(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+	default:
+		return false
+	}
+
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	// transport返回的错误都发生在收到回复之前（连接失败、被重置或者被关闭），
+	// 没有请求体的幂等请求可以安全重试；超时说明上游可能已经在处理，不重试
+	var ne net.Error
+	return !(errors.As(err, &ne) && ne.Timeout())
+}
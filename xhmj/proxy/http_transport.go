@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+// 不能使用websocket的客户端（例如被公司或者学校的网络拦截了Upgrade）使用的http回退传输：
+//   POST /game/:uuid/http/:wtype/open?target=...&uid=...  建立会话，返回{"sid":...}
+//   POST /game/:uuid/http/:wtype/send?sid=...             上行，包体为一个或者一组JSON消息
+//   GET  /game/:uuid/http/:wtype/events?sid=...           下行，Accept为text/event-stream时为SSE，
+//                                                          否则为长轮询，返回一组JSON消息
+//   POST /game/:uuid/http/:wtype/close?sid=...            结束会话
+// 消息格式与JSON模式相同：{"ops":...,"data":"base64"}，保活使用OPPing/OPPong
+//
+// 同一会话同时只有一个events请求取消息，新的请求替换旧的（例如客户端断网重连时旧请求还没结束）：
+// 被替换的SSE收到replaced事件，长轮询回复409，客户端不应再用被替换的请求重连。
+//
+// websocket升级请求到达代理但是失败时，回复带有X-Proxy-Fallback头，值为http回退传输的路径；
+// 升级在到达代理之前就被拦截（例如中间代理直接回复403或者断开）时没有该头，
+// 客户端需要自行按/ws/换成/http/的规则回退
+
+const (
+	httpPollTimeout   = 25 * time.Second // 长轮询没有消息时的等待时间
+	httpSSEHeartbeat  = 15 * time.Second // SSE的注释行心跳，避免中间代理断开空闲连接
+	httpMaxQueued     = 1024             // 下行队列的消息数上限，客户端长时间不取时结束会话
+	fallbackHeader    = "X-Proxy-Fallback"
+	protocolHTTP      = "xhproxy.http"
+	httpSessionIDSize = 16
+)
+
+var (
+	errDownstreamQueueFull = errors.New("downstream queue full")
+
+	// httpProtocol http回退传输的协议，不参与websocket的子协议协商
+	httpProtocol = &wireProtocol{name: protocolHTTP, version: 1, codec: jsonCodec{}, inBandPing: true}
+)
+
+// httpConn http回退传输的客户端连接，实现clientConn：
+// 下行消息先放入队列，由events请求取走
+type httpConn struct {
+	lock   sync.Mutex
+	queue  [][]byte
+	notify chan struct{}
+	reader chan struct{} // 当前的events请求，被替换时关闭
+
+	closeOnce   sync.Once
+	closed      chan struct{}
+	closeCode   int
+	closeReason string
+}
+
+func newHTTPConn() *httpConn {
+	return &httpConn{
+		notify:    make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		closeCode: websocket.CloseNormalClosure,
+	}
+}
+
+func (c *httpConn) WriteMessage(mt int, data []byte) error {
+	select {
+	case <-c.closed:
+		return errSessionClosed
+	default:
+	}
+
+	c.lock.Lock()
+	if len(c.queue) >= httpMaxQueued {
+		c.lock.Unlock()
+		return errDownstreamQueueFull
+	}
+	c.queue = append(c.queue, append([]byte(nil), data...))
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// WriteControl 只记录关闭帧的原因，在下行中告知客户端
+func (c *httpConn) WriteControl(mt int, data []byte, _ time.Time) error {
+	if mt != websocket.CloseMessage || len(data) < 2 {
+		return nil
+	}
+
+	c.lock.Lock()
+	c.closeCode = int(data[0])<<8 | int(data[1])
+	c.closeReason = string(data[2:])
+	c.lock.Unlock()
+
+	return nil
+}
+
+func (c *httpConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *httpConn) EnableWriteCompression(bool) {
+}
+
+func (c *httpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// attach 新的events请求替换正在等待的旧请求，返回的channel被关闭时表示已被替换
+func (c *httpConn) attach() chan struct{} {
+	reader := make(chan struct{})
+
+	c.lock.Lock()
+	if c.reader != nil {
+		close(c.reader)
+	}
+	c.reader = reader
+	c.lock.Unlock()
+
+	return reader
+}
+
+// detach events请求结束
+func (c *httpConn) detach(reader chan struct{}) {
+	c.lock.Lock()
+	if c.reader == reader {
+		c.reader = nil
+	}
+	c.lock.Unlock()
+}
+
+// take 取走队列中所有的消息；reader已经被替换时不取，返回false，
+// 旧请求可能已经抢先收到了通知，队列不为空时重新通知新的请求
+func (c *httpConn) take(reader chan struct{}) ([][]byte, bool) {
+	c.lock.Lock()
+	if c.reader != reader {
+		pending := len(c.queue) > 0
+		c.lock.Unlock()
+
+		if pending {
+			select {
+			case c.notify <- struct{}{}:
+			default:
+			}
+		}
+		return nil, false
+	}
+
+	msgs := c.queue
+	c.queue = nil
+	c.lock.Unlock()
+
+	return msgs, true
+}
+
+// closeMessage 会话结束时发给客户端的关闭原因
+func (c *httpConn) closeMessage() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buf, _ := json.Marshal(map[string]interface{}{"code": c.closeCode, "reason": c.closeReason})
+	return buf
+}
+
+func newHTTPSessionID() string {
+	buf := make([]byte, httpSessionIDSize)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (s *Server) httpSession(sid string) *pairHolder {
+	s.httpLock.Lock()
+	defer s.httpLock.Unlock()
+
+	return s.httpSessions[sid]
+}
+
+// lookupHTTPSession 按查询参数sid找到会话，找不到时回复410，客户端应该重新建立会话
+func (s *Server) lookupHTTPSession(w http.ResponseWriter, r *http.Request) *pairHolder {
+	holder := s.httpSession(r.URL.Query().Get("sid"))
+	if holder == nil {
+		http.Error(w, "session not found", http.StatusGone)
+		return nil
+	}
+
+	holder.touch()
+	return holder
+}
+
+// httpOpenHandle 建立http回退传输的会话，连接游戏服务器成功后返回会话ID
+func (s *Server) httpOpenHandle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.ctx.Err() != nil {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	target := query.Get("target")
+	userID := query.Get("uid")
+
+	conn := newHTTPConn()
+	holder := newPairHolder(s, conn, httpProtocol, true, target, r.RemoteAddr, userID)
+	holder.readLimit = s.wsLimits(ps.ByName("wtype")).ReadLimit
+
+	sid := newHTTPSessionID()
+	s.httpLock.Lock()
+	s.httpSessions[sid] = holder
+	s.httpLock.Unlock()
+
+	holder.log.Println("http fallback session open, uid:", userID)
+
+	// 会话比open请求活得久，只沿用请求的trace
+	ctx := context.WithoutCancel(extractTrace(r))
+	result := make(chan error, 1)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.httpLock.Lock()
+			delete(s.httpSessions, sid)
+			s.httpLock.Unlock()
+		}()
+		defer conn.Close()
+
+		s.serveSession(ctx, holder, func(err error) { result <- err }, func() {
+			<-holder.ctx.Done()
+		})
+	}()
+
+	// 熔断时返回503，客户端应等待冷却后再重试，与拨号失败的502区分开
+	err := <-result
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	buf, _ := json.Marshal(map[string]string{"sid": sid, "protocol": protocolHTTP})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// httpSendHandle 上行消息，包体为一个JSON消息或者JSON消息数组
+func (s *Server) httpSendHandle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	holder := s.lookupHTTPSession(w, r)
+	if holder == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, holder.readLimit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			holder.rejectOversize()
+			http.Error(w, errMessageTooBig.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var msgs []json.RawMessage
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &msgs)
+	} else {
+		msgs = []json.RawMessage{body}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, m := range msgs {
+		holder.onWebsocketMessage(websocket.TextMessage, m)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpEventsHandle 下行消息，SSE或者长轮询
+func (s *Server) httpEventsHandle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	holder := s.lookupHTTPSession(w, r)
+	if holder == nil {
+		return
+	}
+
+	conn := holder.ws.(*httpConn)
+	reader := conn.attach()
+	defer conn.detach(reader)
+
+	if r.Header.Get("Accept") == "text/event-stream" {
+		s.serveSSE(w, r, conn, reader)
+		return
+	}
+
+	s.serveLongPoll(w, r, conn, reader)
+}
+
+// serveSSE 每个消息一个data事件，会话结束时发送close事件，被新的请求替换时发送replaced事件
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request, conn *httpConn, reader chan struct{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(httpSSEHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		msgs, ok := conn.take(reader)
+		if !ok {
+			fmt.Fprintf(w, "event: replaced\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+
+		for _, m := range msgs {
+			fmt.Fprintf(w, "data: %s\n\n", m)
+		}
+		if len(msgs) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-conn.notify:
+		case <-reader:
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-conn.closed:
+			msgs, ok := conn.take(reader)
+			if !ok {
+				continue
+			}
+
+			for _, m := range msgs {
+				fmt.Fprintf(w, "data: %s\n\n", m)
+			}
+			fmt.Fprintf(w, "event: close\ndata: %s\n\n", conn.closeMessage())
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveLongPoll 有消息时立即返回消息数组，否则等待httpPollTimeout后返回空数组；
+// 会话已经结束并且没有剩余消息时回复410以及关闭原因，被新的请求替换时回复409
+func (s *Server) serveLongPoll(w http.ResponseWriter, r *http.Request, conn *httpConn, reader chan struct{}) {
+	// 之前的消息可能留下了通知，醒来时队列为空则继续等待
+	msgs, ok := conn.take(reader)
+	if ok && len(msgs) == 0 {
+		timer := time.NewTimer(httpPollTimeout)
+		defer timer.Stop()
+
+		waiting := true
+		for waiting && ok && len(msgs) == 0 {
+			select {
+			case <-conn.notify:
+			case <-conn.closed:
+				waiting = false
+			case <-reader:
+			case <-timer.C:
+				waiting = false
+			case <-r.Context().Done():
+				return
+			}
+			msgs, ok = conn.take(reader)
+		}
+	}
+
+	if !ok {
+		http.Error(w, "replaced by a newer events request", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(msgs) == 0 {
+		select {
+		case <-conn.closed:
+			w.WriteHeader(http.StatusGone)
+			w.Write(conn.closeMessage())
+			return
+		default:
+		}
+	}
+
+	w.Write([]byte("["))
+	w.Write(bytes.Join(msgs, []byte(",")))
+	w.Write([]byte("]"))
+}
+
+// httpCloseHandle 客户端主动结束会话
+func (s *Server) httpCloseHandle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	holder := s.lookupHTTPSession(w, r)
+	if holder == nil {
+		return
+	}
+
+	holder.closeWithReason(websocket.CloseNormalClosure, "client closed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upgradeError websocket升级失败时告知客户端http回退传输的地址
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	w.Header().Set(fallbackHeader, strings.Replace(r.URL.Path, "/ws/", "/http/", 1))
+	http.Error(w, reason.Error(), status)
+}
+
+func (s *Server) registerHTTPTransport() {
+	s.rootRouter.Handle("POST", "/game/:uuid/http/:wtype/open", s.httpOpenHandle)
+	s.rootRouter.Handle("POST", "/game/:uuid/http/:wtype/send", s.httpSendHandle)
+	s.rootRouter.Handle("GET", "/game/:uuid/http/:wtype/events", s.httpEventsHandle)
+	s.rootRouter.Handle("POST", "/game/:uuid/http/:wtype/close", s.httpCloseHandle)
+}
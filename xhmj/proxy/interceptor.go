@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketDirection 包的流向
+type PacketDirection int
+
+const (
+	// DirUpstream 客户端 -> 游戏服务器
+	DirUpstream PacketDirection = iota
+	// DirDownstream 游戏服务器 -> 客户端
+	DirDownstream
+)
+
+func (d PacketDirection) String() string {
+	if d == DirUpstream {
+		return "up"
+	}
+
+	return "down"
+}
+
+// Packet 解码后的代理包，Ops与ProxyMessage的Ops一致，
+// 游戏消息的Ops为游戏消息码左移8位
+type Packet struct {
+	Dir  PacketDirection
+	Ops  int32
+	Data []byte
+}
+
+// Session 拦截器可见的会话信息
+type Session struct {
+	ID        uint64
+	Peer      string
+	Target    string
+	IsFromWeb bool
+	// Protocol 协商的协议版本，例如"xhproxy.v1"
+	Protocol  string
+	CreatedAt time.Time
+
+	lock   sync.Mutex
+	userID string
+	values map[string]interface{}
+
+	// 新会话按采样率决定是否录制以及是否输出逐包日志
+	sampled    bool
+	logSampled bool
+
+	rtt rttWindow
+
+	holder *pairHolder
+}
+
+var (
+	errSessionClosed = errors.New("session closed")
+)
+
+func newSession(holder *pairHolder, peer string, userID string) *Session {
+	return &Session{
+		ID:         atomic.AddUint64(&holder.server.sessionIDSeed, 1),
+		Peer:       peer,
+		Target:     holder.targetAddr,
+		IsFromWeb:  holder.isFromWeb,
+		Protocol:   holder.wire.name,
+		CreatedAt:  time.Now(),
+		userID:     userID,
+		sampled:    holder.server.recorder.sample(),
+		logSampled: holder.server.packetLogger.sample(),
+		holder:     holder,
+	}
+}
+
+// UserID 会话关联的用户ID，可能为空
+func (s *Session) UserID() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.userID
+}
+
+// SetUserID 设置会话关联的用户ID，例如拦截器从登录包中解析出用户ID
+func (s *Session) SetUserID(userID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.userID = userID
+}
+
+// Value 读取拦截器保存在会话上的数据
+func (s *Session) Value(key string) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.values[key]
+}
+
+// SetValue 在会话上保存数据，供拦截器在后续的包中使用
+func (s *Session) SetValue(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+
+	s.values[key] = value
+}
+
+// RTT 代理与客户端之间最近的往返时延统计，由保活ping测得
+func (s *Session) RTT() RTTStat {
+	return s.rtt.stat()
+}
+
+// Inject 往会话中注入一个包，根据pkt.Dir发往游戏服务器或者客户端，
+// 注入的包不再经过拦截器链
+func (s *Session) Inject(pkt *Packet) error {
+	return s.holder.deliver(pkt)
+}
+
+// Interceptor 包拦截器，每个解码后的包（两个方向）都会调用Intercept，
+// 拦截器可以直接修改pkt，返回false表示丢弃该包；pkt.Data归拦截器所有，可以保留或者稍后Inject
+type Interceptor interface {
+	Intercept(sess *Session, pkt *Packet) bool
+}
+
+// InterceptorFunc 函数形式的拦截器
+type InterceptorFunc func(sess *Session, pkt *Packet) bool
+
+// Intercept 实现Interceptor
+func (f InterceptorFunc) Intercept(sess *Session, pkt *Packet) bool {
+	return f(sess, pkt)
+}
+
+type interceptorChain []Interceptor
+
+// run 依次调用拦截器，任何一个拦截器丢弃则返回false
+func (chain interceptorChain) run(sess *Session, pkt *Packet) bool {
+	for _, ic := range chain {
+		if !ic.Intercept(sess, pkt) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OpsCounter 统计经过代理的各个Ops的包数量
+type OpsCounter struct {
+	lock   sync.Mutex
+	counts map[PacketDirection]map[int32]uint64
+}
+
+// NewOpsCounter 新建OpsCounter
+func NewOpsCounter() *OpsCounter {
+	oc := &OpsCounter{}
+	oc.counts = map[PacketDirection]map[int32]uint64{
+		DirUpstream:   make(map[int32]uint64),
+		DirDownstream: make(map[int32]uint64),
+	}
+
+	return oc
+}
+
+// Intercept 实现Interceptor，只计数不修改
+func (oc *OpsCounter) Intercept(sess *Session, pkt *Packet) bool {
+	oc.lock.Lock()
+	oc.counts[pkt.Dir][pkt.Ops]++
+	oc.lock.Unlock()
+
+	return true
+}
+
+// Snapshot 返回当前计数的拷贝
+func (oc *OpsCounter) Snapshot(dir PacketDirection) map[int32]uint64 {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+
+	m := make(map[int32]uint64, len(oc.counts[dir]))
+	for k, v := range oc.counts[dir] {
+		m[k] = v
+	}
+
+	return m
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LogConfig 日志配置
+type LogConfig struct {
+	// Level 日志级别，例如debug/info/warn，为空时为info
+	Level string
+	// Format 为json时输出json格式，否则为文本格式
+	Format string
+	// File 日志文件，为空时输出到stderr；文件大小(MB)超过MaxSize后滚动，保留MaxFiles个
+	File     string
+	MaxSize  int
+	MaxFiles int
+}
+
+// SetupLogging 按配置设置logrus的全局logger
+func SetupLogging(cfg LogConfig) error {
+	level := log.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		level, err = log.ParseLevel(cfg.Level)
+		if err != nil {
+			return err
+		}
+	}
+	log.SetLevel(level)
+
+	if cfg.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+
+	if cfg.File != "" {
+		err := os.MkdirAll(filepath.Dir(cfg.File), 0755)
+		if err != nil {
+			return err
+		}
+
+		w := newRotateWriter(cfg.File, int64(cfg.MaxSize)<<20, cfg.MaxFiles)
+		err = w.open()
+		if err != nil {
+			return err
+		}
+		log.SetOutput(w)
+	}
+
+	return nil
+}
+
+// sessionLogger 会话的日志，每行都带上会话ID、客户端地址以及游戏服务器地址
+func sessionLogger(sess *Session) *log.Entry {
+	return log.WithFields(log.Fields{
+		"sid":    sess.ID,
+		"peer":   sess.Peer,
+		"target": sess.Target,
+	})
+}
+
+// packetLogger 逐包日志的开关：只有被选中的会话以info级别输出，
+// 其他会话以debug级别输出，默认的info级别下被忽略
+type packetLogger struct {
+	lock sync.RWMutex
+
+	userIDs    map[string]bool
+	sessionIDs map[uint64]bool
+	sampleRate float64
+}
+
+func newPacketLogger(cfg *Config) *packetLogger {
+	return &packetLogger{
+		userIDs:    make(map[string]bool),
+		sessionIDs: make(map[uint64]bool),
+		sampleRate: cfg.LogSampleRate,
+	}
+}
+
+// sample 新会话是否被采样输出逐包日志
+func (pl *packetLogger) sample() bool {
+	pl.lock.RLock()
+	defer pl.lock.RUnlock()
+
+	return pl.sampleRate > 0 && rand.Float64() < pl.sampleRate
+}
+
+func (pl *packetLogger) selected(sess *Session) bool {
+	if sess.logSampled {
+		return true
+	}
+
+	pl.lock.RLock()
+	defer pl.lock.RUnlock()
+
+	if len(pl.userIDs) == 0 && len(pl.sessionIDs) == 0 {
+		return false
+	}
+
+	return pl.sessionIDs[sess.ID] || pl.userIDs[sess.UserID()]
+}
+
+func (pl *packetLogger) snapshot() map[string]interface{} {
+	pl.lock.RLock()
+	defer pl.lock.RUnlock()
+
+	userIDs := make([]string, 0, len(pl.userIDs))
+	for k := range pl.userIDs {
+		userIDs = append(userIDs, k)
+	}
+
+	sessionIDs := make([]uint64, 0, len(pl.sessionIDs))
+	for k := range pl.sessionIDs {
+		sessionIDs = append(sessionIDs, k)
+	}
+
+	return map[string]interface{}{
+		"uids": userIDs,
+		"sids": sessionIDs,
+		"rate": pl.sampleRate,
+	}
+}
+
+// packetLogf 逐包日志
+func (ph *pairHolder) packetLogf(format string, args ...interface{}) {
+	if ph.server.packetLogger.selected(ph.session) {
+		ph.log.Infof(format, args...)
+		return
+	}
+
+	ph.log.Debugf(format, args...)
+}
+
+// packetLogHandle 逐包日志管理接口
+// uid=xx或者sid=xx，配合enable=1/0开启或者关闭；rate=0.01设置新会话的采样率
+// 返回当前的规则
+func (s *Server) packetLogHandle(w http.ResponseWriter, r *http.Request) {
+	pl := s.packetLogger
+	query := r.URL.Query()
+	enable := query.Get("enable") != "0"
+
+	pl.lock.Lock()
+	if uid := query.Get("uid"); uid != "" {
+		if enable {
+			pl.userIDs[uid] = true
+		} else {
+			delete(pl.userIDs, uid)
+		}
+	}
+
+	if sid := query.Get("sid"); sid != "" {
+		id, err := strconv.ParseUint(sid, 10, 64)
+		if err != nil {
+			pl.lock.Unlock()
+			http.Error(w, "invalid sid:"+sid, http.StatusBadRequest)
+			return
+		}
+
+		if enable {
+			pl.sessionIDs[id] = true
+		} else {
+			delete(pl.sessionIDs, id)
+		}
+	}
+
+	if rate := query.Get("rate"); rate != "" {
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil || f < 0 || f > 1 {
+			pl.lock.Unlock()
+			http.Error(w, "invalid rate:"+rate, http.StatusBadRequest)
+			return
+		}
+
+		pl.sampleRate = f
+	}
+	pl.lock.Unlock()
+
+	buf, _ := json.Marshal(pl.snapshot())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *Server) registerLogHandlers() {
+	s.monkeySupportHandlers["/packetlog"] = s.packetLogHandle
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// 运维推送：每个实例订阅redis频道proxynotice:<ServerID>，收到的通知以OPNotice推送给本实例的会话；
+// 管理接口/notice向proxyserver:1中登记的所有实例逐个PUBLISH，也可以直接PUBLISH到某个实例的频道。
+// 通知为JSON：{"message":"...","target":"1.2.3.4:5000","uid":"xx"}，target以及uid为空时不过滤
+
+const (
+	noticeRetryInterval = 3 * time.Second  // 订阅断开后重新订阅的间隔
+	noticeHealthCheck   = 60 * time.Second // 订阅连接上PING的间隔，尽早发现断开
+	noticeQueueSize     = 16               // 每个会话等待推送的通知上限，客户端写不动时丢弃之后的通知
+)
+
+// noticeChannel 本实例订阅的通知频道，同时用于检查是否有相同ServerID的实例在运行
+func (s *Server) noticeChannel() string {
+	return proxyNoticePrefix + s.cfg.ServerID
+}
+
+// notice 推送的通知
+type notice struct {
+	Message string `json:"message"`
+	// Target 只推送给连接该游戏服务器的会话
+	Target string `json:"target,omitempty"`
+	// UserID 只推送给该用户
+	UserID string `json:"uid,omitempty"`
+}
+
+func (n *notice) matches(ph *pairHolder) bool {
+	if n.Target != "" && n.Target != ph.session.Target {
+		return false
+	}
+
+	if n.UserID != "" && n.UserID != ph.session.UserID() {
+		return false
+	}
+
+	return true
+}
+
+// pushNotice 放入本实例中匹配的会话的通知队列，不等待发送，返回放入的会话数；
+// 在订阅的接收goroutine中调用，个别客户端写不动时不能阻塞之后的通知
+func (s *Server) pushNotice(n *notice) int {
+	var pushed int
+	for _, ph := range s.holders() {
+		if !n.matches(ph) {
+			continue
+		}
+
+		if ph.queueNotice([]byte(n.Message)) {
+			pushed++
+		}
+	}
+
+	return pushed
+}
+
+// queueNotice 放入会话的通知队列，需要时启动sendNotices；会话已结束或者队列满时返回false
+func (ph *pairHolder) queueNotice(msg []byte) bool {
+	ph.noticeLock.Lock()
+	defer ph.noticeLock.Unlock()
+
+	if ph.noticeStopped || ph.closed() || len(ph.notices) >= noticeQueueSize {
+		return false
+	}
+
+	ph.notices = append(ph.notices, msg)
+	if ph.noticeDone == nil {
+		ph.noticeDone = make(chan struct{})
+		go ph.sendNotices(ph.noticeDone)
+	}
+
+	return true
+}
+
+// stopNotices 不再接受通知并等待sendNotices退出，会话结束时调用，
+// 这样Shutdown等待会话时也等待了正在发送的通知
+func (ph *pairHolder) stopNotices() {
+	ph.noticeLock.Lock()
+	ph.noticeStopped = true
+	done := ph.noticeDone
+	ph.noticeLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// sendNotices 按顺序发送队列中的通知，队列空或者会话结束时退出
+func (ph *pairHolder) sendNotices(done chan struct{}) {
+	defer close(done)
+
+	for {
+		ph.noticeLock.Lock()
+		if len(ph.notices) == 0 || ph.closed() {
+			ph.notices = nil
+			ph.noticeDone = nil
+			ph.noticeLock.Unlock()
+			return
+		}
+
+		msg := ph.notices[0]
+		ph.notices = ph.notices[1:]
+		ph.noticeLock.Unlock()
+
+		ph.sendProxyMessage(msg, int(MessageCode_OPNotice))
+	}
+}
+
+// onNotice 处理订阅频道上收到的通知
+func (s *Server) onNotice(data []byte) {
+	n := &notice{}
+	err := json.Unmarshal(data, n)
+	if err != nil {
+		log.Println("invalid notice:", err)
+		return
+	}
+
+	pushed := s.pushNotice(n)
+	log.Printf("notice queued to %d sessions, target:%s, uid:%s", pushed, n.Target, n.UserID)
+}
+
+// listenNotices 订阅本实例的频道直到服务器关闭，断开后重新订阅
+func (s *Server) listenNotices() {
+	defer s.wg.Done()
+
+	for {
+		err := s.receiveNotices()
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		log.Println("notice subscription failed:", err)
+
+		select {
+		case <-time.After(noticeRetryInterval):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// receiveNotices 订阅一次，服务器关闭时退订后返回
+func (s *Server) receiveNotices() error {
+	psc := redis.PubSubConn{Conn: s.redis.Get()}
+	defer psc.Close()
+
+	err := psc.Subscribe(s.noticeChannel())
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				s.onNotice(v.Data)
+			case redis.Subscription:
+				if v.Count == 0 {
+					done <- nil
+					return
+				}
+			case error:
+				done <- v
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(noticeHealthCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err = <-done:
+			return err
+		case <-ticker.C:
+			err = psc.Ping("")
+			if err != nil {
+				psc.Unsubscribe()
+				<-done
+				return err
+			}
+		case <-s.ctx.Done():
+			psc.Unsubscribe()
+			return <-done
+		}
+	}
+}
+
+// noticeHandle 向所有登记的代理实例发布通知，参数message、target、uid
+func (s *Server) noticeHandle(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	n := &notice{
+		Message: query.Get("message"),
+		Target:  query.Get("target"),
+		UserID:  query.Get("uid"),
+	}
+	if n.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+
+	buf, _ := json.Marshal(n)
+
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	instances, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s%d", proxyServerInstancePrefix, int(myRoomType))))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list proxy instances failed:%v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var receivers int
+	for _, id := range instances {
+		count, err := redis.Int(conn.Do("PUBLISH", proxyNoticePrefix+id, buf))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("publish notice failed:%v", err), http.StatusInternalServerError)
+			return
+		}
+		receivers += count
+	}
+
+	log.Printf("notice published to %d/%d instances, target:%s, uid:%s", receivers, len(instances), n.Target, n.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"instances":%d,"receivers":%d}`, len(instances), receivers)
+}
+
+func (s *Server) registerNoticeHandlers() {
+	s.monkeySupportHandlers["/notice"] = s.noticeHandle
+}
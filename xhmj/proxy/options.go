@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option New的可选参数
+type Option func(s *Server)
+
+// WithRedis 指定redis连接来源，默认按Config.RedisServer新建连接池
+func WithRedis(rds Redis) Option {
+	return func(s *Server) {
+		s.redis = rds
+	}
+}
+
+// WithListener 指定监听socket，默认在Config.ServerPort上监听
+func WithListener(ln net.Listener) Option {
+	return func(s *Server) {
+		s.listener = ln
+	}
+}
+
+// WithTCPListener 指定tcp客户端的监听socket，默认在Config.ClientTCPAddr上监听
+func WithTCPListener(ln net.Listener) Option {
+	return func(s *Server) {
+		s.tcpListener = ln
+	}
+}
+
+// WithUDPConn 指定可靠udp客户端的socket，默认在Config.ClientUDPAddr上监听；测试时可以包装以模拟丢包
+func WithUDPConn(pc net.PacketConn) Option {
+	return func(s *Server) {
+		s.udpConn = pc
+	}
+}
+
+// WithInterceptors 追加包拦截器，按顺序对每个解码后的包（两个方向）调用
+func WithInterceptors(ics ...Interceptor) Option {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, ics...)
+	}
+}
+
+// WithTracerProvider 指定span的TracerProvider，默认使用otel的全局TracerProvider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithSessionHooks 会话开始（已连接到游戏服务器）以及结束时的回调，可以为nil
+func WithSessionHooks(onStart, onEnd func(sess *Session)) Option {
+	return func(s *Server) {
+		s.onSessionStart = onStart
+		s.onSessionEnd = onEnd
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// 通过Sec-WebSocket-Protocol协商的协议版本，客户端没有指定时为xhproxy.v1
+const (
+	// protocolV1 原来的协议：二进制帧为protobuf编码的ProxyMessage，
+	// 使用websocket原生ping，web=1的浏览器客户端使用OPPing/OPPong
+	protocolV1 = "xhproxy.v1"
+	// protocolV2 二进制帧为4字节大端ops加上数据，不需要protobuf；
+	// 始终使用OPPing/OPPong保活，浏览器与原生客户端行为一致
+	protocolV2 = "xhproxy.v2"
+	// protocolJSON v1的JSON文本版本，收发{"ops":...,"data":"base64"}，
+	// 便于浏览器调试、测试脚本等；也可以通过查询参数mode=json选择
+	protocolJSON = "xhproxy.json"
+)
+
+var (
+	errShortFrame = errors.New("frame too short")
+)
+
+// frameCodec 协议版本的帧格式，在ProxyMessage的ops/data与websocket消息之间转换
+type frameCodec interface {
+	encode(ops int32, data []byte) (messageType int, buf []byte, err error)
+	// decode 不属于该格式的消息类型返回nil，被忽略
+	decode(messageType int, buf []byte) (*ProxyMessage, error)
+}
+
+// wireProtocol 一个协议版本
+type wireProtocol struct {
+	name    string
+	version int
+	codec   frameCodec
+	// inBandPing 使用OPPing/OPPong消息保活，否则使用websocket原生ping
+	inBandPing bool
+}
+
+// wireProtocols 服务器支持的协议，按优先顺序排列，客户端同时支持多个时选择靠前的
+var wireProtocols = []*wireProtocol{
+	{name: protocolV2, version: 2, codec: rawCodec{}, inBandPing: true},
+	{name: protocolV1, version: 1, codec: protobufCodec{}},
+	{name: protocolJSON, version: 1, codec: jsonCodec{}},
+}
+
+// subprotocols 升级websocket时可以协商的子协议
+func subprotocols() []string {
+	names := make([]string, 0, len(wireProtocols))
+	for _, p := range wireProtocols {
+		names = append(names, p.name)
+	}
+
+	return names
+}
+
+func findProtocol(name string) *wireProtocol {
+	for _, p := range wireProtocols {
+		if p.name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// negotiatedProtocol 升级时协商的协议；客户端没有指定子协议时为v1，
+// 查询参数mode=json时为JSON模式
+func negotiatedProtocol(ws *websocket.Conn, r *http.Request) *wireProtocol {
+	if p := findProtocol(ws.Subprotocol()); p != nil {
+		return p
+	}
+
+	if r.URL.Query().Get("mode") == "json" {
+		return findProtocol(protocolJSON)
+	}
+
+	return findProtocol(protocolV1)
+}
+
+// protobufCodec v1的帧格式
+type protobufCodec struct{}
+
+func (protobufCodec) encode(ops int32, data []byte) (int, []byte, error) {
+	buf := formatProxyMsgByData(data, ops)
+	if buf == nil {
+		return 0, nil, errors.New("marshal proxy message failed")
+	}
+
+	return websocket.BinaryMessage, buf, nil
+}
+
+func (protobufCodec) decode(mt int, buf []byte) (*ProxyMessage, error) {
+	if mt != websocket.BinaryMessage {
+		return nil, nil
+	}
+
+	gmsg := &ProxyMessage{}
+	err := proto.Unmarshal(buf, gmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return gmsg, nil
+}
+
+// rawCodec v2的帧格式：4字节大端ops，之后为数据
+type rawCodec struct{}
+
+func (rawCodec) encode(ops int32, data []byte) (int, []byte, error) {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(ops))
+	copy(buf[4:], data)
+
+	return websocket.BinaryMessage, buf, nil
+}
+
+func (rawCodec) decode(mt int, buf []byte) (*ProxyMessage, error) {
+	if mt != websocket.BinaryMessage {
+		return nil, nil
+	}
+
+	if len(buf) < 4 {
+		return nil, errShortFrame
+	}
+
+	ops := int32(binary.BigEndian.Uint32(buf))
+	return &ProxyMessage{Ops: &ops, Data: buf[4:]}, nil
+}
+
+// jsonMessage JSON模式下的消息，data在JSON中为base64
+type jsonMessage struct {
+	Ops  int32  `json:"ops"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// jsonCodec JSON模式的帧格式，浏览器调试、测试脚本等不需要protobuf库
+type jsonCodec struct{}
+
+func (jsonCodec) encode(ops int32, data []byte) (int, []byte, error) {
+	buf, err := json.Marshal(&jsonMessage{Ops: ops, Data: data})
+	return websocket.TextMessage, buf, err
+}
+
+func (jsonCodec) decode(mt int, buf []byte) (*ProxyMessage, error) {
+	if mt != websocket.TextMessage {
+		return nil, nil
+	}
+
+	jm := &jsonMessage{}
+	err := json.Unmarshal(buf, jm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyMessage{Ops: &jm.Ops, Data: jm.Data}, nil
+}
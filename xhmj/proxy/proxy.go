@@ -1,13 +1,15 @@
 package proxy
 
 import (
-	"encoding/binary"
-	"errors"
+	"context"
 	proto "github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,36 +18,93 @@ const (
 	tcpWriteDeadLine       = 5 * time.Second
 )
 
+// clientConn 客户端一端的连接，*websocket.Conn实现了该接口；
+// 不支持websocket的客户端使用http回退传输(httpConn)
+type clientConn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	EnableWriteCompression(enable bool)
+	Close() error
+}
+
 // pairHolder hold websocket and tcp pair
+// ws和tcpConn在会话开始后不再修改，会话结束通过ctx取消，
+// 由closeOnDone统一关闭两端，阻塞中的读写因此返回
 type pairHolder struct {
-	ws      *websocket.Conn
+	// 最后收到websocket数据的时间(UnixNano)，保活goroutine并发读取，需要原子操作
+	lastReceivedTime int64
+	// 是否有待发送的ping
+	pinging int32
+	// 在保活堆中的条目，由aliveKeeper的锁保护
+	keepEntry *keepEntry
+
+	// 最后从游戏服务器读到数据以及最后发送心跳的时间，只在serveTCP中访问
+	lastUpstreamRead time.Time
+	lastHeartbeat    time.Time
+
+	ws      clientConn
 	tcpConn *net.TCPConn
 
-	lastReceivedTime time.Time
-	lastPingTime     time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // serveTCP以及closeOnDone
 
-	wsLock *sync.Mutex // websocket并发写锁
+	wsLock  *sync.Mutex // websocket并发写锁
+	tcpLock *sync.Mutex // tcp并发写锁，拦截器注入的包可能来自其他goroutine
 
 	// 如果是浏览器，其websocket没有原生的ping/pong
 	// 需要自定义ping pong实现
 	isFromWeb bool
+	// 升级时协商的协议版本，决定帧格式以及保活方式
+	wire *wireProtocol
 
 	targetAddr string
+	readLimit  int64 // 客户端单个消息的大小限制
+
+	noticeLock    sync.Mutex
+	notices       [][]byte      // 等待推送的通知，由sendNotices逐个发送
+	noticeDone    chan struct{} // sendNotices运行时不为nil，退出时关闭
+	noticeStopped bool          // 会话结束，不再启动sendNotices
+
+	session *Session
+	log     *log.Entry
+
+	server *Server
 }
 
-func newPairHolder(ws *websocket.Conn, isFromWeb bool, targetAddr string) *pairHolder {
+func newPairHolder(server *Server, ws clientConn, wire *wireProtocol, isFromWeb bool, targetAddr string, peer string, userID string) *pairHolder {
 	hodler := &pairHolder{}
+	hodler.server = server
+	hodler.ctx, hodler.cancel = context.WithCancel(server.ctx)
 	hodler.ws = ws
+	hodler.wire = wire
 	hodler.isFromWeb = isFromWeb
 	hodler.targetAddr = targetAddr
+	hodler.readLimit = defaultWSReadLimit
 	hodler.wsLock = &sync.Mutex{}
+	hodler.tcpLock = &sync.Mutex{}
+	hodler.session = newSession(hodler, peer, userID)
+	hodler.log = sessionLogger(hodler.session)
 
 	return hodler
 }
 
+func (ph *pairHolder) touch() {
+	atomic.StoreInt64(&ph.lastReceivedTime, time.Now().UnixNano())
+}
+
+func (ph *pairHolder) lastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ph.lastReceivedTime))
+}
+
+func (ph *pairHolder) closed() bool {
+	return ph.ctx.Err() != nil
+}
+
 func (ph *pairHolder) sendPong(msg string) {
 	ws := ph.ws
-	if ws != nil {
+	if !ph.closed() {
 		ph.wsLock.Lock()
 		defer ph.wsLock.Unlock()
 
@@ -56,146 +115,208 @@ func (ph *pairHolder) sendPong(msg string) {
 		ws.SetWriteDeadline(time.Now().Add(websocketWriteDeadLine))
 		err := ws.WriteMessage(websocket.PongMessage, []byte(msg))
 		if err != nil {
-			log.Println("pair holder ws write err:", err)
-			ws.Close()
+			ph.log.Warnln("pair holder ws write err:", err)
+			ph.close()
 		}
 	}
 }
 
 func (ph *pairHolder) sendPing() {
 	ws := ph.ws
-	if ws != nil {
+	if !ph.closed() {
 		ph.wsLock.Lock()
 		defer ph.wsLock.Unlock()
 
 		ws.SetWriteDeadline(time.Now().Add(websocketWriteDeadLine))
 
+		// 两种模式都带上毫秒时间戳，对端原样回复，据此计算往返时延
 		var err error
-		if ph.isFromWeb {
-			buf2 := make([]byte, 8)
-			binary.LittleEndian.PutUint64(buf2, uint64(time.Now().Unix()))
-			buf := formatProxyMsgByData(buf2, int32(MessageCode_OPPing))
-			ws.WriteMessage(websocket.BinaryMessage, buf)
+		if ph.isFromWeb || ph.wire.inBandPing {
+			var mt int
+			var buf []byte
+			mt, buf, err = ph.wire.codec.encode(int32(MessageCode_OPPing), rttTimestamp())
+			if err == nil {
+				err = ph.writeMessage(mt, buf)
+			}
 		} else {
-			err = ws.WriteMessage(websocket.PingMessage, []byte("ka"))
+			err = ws.WriteMessage(websocket.PingMessage, rttTimestamp())
 		}
 
 		if err != nil {
-			log.Println("pair holder  ws write err:", err)
-			ws.Close()
+			ph.log.Warnln("pair holder ws write err:", err)
+			ph.close()
 		}
 	}
 }
 
-func (ph *pairHolder) send(bytes []byte) error {
+func (ph *pairHolder) send(mt int, bytes []byte) error {
 	ws := ph.ws
-	if ws != nil {
+	if !ph.closed() {
 		ph.wsLock.Lock()
 		defer ph.wsLock.Unlock()
 
 		ws.SetWriteDeadline(time.Now().Add(websocketWriteDeadLine))
-		err := ws.WriteMessage(websocket.BinaryMessage, bytes)
+		err := ph.writeMessage(mt, bytes)
 		if err != nil {
-			ws.Close()
-			log.Println("pair holder ws write err:", err)
+			ph.close()
+			ph.log.Warnln("pair holder ws write err:", err)
 		}
 
 		return err
 	}
 
-	return errors.New("websocket is nil")
+	return errSessionClosed
 }
 
-func (ph *pairHolder) sendProxyMessage(data []byte, ops int) error {
-	d := formatProxyMsgByData(data, int32(ops))
-	return ph.send(d)
+// writeMessage 发送按协议编码后的消息；调用者持有wsLock
+func (ph *pairHolder) writeMessage(mt int, buf []byte) error {
+	ph.enableWriteCompression(len(buf))
+	return ph.ws.WriteMessage(mt, buf)
 }
 
-func (ph *pairHolder) closeWebsocket() {
-	if ph.ws != nil {
-		ph.ws.Close()
+// sendProxyMessage 按协商的协议编码后发给客户端
+func (ph *pairHolder) sendProxyMessage(data []byte, ops int) error {
+	mt, buf, err := ph.wire.codec.encode(int32(ops), data)
+	if err != nil {
+		ph.log.Errorln("encode proxy message failed:", err)
+		return err
 	}
+
+	return ph.send(mt, buf)
 }
 
-func (ph *pairHolder) onWebsocketClosed(ws *websocket.Conn) {
-	if ws == ph.ws {
-		// my websocket has closed
-		ph.ws = nil
+// close 结束会话，任何一端出错或者服务器关闭时调用，可以重复调用
+func (ph *pairHolder) close() {
+	ph.cancel()
+}
 
-		// try to close tcp
-		tcpConn := ph.tcpConn
-		if tcpConn != nil {
-			tcpConn.Close()
-		}
+// closeWithReason 发送websocket关闭帧告知客户端原因，然后结束会话
+func (ph *pairHolder) closeWithReason(code int, reason string) {
+	if !ph.closed() {
+		msg := websocket.FormatCloseMessage(code, reason)
+		ph.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(websocketWriteDeadLine))
 	}
+
+	ph.close()
 }
 
-func (ph *pairHolder) onTCPConnClosed(tcpConn *net.TCPConn) {
-	if tcpConn == ph.tcpConn {
-		// my tcp conn has closed
-		ph.tcpConn = nil
+// closeOnDone 会话结束后关闭websocket以及tcp，使阻塞中的读写返回
+func (ph *pairHolder) closeOnDone() {
+	defer ph.wg.Done()
 
-		// try to close websocket
-		ws := ph.ws
-		if ws != nil {
-			ws.Close()
-		}
-	}
+	<-ph.ctx.Done()
+
+	ph.ws.Close()
+	ph.tcpConn.Close()
 }
 
-func (ph *pairHolder) onWebsocketMessage(ws *websocket.Conn, message []byte) {
-	tcpConn := ph.tcpConn
-	if tcpConn != nil {
-		gmsg := &ProxyMessage{}
-		err := proto.Unmarshal(message, gmsg)
+// wait 等待会话的所有goroutine退出
+func (ph *pairHolder) wait() {
+	ph.wg.Wait()
+}
 
+// onWebsocketMessage 按协商的协议解码客户端发来的消息，不属于该协议的消息类型被忽略
+func (ph *pairHolder) onWebsocketMessage(mt int, message []byte) {
+	if !ph.closed() {
+		gmsg, err := ph.wire.codec.decode(mt, message)
 		if err != nil {
-			log.Println("websocket message decode failed:", err)
+			ph.log.Warnln("websocket message decode failed:", err)
 			return
 		}
 
-		ops := gmsg.GetOps()
+		if gmsg != nil {
+			ph.onProxyMessage(gmsg)
+		}
+	}
+}
+
+// onProxyMessage 处理客户端发来的消息：游戏消息转发给游戏服务器，其余为代理自身的消息
+func (ph *pairHolder) onProxyMessage(gmsg *ProxyMessage) {
+	if !ph.closed() {
+		pkt := &Packet{Dir: DirUpstream, Ops: gmsg.GetOps(), Data: gmsg.GetData()}
+		if !ph.server.interceptors.run(ph.session, pkt) {
+			return
+		}
+
+		ops := pkt.Ops
 		if ops > 255 {
-			sendTCPMessage(gmsg, tcpConn)
+			ph.sendTCPMessage(pkt)
 			return
 		}
 
+		ph.server.recorder.record(ph.session, pkt, nil)
+
 		switch ops {
 		case int32(MessageCode_OPPing):
-			xd := gmsg.GetData()
+			xd := pkt.Data
 			// log.Println("got ping, len:", len(xd))
-			buf := formatProxyMsgByData(xd, int32(MessageCode_OPPong))
-			ph.send(buf)
+			ph.sendProxyMessage(xd, int(MessageCode_OPPong))
 			break
 		case int32(MessageCode_OPPong):
-			// log.Println("got pong")
+			ph.onPong(pkt.Data)
 			break
 		default:
-			log.Println("onWebsocketMessage, unknown ops:", ops)
+			ph.log.Warnln("onWebsocketMessage, unknown ops:", ops)
 		}
 	}
 }
 
-func (ph *pairHolder) proxyStart() error {
+// deliver 把包直接发往pkt.Dir指定的一端，不经过拦截器链
+func (ph *pairHolder) deliver(pkt *Packet) error {
+	if pkt.Dir == DirUpstream {
+		return ph.sendTCPMessage(pkt)
+	}
+
+	ph.server.recorder.record(ph.session, pkt, nil)
+	return ph.sendProxyMessage(pkt.Data, int(pkt.Ops))
+}
+
+// proxyStart 连接游戏服务器，traceCtx带有会话的span
+func (ph *pairHolder) proxyStart(traceCtx context.Context) (err error) {
+	_, span := ph.server.startSpan(traceCtx, "upstream.dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("net.peer.name", ph.targetAddr)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", ph.targetAddr)
 	if err != nil {
-		log.Println("pair holder ResolveTCPAddr failed:", err)
+		ph.log.Warnln("pair holder ResolveTCPAddr failed:", err)
+		ph.closeWithReason(closeUpstreamUnresponsive, errUpstreamDialFailed.Error())
 
 		return err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	// 拨号也可以被取消，例如服务器关闭；拨号失败以及熔断时以不同的关闭码告知客户端
+	var conn net.Conn
+	dialer := &net.Dialer{KeepAlive: ph.server.cfg.UpstreamKeepAlive}
+	cerr := ph.server.breakers.call("tcp://"+tcpAddr.String(), func() bool {
+		conn, err = dialer.DialContext(ph.ctx, "tcp", tcpAddr.String())
+		return err == nil || ph.ctx.Err() != nil
+	})
+	if cerr != nil {
+		ph.log.Warnln("pair holder dial to tcp server rejected:", cerr)
+		ph.closeWithReason(closeCircuitOpen, cerr.Error())
+
+		return cerr
+	}
+
 	if err != nil {
 		// handle error
-		log.Println("pair holder dial to tcp server failed:", err)
+		ph.log.Warnln("pair holder dial to tcp server failed:", err)
+		ph.closeWithReason(closeUpstreamUnresponsive, errUpstreamDialFailed.Error())
 
 		return err
 	}
 
-	ph.tcpConn = conn
+	ph.tcpConn = conn.(*net.TCPConn)
 
 	ph.tcpConn.SetNoDelay(true)
+	ph.lastUpstreamRead = time.Now()
 
+	ph.wg.Add(2)
+	go ph.closeOnDone()
 	go ph.serveTCP()
 
 	return nil
@@ -209,7 +330,7 @@ func formatProxyMsgByData(data []byte, ops int32) []byte {
 
 	bytes, err := proto.Marshal(gmsg)
 	if err != nil {
-		log.Println("marshal game msg failed:", err)
+		log.Errorln("marshal game msg failed:", err)
 		return nil
 	}
 
@@ -28,6 +28,9 @@ const (
 	MessageCode_OPData       MessageCode = 2
 	MessageCode_OPPing       MessageCode = 100
 	MessageCode_OPPong       MessageCode = 101
+	MessageCode_OPRtt        MessageCode = 102
+	MessageCode_OPNotice     MessageCode = 103
+	MessageCode_OPClose      MessageCode = 104
 )
 
 var MessageCode_name = map[int32]string{
@@ -36,6 +39,9 @@ var MessageCode_name = map[int32]string{
 	2:   "OPData",
 	100: "OPPing",
 	101: "OPPong",
+	102: "OPRtt",
+	103: "OPNotice",
+	104: "OPClose",
 }
 
 var MessageCode_value = map[string]int32{
@@ -44,6 +50,9 @@ var MessageCode_value = map[string]int32{
 	"OPData":       2,
 	"OPPing":       100,
 	"OPPong":       101,
+	"OPRtt":        102,
+	"OPNotice":     103,
+	"OPClose":      104,
 }
 
 func (x MessageCode) Enum() *MessageCode {
@@ -125,15 +134,16 @@ func init() {
 func init() { proto.RegisterFile("proxy.proto", fileDescriptor_700b50b08ed8dbaf) }
 
 var fileDescriptor_700b50b08ed8dbaf = []byte{
-	// 146 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2e, 0x28, 0xca, 0xaf,
-	0xa8, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x73, 0x94, 0x34, 0xb9, 0x78, 0x02,
-	0x40, 0x0c, 0xdf, 0xd4, 0xe2, 0xe2, 0xc4, 0xf4, 0x54, 0x21, 0x6e, 0x2e, 0x66, 0xff, 0x82, 0x62,
-	0x09, 0x46, 0x05, 0x26, 0x0d, 0x56, 0x21, 0x1e, 0x2e, 0x16, 0x97, 0xc4, 0x92, 0x44, 0x09, 0x26,
-	0x05, 0x46, 0x0d, 0x1e, 0xad, 0x20, 0x2e, 0x6e, 0xa8, 0x2a, 0xe7, 0xfc, 0x94, 0x54, 0x21, 0x5e,
-	0x2e, 0x4e, 0xff, 0x00, 0xcf, 0xbc, 0xb2, 0xc4, 0x9c, 0xcc, 0x14, 0x01, 0x06, 0x21, 0x01, 0x2e,
-	0x1e, 0xff, 0x00, 0xb0, 0x51, 0x41, 0xa9, 0x05, 0x39, 0x95, 0x02, 0x8c, 0x42, 0x5c, 0x5c, 0x6c,
-	0xfe, 0x01, 0x20, 0xfd, 0x02, 0x4c, 0x10, 0x76, 0x40, 0x66, 0x5e, 0xba, 0x40, 0x0a, 0x94, 0x9d,
-	0x9f, 0x97, 0x2e, 0x90, 0x0a, 0x08, 0x00, 0x00, 0xff, 0xff, 0xac, 0xa9, 0x8c, 0x5b, 0x93, 0x00,
-	0x00, 0x00,
+	// 174 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x2c, 0xcc, 0x41, 0x8f, 0x82, 0x30,
+	0x10, 0x05, 0xe0, 0x85, 0x5d, 0x76, 0x97, 0x69, 0x4d, 0x26, 0x73, 0xe2, 0x48, 0x3c, 0xa1, 0x07,
+	0xff, 0x04, 0x5e, 0x3c, 0x68, 0x27, 0xfc, 0x83, 0x46, 0x6a, 0x25, 0x21, 0xb4, 0xa1, 0x8d, 0x81,
+	0x7f, 0x6f, 0x40, 0x6e, 0xdf, 0x4b, 0xde, 0x7b, 0x20, 0xfc, 0xe8, 0xa6, 0xf9, 0xe4, 0x47, 0x17,
+	0x1d, 0x65, 0x6b, 0xd8, 0x1f, 0x40, 0xf2, 0x82, 0xab, 0x09, 0x41, 0x5b, 0x43, 0x02, 0xbe, 0x95,
+	0x0f, 0x45, 0x52, 0xa6, 0x55, 0x46, 0x12, 0x7e, 0xce, 0x3a, 0xea, 0x22, 0x2d, 0x93, 0x4a, 0x1e,
+	0x27, 0x10, 0x5b, 0xab, 0x76, 0xad, 0xa1, 0x1d, 0xe4, 0x8a, 0x2f, 0xc3, 0x4b, 0xf7, 0x5d, 0x8b,
+	0x5f, 0x84, 0x20, 0x15, 0xaf, 0x57, 0x8d, 0xf1, 0xfd, 0x8c, 0x09, 0x01, 0xfc, 0x2a, 0x5e, 0xf6,
+	0x98, 0x7e, 0xcc, 0xdd, 0x60, 0xb1, 0xdd, 0xec, 0x06, 0x8b, 0x86, 0x72, 0xc8, 0x14, 0x37, 0x31,
+	0xe2, 0x83, 0x24, 0xfc, 0x2b, 0xbe, 0xb9, 0xd8, 0xdd, 0x0d, 0x5a, 0x12, 0xf0, 0xa7, 0xb8, 0xee,
+	0x5d, 0x30, 0xf8, 0x7c, 0x0f, 0x00, 0xdc, 0xde, 0x6f, 0x86, 0xb9, 0x00, 0x00, 0x00,
 }
@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"encoding/binary"
 	"errors"
-	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"net"
@@ -17,6 +16,19 @@ const (
 	packHeaderSize = 12
 	minimalSize    = 256
 	flagCompressed = 0x40
+
+	// PacketHeaderSize 游戏包头长度
+	PacketHeaderSize = packHeaderSize
+	// FlagCompressed 包标志中的压缩位，包体为gzip压缩
+	FlagCompressed = flagCompressed
+
+	// maxGamePacketSize ReadGamePacket接受的包体大小上限，解压前后都检查，避免错误的包头分配大量内存
+	maxGamePacketSize = 16 << 20
+)
+
+var (
+	// ErrGamePacketTooBig 包头中的大小或者解压后的大小超过上限；前者只读取了包头
+	ErrGamePacketTooBig = errors.New("game packet too big")
 )
 
 type packetHeader struct {
@@ -27,23 +39,37 @@ type packetHeader struct {
 	hash     uint32 // hash
 }
 
+// readRequiredBytes 读取requiredSize个字节；读超时时检查游戏服务器是否无响应以及是否需要发送心跳
 func (ph *pairHolder) readRequiredBytes(buf []byte, requiredSize int) error {
 	conn := ph.tcpConn
-	read, err := io.ReadFull(conn, buf[0:requiredSize])
-	if read == 0 {
-		// pear shudown, get a FIN package
-		log.Println("serveTCP, tcp server finished connection")
-		return err
-	}
+	read := 0
+	for read < requiredSize {
+		ph.setUpstreamReadDeadline()
+		n, err := conn.Read(buf[read:requiredSize])
+		if n > 0 {
+			read += n
+			ph.lastUpstreamRead = time.Now()
+		}
 
-	if err != nil {
-		log.Printf("serveTCP read error:%v, addr:%v", err, conn.RemoteAddr())
-		return err
-	}
+		if err == nil {
+			continue
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !ph.closed() {
+			err = ph.onUpstreamIdle()
+			if err == nil {
+				continue
+			}
+		}
+
+		if read == 0 && err == io.EOF {
+			// pear shudown, get a FIN package
+			ph.log.Println("serveTCP, tcp server finished connection")
+			return err
+		}
 
-	if read != requiredSize {
-		log.Printf("serveTCP read error, ret:%d != required:%d", read, requiredSize)
-		return errors.New("ret not equal required")
+		ph.log.Warnf("serveTCP read error:%v", err)
+		return err
 	}
 
 	return nil
@@ -54,14 +80,15 @@ func (ph *pairHolder) serveTCP() {
 	defer func() {
 		if r := recover(); r != nil {
 			debug.PrintStack()
-			log.Printf("-----This serveTCP GR will die, Recovered in serveTCP:%v\n", r)
+			ph.log.Errorf("-----This serveTCP GR will die, Recovered in serveTCP:%v", r)
 		}
 
-		conn.Close()
-		ph.onTCPConnClosed(conn)
+		// tcp断开，结束会话，websocket随之关闭
+		ph.close()
+		ph.wg.Done()
 	}()
 
-	log.Println("serveTCP for:", conn.RemoteAddr())
+	ph.log.Println("serveTCP for:", conn.RemoteAddr())
 
 	buf := make([]byte, minimalSize)
 
@@ -69,7 +96,7 @@ func (ph *pairHolder) serveTCP() {
 		// read packet header
 		err := ph.readRequiredBytes(buf, packHeaderSize)
 		if err != nil {
-			log.Println("serveTCP read packet header failed:", err)
+			ph.log.Println("serveTCP read packet header failed:", err)
 			break
 		}
 
@@ -82,7 +109,7 @@ func (ph *pairHolder) serveTCP() {
 
 		err = ph.readRequiredBytes(buf, int(header.size))
 		if err != nil {
-			log.Println("serveTCP read packet body failed:", err)
+			ph.log.Println("serveTCP read packet body failed:", err)
 			break
 		}
 
@@ -91,31 +118,44 @@ func (ph *pairHolder) serveTCP() {
 		data := buf[0:header.size]
 		hash := calcHash(data)
 		if header.hash != hash {
-			log.Printf("serveTCP hash not match, header hash:%d, calc:%d\n", header, hash)
+			ph.log.Warnf("serveTCP hash not match, header hash:%d, calc:%d", header.hash, hash)
 			break
 		}
 
 		if (header.flag & flagCompressed) != 0 {
 			// compressed packet, need uncompressed first
-			log.Println("serveTCP got compressed packet, decompress ...")
+			ph.packetLogf("serveTCP got compressed packet, decompress ...")
 			before := data
 			data, err = gzipDecompress(data)
 
 			if err != nil {
-				log.Println("serveTCP decompress failed:", err)
+				ph.log.Warnln("serveTCP decompress failed:", err)
 				break
 			}
 
 			if len(data) > 2048 {
-				log.Printf("WARNING, packet decompressed size too large:%d, before:%d", len(data), len(before))
+				ph.log.Warnf("packet decompressed size too large:%d, before:%d", len(data), len(before))
 			}
+		} else {
+			// buf在读下一个包时被复用，拦截器可能保留或者稍后Inject该数据
+			data = append([]byte(nil), data...)
+		}
+
+		if ph.isUpstreamHeartbeat(header.msg) {
+			continue
 		}
 
 		// msg32 left shift 8 bit
-		err = ph.sendProxyMessage(data, msg32<<8)
+		pkt := &Packet{Dir: DirDownstream, Ops: int32(msg32 << 8), Data: data}
+		if !ph.server.interceptors.run(ph.session, pkt) {
+			continue
+		}
+
+		ph.server.recorder.record(ph.session, pkt, header)
+		err = ph.sendProxyMessage(pkt.Data, int(pkt.Ops))
 
 		if err != nil {
-			log.Println("serveTCP send ws packet failed:", err)
+			ph.log.Println("serveTCP send ws packet failed:", err)
 			break
 		}
 	}
@@ -134,32 +174,43 @@ func (ph *pairHolder) decodeHeader(buf []byte) *packetHeader {
 	pheader.compress = compress
 	pheader.size = sizeU32
 	pheader.hash = hashU32
-	log.Printf("decodeHeader, header:%v", pheader)
+	ph.packetLogf("decodeHeader, header:%+v", *pheader)
 
 	return pheader
 }
 
-func sendTCPMessage(gmsg *ProxyMessage, tcpConn *net.TCPConn) {
-	data, err := wsMessage2TcpMessage(gmsg)
+func (ph *pairHolder) sendTCPMessage(pkt *Packet) error {
+	tcpConn := ph.tcpConn
+	if ph.closed() {
+		return errSessionClosed
+	}
+
+	data, err := wsMessage2TcpMessage(pkt)
 	if err != nil {
-		log.Println("pair holder onWebsocketMessage wsMessage2TcpMessage failed:", err)
-		return
+		ph.log.Warnln("pair holder onWebsocketMessage wsMessage2TcpMessage failed:", err)
+		return err
 	}
 
+	header := &packetHeader{msg: uint16(pkt.Ops >> 8), size: uint32(len(pkt.Data)), hash: binary.LittleEndian.Uint32(data[8:])}
+	ph.server.recorder.record(ph.session, pkt, header)
+
+	ph.tcpLock.Lock()
+	defer ph.tcpLock.Unlock()
+
 	tcpConn.SetWriteDeadline(time.Now().Add(tcpWriteDeadLine))
-	log.Printf("onWebsocketMessage, write %d bytes to tcp", len(data))
+	ph.packetLogf("sendTCPMessage, msg:%d, hash:%d, write %d bytes to tcp", header.msg, header.hash, len(data))
 	wrote, err := tcpConn.Write(data)
 
 	if err != nil {
-		log.Println("pair holder onWebsocketMessage write tcp failed:", err)
-		return
+		ph.log.Warnln("pair holder onWebsocketMessage write tcp failed:", err)
+		return err
 	}
 
 	if wrote < len(data) {
-		log.Printf("pair holder onWebsocketMessage write tcp, wrote:%d != expected:%d", wrote, len(data))
+		ph.log.Warnf("pair holder onWebsocketMessage write tcp, wrote:%d != expected:%d", wrote, len(data))
 	}
 
-	log.Println("sendTCPMessage completed, length in byte:", wrote)
+	return nil
 }
 
 func gzipDecompress(data []byte) ([]byte, error) {
@@ -172,30 +223,107 @@ func gzipDecompress(data []byte) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
-func wsMessage2TcpMessage(gmsg *ProxyMessage) ([]byte, error) {
-	wsData := gmsg.GetData()
-	wsDataLength := len(wsData)
-	data := make([]byte, packHeaderSize+wsDataLength)
-	if wsDataLength > 0 {
-		copy(data[12:], wsData)
+func gzipCompress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
 	}
 
-	gameOPs := uint16(gmsg.GetOps() >> 8)
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
 
-	binary.LittleEndian.PutUint16(data, uint16(gameOPs)) // msg code, right shift 8 bits
-	data[2] = 0                                          // flag none
-	data[3] = 0                                          // uncompressed
+	return b.Bytes(), nil
+}
 
-	binary.LittleEndian.PutUint32(data[4:], uint32(wsDataLength)) // size
+func wsMessage2TcpMessage(pkt *Packet) ([]byte, error) {
+	gameOPs := uint16(pkt.Ops >> 8) // msg code, right shift 8 bits
 
-	hash := calcHash(wsData)
-	binary.LittleEndian.PutUint32(data[8:], uint32(hash)) // hash
+	// flag none, uncompressed
+	data, err := EncodeGamePacket(gameOPs, 0, pkt.Data)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Printf("wsMessage2TcpMessage, ops:%d, hash:%d", gameOPs, hash)
+	return data, nil
+}
+
+// EncodeGamePacket 按游戏服务器的12字节包头格式编码一个包，
+// flag带有压缩标志时包体先用gzip压缩，hash按压缩后的包体计算
+func EncodeGamePacket(msg uint16, flag byte, body []byte) ([]byte, error) {
+	if (flag & flagCompressed) != 0 {
+		var err error
+		body, err = gzipCompress(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, packHeaderSize+len(body))
+	binary.LittleEndian.PutUint16(data, msg)
+	data[2] = flag
+	data[3] = 0
+
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(data[8:], calcHash(body))
+	copy(data[packHeaderSize:], body)
 
 	return data, nil
 }
 
+// ReadGamePacket 从r读取一个完整的游戏包，校验hash并在需要时解压，
+// 返回消息码、包标志以及解压后的包体
+func ReadGamePacket(r io.Reader) (uint16, byte, []byte, error) {
+	var hdr [packHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	msg := binary.LittleEndian.Uint16(hdr[0:])
+	flag := hdr[2]
+	size := binary.LittleEndian.Uint32(hdr[4:])
+	hash := binary.LittleEndian.Uint32(hdr[8:])
+	if size > maxGamePacketSize {
+		return 0, 0, nil, ErrGamePacketTooBig
+	}
+
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if calcHash(body) != hash {
+		return 0, 0, nil, errors.New("game packet hash not match")
+	}
+
+	if (flag & flagCompressed) != 0 {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		body, err = ioutil.ReadAll(io.LimitReader(zr, maxGamePacketSize+1))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if len(body) > maxGamePacketSize {
+			return 0, 0, nil, ErrGamePacketTooBig
+		}
+	}
+
+	return msg, flag, body, nil
+}
+
+// CalcHash 计算游戏包体的hash，与包头中的hash字段比较
+func CalcHash(data []byte) uint32 {
+	return calcHash(data)
+}
+
 func calcHash(data []byte) uint32 {
 	// 以下代码是copy自南京项目组的pb.cpp文件中的calchash函数
 	var hash uint32
@@ -0,0 +1,84 @@
+package proxytest
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"xhmj/proxy"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// Client 模拟游戏客户端的websocket连接，收发ProxyMessage
+type Client struct {
+	*websocket.Conn
+
+	writeLock sync.Mutex
+}
+
+// Dial 连接代理，serverURL为httptest.Server.URL（http://开头）或者ws地址，
+// query附加在/game/test/ws/play后面，例如"target=127.0.0.1:1234&web=1"
+func Dial(serverURL string, query string) (*Client, error) {
+	return DialWith(websocket.DefaultDialer, serverURL, query)
+}
+
+// DialWith 使用指定的Dialer连接代理，例如开启压缩或者统计流量
+func DialWith(dialer *websocket.Dialer, serverURL string, query string) (*Client, error) {
+	ws, _, err := dialer.Dial(playURL(serverURL, query), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{Conn: ws}, nil
+}
+
+func playURL(serverURL string, query string) string {
+	u := strings.Replace(serverURL, "http://", "ws://", 1) + "/game/test/ws/play"
+	if query != "" {
+		u += "?" + query
+	}
+
+	return u
+}
+
+// SendProxyMessage 发送一个ProxyMessage
+func (c *Client) SendProxyMessage(ops int32, data []byte) error {
+	buf, err := proto.Marshal(&proxy.ProxyMessage{Ops: &ops, Data: data})
+	if err != nil {
+		return err
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.WriteMessage(websocket.BinaryMessage, buf)
+}
+
+// SendGame 发送一个游戏消息，ops为msg左移8位
+func (c *Client) SendGame(msg uint16, data []byte) error {
+	return c.SendProxyMessage(int32(msg)<<8, data)
+}
+
+// ReadProxyMessage 读取下一个ProxyMessage
+func (c *Client) ReadProxyMessage(timeout time.Duration) (*proxy.ProxyMessage, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		mt, message, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+
+		gmsg := &proxy.ProxyMessage{}
+		err = proto.Unmarshal(message, gmsg)
+		if err != nil {
+			return nil, err
+		}
+
+		return gmsg, nil
+	}
+}
@@ -0,0 +1,186 @@
+// Package proxytest 代理的测试工具：内存redis、假游戏服务器以及websocket测试客户端，
+// 使得代理的端到端行为可以在进程内测试，不依赖外部服务
+package proxytest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"xhmj/proxy"
+)
+
+// GamePacket 游戏服务器收到的一个包，Body为解压后的包体
+type GamePacket struct {
+	Msg  uint16
+	Flag byte
+	Body []byte
+}
+
+// GameServer 进程内的假游戏服务器，使用12字节包头格式（支持压缩以及hash校验），
+// 默认把收到的包原样发回
+type GameServer struct {
+	ln net.Listener
+
+	// Handler 收到包时调用，为nil时原样回显
+	Handler func(conn *GameConn, pkt *GamePacket)
+	// Compress 回显时是否压缩包体
+	Compress bool
+
+	lock  sync.Mutex
+	conns []*GameConn
+
+	accepted chan *GameConn
+}
+
+// GameConn 游戏服务器上的一个连接
+type GameConn struct {
+	net.Conn
+
+	writeLock sync.Mutex
+	received  chan *GamePacket
+}
+
+// NewGameServer 在127.0.0.1的随机端口上启动假游戏服务器
+func NewGameServer() (*GameServer, error) {
+	return ListenGameServer("127.0.0.1:0")
+}
+
+// ListenGameServer 在指定地址上启动假游戏服务器
+func ListenGameServer(addr string) (*GameServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	gs := &GameServer{
+		ln:       ln,
+		accepted: make(chan *GameConn, 64),
+	}
+
+	go gs.serve()
+
+	return gs, nil
+}
+
+// Addr 监听地址，作为代理的target
+func (gs *GameServer) Addr() string {
+	return gs.ln.Addr().String()
+}
+
+// Close 关闭监听以及所有连接
+func (gs *GameServer) Close() {
+	gs.ln.Close()
+
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	for _, c := range gs.conns {
+		c.Close()
+	}
+}
+
+// Accept 等待下一个连接，超时返回错误
+func (gs *GameServer) Accept(timeout time.Duration) (*GameConn, error) {
+	select {
+	case c := <-gs.accepted:
+		return c, nil
+	case <-time.After(timeout):
+		return nil, errors.New("proxytest: accept timeout")
+	}
+}
+
+func (gs *GameServer) serve() {
+	for {
+		conn, err := gs.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		gc := &GameConn{Conn: conn, received: make(chan *GamePacket, 256)}
+
+		gs.lock.Lock()
+		gs.conns = append(gs.conns, gc)
+		gs.lock.Unlock()
+
+		select {
+		case gs.accepted <- gc:
+		default:
+		}
+
+		go gs.serveConn(gc)
+	}
+}
+
+func (gs *GameServer) serveConn(gc *GameConn) {
+	defer gs.remove(gc)
+	defer gc.Close()
+	defer close(gc.received)
+
+	for {
+		msg, flag, body, err := proxy.ReadGamePacket(gc)
+		if err != nil {
+			return
+		}
+
+		pkt := &GamePacket{Msg: msg, Flag: flag, Body: body}
+		select {
+		case gc.received <- pkt:
+		default:
+		}
+
+		if gs.Handler != nil {
+			gs.Handler(gc, pkt)
+			continue
+		}
+
+		err = gc.Send(msg, body, gs.Compress)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (gs *GameServer) remove(gc *GameConn) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	for i, c := range gs.conns {
+		if c == gc {
+			gs.conns = append(gs.conns[:i], gs.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// Send 发送一个游戏包，compress为true时包体被gzip压缩
+func (gc *GameConn) Send(msg uint16, body []byte, compress bool) error {
+	var flag byte
+	if compress {
+		flag = proxy.FlagCompressed
+	}
+
+	buf, err := proxy.EncodeGamePacket(msg, flag, body)
+	if err != nil {
+		return err
+	}
+
+	gc.writeLock.Lock()
+	defer gc.writeLock.Unlock()
+
+	_, err = gc.Write(buf)
+	return err
+}
+
+// Receive 等待连接上收到的下一个包
+func (gc *GameConn) Receive(timeout time.Duration) (*GamePacket, error) {
+	select {
+	case pkt, ok := <-gc.received:
+		if !ok {
+			return nil, errors.New("proxytest: game connection closed")
+		}
+		return pkt, nil
+	case <-time.After(timeout):
+		return nil, errors.New("proxytest: receive timeout")
+	}
+}
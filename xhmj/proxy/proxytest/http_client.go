@@ -0,0 +1,185 @@
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"xhmj/proxy"
+
+	"github.com/gorilla/websocket"
+)
+
+// GameClient 游戏客户端，websocket或者http回退传输
+type GameClient interface {
+	SendProxyMessage(ops int32, data []byte) error
+	SendGame(msg uint16, data []byte) error
+	ReadProxyMessage(timeout time.Duration) (*proxy.ProxyMessage, error)
+	Close() error
+}
+
+// jsonMessage http回退传输的消息格式
+type jsonMessage struct {
+	Ops  int32  `json:"ops"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// ErrEventsReplaced 同一会话有了新的events请求，当前的SSE被替换
+var ErrEventsReplaced = errors.New("proxytest: events replaced")
+
+// HTTPClient 使用http回退传输的客户端，下行使用SSE
+type HTTPClient struct {
+	base string
+	sid  string
+
+	stream *http.Response
+	events chan *proxy.ProxyMessage
+	err    error
+}
+
+// DialHTTP 通过http回退传输连接代理，path为回退地址，例如"/game/test/http/play"
+func DialHTTP(serverURL string, path string, query string) (*HTTPClient, error) {
+	base := strings.Replace(serverURL, "ws://", "http://", 1) + path
+	resp, err := http.Post(base+"/open?"+query, "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxytest: open failed, %d %s", resp.StatusCode, body)
+	}
+
+	var opened struct {
+		SID string `json:"sid"`
+	}
+	err = json.Unmarshal(body, &opened)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest("GET", base+"/events?sid="+opened.SID, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &HTTPClient{
+		base:   base,
+		sid:    opened.SID,
+		stream: stream,
+		events: make(chan *proxy.ProxyMessage, 256),
+	}
+	go c.readEvents()
+
+	return c, nil
+}
+
+// DialAuto 先尝试websocket，升级失败时使用http回退传输：代理给出了回退地址时使用该地址，
+// 升级在到达代理之前就被拦截时没有该头，按/ws/换成/http/的规则回退
+func DialAuto(serverURL string, query string) (GameClient, error) {
+	ws, resp, err := websocket.DefaultDialer.Dial(playURL(serverURL, query), nil)
+	if err == nil {
+		return &Client{Conn: ws}, nil
+	}
+
+	path := "/game/test/http/play"
+	if resp != nil && resp.Header.Get("X-Proxy-Fallback") != "" {
+		path = resp.Header.Get("X-Proxy-Fallback")
+	}
+
+	return DialHTTP(serverURL, path, query)
+}
+
+// readEvents 解析SSE，close事件转换为*websocket.CloseError，replaced事件表示被新的events请求替换
+func (c *HTTPClient) readEvents() {
+	defer close(c.events)
+	defer c.stream.Body.Close()
+
+	var event string
+	scanner := bufio.NewScanner(c.stream.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := []byte(strings.TrimPrefix(line, "data: "))
+			if event == "close" {
+				var ce struct {
+					Code   int    `json:"code"`
+					Reason string `json:"reason"`
+				}
+				json.Unmarshal(data, &ce)
+				c.err = &websocket.CloseError{Code: ce.Code, Text: ce.Reason}
+				return
+			}
+
+			if event == "replaced" {
+				c.err = ErrEventsReplaced
+				return
+			}
+
+			jm := &jsonMessage{}
+			if json.Unmarshal(data, jm) == nil {
+				c.events <- &proxy.ProxyMessage{Ops: &jm.Ops, Data: jm.Data}
+			}
+		case line == "":
+			event = ""
+		}
+	}
+
+	c.err = errors.New("proxytest: event stream closed")
+}
+
+// SendProxyMessage 发送一个消息
+func (c *HTTPClient) SendProxyMessage(ops int32, data []byte) error {
+	buf, _ := json.Marshal(&jsonMessage{Ops: ops, Data: data})
+	resp, err := http.Post(c.base+"/send?sid="+c.sid, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("proxytest: send failed, %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SendGame 发送一个游戏消息，ops为msg左移8位
+func (c *HTTPClient) SendGame(msg uint16, data []byte) error {
+	return c.SendProxyMessage(int32(msg)<<8, data)
+}
+
+// ReadProxyMessage 读取下一个消息，会话结束时返回*websocket.CloseError
+func (c *HTTPClient) ReadProxyMessage(timeout time.Duration) (*proxy.ProxyMessage, error) {
+	select {
+	case gmsg, ok := <-c.events:
+		if !ok {
+			return nil, c.err
+		}
+		return gmsg, nil
+	case <-time.After(timeout):
+		return nil, errors.New("proxytest: read timeout")
+	}
+}
+
+// Close 结束会话
+func (c *HTTPClient) Close() error {
+	resp, err := http.Post(c.base+"/close?sid="+c.sid, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,519 @@
+package proxytest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Redis 内存实现的redis，只支持代理用到的命令，实现了proxy.Redis
+type Redis struct {
+	lock    sync.Mutex
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	strings map[string]redisString
+	// 频道的订阅者
+	channels map[string]map[*redisConn]bool
+}
+
+// redisString 字符串值，expireAt为零时不过期
+type redisString struct {
+	value    string
+	expireAt time.Time
+}
+
+// NewRedis 新建内存redis
+func NewRedis() *Redis {
+	return &Redis{
+		hashes:   make(map[string]map[string]string),
+		sets:     make(map[string]map[string]bool),
+		strings:  make(map[string]redisString),
+		channels: make(map[string]map[*redisConn]bool),
+	}
+}
+
+// Get 实现proxy.Redis
+func (r *Redis) Get() redis.Conn {
+	return &redisConn{r: r, closed: make(chan struct{})}
+}
+
+// HGet 读取hash字段，不存在时返回空串
+func (r *Redis) HGet(key, field string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.hashes[key][field]
+}
+
+// HSet 写入hash字段，例如预先设置monkey账号
+func (r *Redis) HSet(key, field, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.hset(key, field, value)
+}
+
+// SIsMember 集合中是否有member
+func (r *Redis) SIsMember(key, member string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.sets[key][member]
+}
+
+// Keys 未过期的字符串key中匹配glob模式pattern的key
+func (r *Redis) Keys(pattern string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.keys(pattern)
+}
+
+func (r *Redis) keys(pattern string) []string {
+	var keys []string
+	now := time.Now()
+	for k, v := range r.strings {
+		if !v.expireAt.IsZero() && now.After(v.expireAt) {
+			delete(r.strings, k)
+			continue
+		}
+
+		if globMatch(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// globMatch redis的glob匹配：*、?、[abc]、[a-z]、[^a]以及\转义
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+			continue
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(s) == 0 {
+				return false
+			}
+			set := pattern[1 : end+1]
+			negate := strings.HasPrefix(set, "^")
+			if negate {
+				set = set[1:]
+			}
+			matched := false
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					matched = matched || (s[0] >= set[i] && s[0] <= set[i+2])
+					i += 2
+					continue
+				}
+				matched = matched || s[0] == set[i]
+			}
+			if matched == negate {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+
+		if len(s) == 0 || s[0] != pattern[0] {
+			return false
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func (r *Redis) hset(key, field, value string) {
+	h, ok := r.hashes[key]
+	if !ok {
+		h = make(map[string]string)
+		r.hashes[key] = h
+	}
+
+	h[field] = value
+}
+
+func (r *Redis) exec(cmd string, args []interface{}) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	strs := make([]string, len(args))
+	for i, a := range args {
+		if b, ok := a.([]byte); ok {
+			strs[i] = string(b)
+			continue
+		}
+		strs[i] = fmt.Sprint(a)
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "HGET":
+		if len(strs) != 2 {
+			return nil, errWrongArgs
+		}
+
+		v, ok := r.hashes[strs[0]][strs[1]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "HSET", "HMSET":
+		if len(strs) < 3 || len(strs)%2 != 1 {
+			return nil, errWrongArgs
+		}
+
+		for i := 1; i < len(strs); i += 2 {
+			r.hset(strs[0], strs[i], strs[i+1])
+		}
+		return "OK", nil
+	case "HINCRBY":
+		if len(strs) != 3 {
+			return nil, errWrongArgs
+		}
+
+		incr, err := strconv.ParseInt(strs[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		v, _ := strconv.ParseInt(r.hashes[strs[0]][strs[1]], 10, 64)
+		v += incr
+		r.hset(strs[0], strs[1], strconv.FormatInt(v, 10))
+		return v, nil
+	case "SADD":
+		if len(strs) < 2 {
+			return nil, errWrongArgs
+		}
+
+		set, ok := r.sets[strs[0]]
+		if !ok {
+			set = make(map[string]bool)
+			r.sets[strs[0]] = set
+		}
+
+		var added int64
+		for _, m := range strs[1:] {
+			if !set[m] {
+				set[m] = true
+				added++
+			}
+		}
+		return added, nil
+	case "GET":
+		if len(strs) != 1 {
+			return nil, errWrongArgs
+		}
+
+		v, ok := r.strings[strs[0]]
+		if !ok || (!v.expireAt.IsZero() && time.Now().After(v.expireAt)) {
+			return nil, nil
+		}
+		return []byte(v.value), nil
+	case "SET":
+		// 只支持SET key value [PX milliseconds]
+		if len(strs) != 2 && len(strs) != 4 {
+			return nil, errWrongArgs
+		}
+
+		v := redisString{value: strs[1]}
+		if len(strs) == 4 {
+			ms, err := strconv.ParseInt(strs[3], 10, 64)
+			if err != nil || strings.ToUpper(strs[2]) != "PX" {
+				return nil, errWrongArgs
+			}
+			v.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		r.strings[strs[0]] = v
+		return "OK", nil
+	case "DEL":
+		var deleted int64
+		for _, k := range strs {
+			if _, ok := r.strings[k]; ok {
+				delete(r.strings, k)
+				deleted++
+			}
+		}
+		return deleted, nil
+	case "SCAN":
+		// 一次返回所有匹配的key，只支持SCAN cursor MATCH pattern [COUNT n]
+		if len(strs) < 3 || strings.ToUpper(strs[1]) != "MATCH" {
+			return nil, errWrongArgs
+		}
+
+		keys := []interface{}{}
+		for _, k := range r.keys(strs[2]) {
+			keys = append(keys, []byte(k))
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "SMEMBERS":
+		if len(strs) != 1 {
+			return nil, errWrongArgs
+		}
+
+		members := []interface{}{}
+		for m := range r.sets[strs[0]] {
+			members = append(members, []byte(m))
+		}
+		return members, nil
+	case "PUBLISH":
+		if len(strs) != 2 {
+			return nil, errWrongArgs
+		}
+
+		var received int64
+		for c := range r.channels[strs[0]] {
+			if c.push([]interface{}{[]byte("message"), []byte(strs[0]), []byte(strs[1])}) {
+				received++
+			}
+		}
+		return received, nil
+	case "PUBSUB":
+		// 只支持PUBSUB NUMSUB channel...
+		reply := []interface{}{}
+		for _, ch := range strs[1:] {
+			reply = append(reply, []byte(ch), int64(len(r.channels[ch])))
+		}
+		return reply, nil
+	}
+
+	return nil, fmt.Errorf("proxytest redis: unsupported command %s", cmd)
+}
+
+var (
+	errWrongArgs = errors.New("proxytest redis: wrong number of arguments")
+)
+
+// redisConn 实现redis.Conn，支持MULTI/EXEC、Send/Receive以及订阅
+type redisConn struct {
+	r *Redis
+
+	multi   bool
+	queued  [][]interface{}
+	pending []interface{}
+
+	// 订阅之后Receive阻塞等待推送，Close时返回错误
+	lock       sync.Mutex
+	subscribed map[string]bool
+	pushes     chan interface{}
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func (c *redisConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.unsubscribe(nil)
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// push 推送一个消息，缓冲区满时丢弃；调用者持有r.lock
+func (c *redisConn) push(msg interface{}) bool {
+	select {
+	case c.pushes <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribe 订阅频道，每个频道推送一个确认
+func (c *redisConn) subscribe(channels []string) {
+	c.r.lock.Lock()
+	defer c.r.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pushes == nil {
+		c.pushes = make(chan interface{}, 64)
+		c.subscribed = make(map[string]bool)
+	}
+
+	for _, ch := range channels {
+		subs, ok := c.r.channels[ch]
+		if !ok {
+			subs = make(map[*redisConn]bool)
+			c.r.channels[ch] = subs
+		}
+		subs[c] = true
+		c.subscribed[ch] = true
+		c.push([]interface{}{[]byte("subscribe"), []byte(ch), int64(len(c.subscribed))})
+	}
+}
+
+// unsubscribe 退订频道，channels为空时退订所有频道
+func (c *redisConn) unsubscribe(channels []string) {
+	c.r.lock.Lock()
+	defer c.r.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pushes == nil {
+		return
+	}
+
+	if len(channels) == 0 {
+		for ch := range c.subscribed {
+			channels = append(channels, ch)
+		}
+	}
+
+	for _, ch := range channels {
+		delete(c.r.channels[ch], c)
+		delete(c.subscribed, ch)
+		c.push([]interface{}{[]byte("unsubscribe"), []byte(ch), int64(len(c.subscribed))})
+	}
+}
+
+func (c *redisConn) subscribeMode() chan interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.pushes
+}
+
+func (c *redisConn) Err() error {
+	return nil
+}
+
+func (c *redisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// 只是flush，返回最后一个pending的结果
+		var last interface{}
+		for len(c.pending) > 0 {
+			last = c.pending[0]
+			c.pending = c.pending[1:]
+		}
+		return last, nil
+	}
+
+	err := c.Send(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply interface{}
+	for len(c.pending) > 0 {
+		reply = c.pending[0]
+		c.pending = c.pending[1:]
+	}
+
+	if e, ok := reply.(error); ok {
+		return nil, e
+	}
+
+	return reply, nil
+}
+
+func (c *redisConn) Send(cmd string, args ...interface{}) error {
+	channels := make([]string, len(args))
+	for i, a := range args {
+		channels[i] = fmt.Sprint(a)
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "SUBSCRIBE":
+		c.subscribe(channels)
+		return nil
+	case "UNSUBSCRIBE":
+		c.unsubscribe(channels)
+		return nil
+	case "PING":
+		if pushes := c.subscribeMode(); pushes != nil {
+			data := ""
+			if len(channels) > 0 {
+				data = channels[0]
+			}
+			pushes <- []interface{}{[]byte("pong"), []byte(data)}
+			return nil
+		}
+	case "MULTI":
+		c.multi = true
+		c.pending = append(c.pending, "OK")
+		return nil
+	case "EXEC":
+		replies := make([]interface{}, 0, len(c.queued))
+		for _, q := range c.queued {
+			reply, err := c.r.exec(q[0].(string), q[1:])
+			if err != nil {
+				reply = redis.Error(err.Error())
+			}
+			replies = append(replies, reply)
+		}
+
+		c.multi = false
+		c.queued = nil
+		c.pending = append(c.pending, replies)
+		return nil
+	}
+
+	if c.multi {
+		c.queued = append(c.queued, append([]interface{}{cmd}, args...))
+		c.pending = append(c.pending, "QUEUED")
+		return nil
+	}
+
+	reply, err := c.r.exec(cmd, args)
+	if err != nil {
+		c.pending = append(c.pending, err)
+		return nil
+	}
+
+	c.pending = append(c.pending, reply)
+	return nil
+}
+
+func (c *redisConn) Flush() error {
+	return nil
+}
+
+func (c *redisConn) Receive() (interface{}, error) {
+	if pushes := c.subscribeMode(); pushes != nil {
+		select {
+		case msg := <-pushes:
+			return msg, nil
+		case <-c.closed:
+			return nil, errors.New("proxytest redis: connection closed")
+		}
+	}
+
+	if len(c.pending) == 0 {
+		return nil, errors.New("proxytest redis: no pending reply")
+	}
+
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+
+	if e, ok := reply.(error); ok {
+		return nil, e
+	}
+
+	return reply, nil
+}
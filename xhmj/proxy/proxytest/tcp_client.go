@@ -0,0 +1,99 @@
+package proxytest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"xhmj/proxy"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// TCPClient 使用tcp连接代理的客户端，每帧为4字节大端长度加上内容
+type TCPClient struct {
+	net.Conn
+
+	writeLock sync.Mutex
+}
+
+// DialTCP 连接代理的tcp客户端监听，query为握手内容，例如"target=127.0.0.1:1234&uid=1"
+func DialTCP(addr string, query string) (*TCPClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TCPClient{Conn: conn}
+	err = c.WriteFrame([]byte(query))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// WriteFrame 发送一帧
+func (c *TCPClient) WriteFrame(data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.Write(buf)
+	return err
+}
+
+// SendProxyMessage 发送一个ProxyMessage
+func (c *TCPClient) SendProxyMessage(ops int32, data []byte) error {
+	buf, err := proto.Marshal(&proxy.ProxyMessage{Ops: &ops, Data: data})
+	if err != nil {
+		return err
+	}
+
+	return c.WriteFrame(buf)
+}
+
+// SendGame 发送一个游戏消息，ops为msg左移8位
+func (c *TCPClient) SendGame(msg uint16, data []byte) error {
+	return c.SendProxyMessage(int32(msg)<<8, data)
+}
+
+// ReadProxyMessage 读取下一个ProxyMessage，代理结束会话时返回*websocket.CloseError
+func (c *TCPClient) ReadProxyMessage(timeout time.Duration) (*proxy.ProxyMessage, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+
+	var head [4]byte
+	_, err := io.ReadFull(c, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint32(head[:]))
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	gmsg := &proxy.ProxyMessage{}
+	err = proto.Unmarshal(buf, gmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	if gmsg.GetOps() == int32(proxy.MessageCode_OPClose) {
+		ce := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+		if data := gmsg.GetData(); len(data) >= 2 {
+			ce.Code = int(binary.BigEndian.Uint16(data))
+			ce.Text = string(data[2:])
+		}
+		return nil, ce
+	}
+
+	return gmsg, nil
+}
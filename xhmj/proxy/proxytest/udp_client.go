@@ -0,0 +1,108 @@
+package proxytest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"xhmj/proxy"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// UDPClient 使用可靠udp连接代理的客户端
+type UDPClient struct {
+	*proxy.RUDPClient
+}
+
+// DialUDP 通过pc连接代理的udp客户端监听，query为握手内容，例如"target=127.0.0.1:1234&uid=1"
+func DialUDP(pc net.PacketConn, addr string, query string) (*UDPClient, error) {
+	c, err := proxy.DialRUDP(pc, addr, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UDPClient{RUDPClient: c}, nil
+}
+
+// SendProxyMessage 发送一个ProxyMessage
+func (c *UDPClient) SendProxyMessage(ops int32, data []byte) error {
+	buf, err := proto.Marshal(&proxy.ProxyMessage{Ops: &ops, Data: data})
+	if err != nil {
+		return err
+	}
+
+	return c.Send(buf)
+}
+
+// SendGame 发送一个游戏消息，ops为msg左移8位
+func (c *UDPClient) SendGame(msg uint16, data []byte) error {
+	return c.SendProxyMessage(int32(msg)<<8, data)
+}
+
+// ReadProxyMessage 读取下一个ProxyMessage，会话结束时返回*websocket.CloseError
+func (c *UDPClient) ReadProxyMessage(timeout time.Duration) (*proxy.ProxyMessage, error) {
+	buf, err := c.Recv(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	gmsg := &proxy.ProxyMessage{}
+	err = proto.Unmarshal(buf, gmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return gmsg, nil
+}
+
+// LossyConn 按比例随机丢弃发出的包，模拟丢包的网络
+type LossyConn struct {
+	net.PacketConn
+
+	lock    sync.Mutex
+	rnd     *rand.Rand
+	loss    float64
+	dropped int
+}
+
+// NewLossyConn loss为丢包比例，0~1
+func NewLossyConn(pc net.PacketConn, loss float64) *LossyConn {
+	return &LossyConn{
+		PacketConn: pc,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		loss:       loss,
+	}
+}
+
+// WriteTo 被丢弃的包也返回成功
+func (c *LossyConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	drop := c.rnd.Float64() < c.loss
+	if drop {
+		c.dropped++
+	}
+	c.lock.Unlock()
+
+	if drop {
+		return len(buf), nil
+	}
+
+	return c.PacketConn.WriteTo(buf, addr)
+}
+
+// SetLoss 修改丢包比例
+func (c *LossyConn) SetLoss(loss float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.loss = loss
+}
+
+// Dropped 已经丢弃的包数
+func (c *LossyConn) Dropped() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.dropped
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// captureRunLayout 抓包记录中Run的格式，精确到毫秒
+const captureRunLayout = "20060102T150405.000"
+
+// CaptureHeader 游戏包头，与tcp上的12字节包头一致
+type CaptureHeader struct {
+	Msg  uint16 `json:"msg"`
+	Flag byte   `json:"flag"`
+	Size uint32 `json:"size"`
+	Hash uint32 `json:"hash"`
+}
+
+// CaptureRecord 抓包文件中的一行（JSONL），Data为解压后的包体；
+// 同一个抓包文件跨越多次启动，会话ID只在Run（代理实例的启动时间）内唯一
+type CaptureRecord struct {
+	Time   time.Time      `json:"t"`
+	Run    string         `json:"run,omitempty"`
+	SID    uint64         `json:"sid"`
+	UserID string         `json:"uid,omitempty"`
+	Target string         `json:"target"`
+	Dir    string         `json:"dir"`
+	Ops    int32          `json:"ops"`
+	Header *CaptureHeader `json:"hdr,omitempty"`
+	Data   []byte         `json:"data,omitempty"`
+}
+
+// SessionKey 跨越多次启动唯一的会话标识，形如"20060102T150405.000/12"
+func (rec *CaptureRecord) SessionKey() string {
+	return fmt.Sprintf("%s/%d", rec.Run, rec.SID)
+}
+
+// CaptureReader 逐行读取抓包文件
+type CaptureReader struct {
+	scanner *bufio.Scanner
+}
+
+// NewCaptureReader 新建CaptureReader
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+
+	return &CaptureReader{scanner: scanner}
+}
+
+// Next 读取下一条记录，读完返回io.EOF
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	for cr.scanner.Scan() {
+		line := cr.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := &CaptureRecord{}
+		err := json.Unmarshal(line, rec)
+		if err != nil {
+			return nil, err
+		}
+
+		return rec, nil
+	}
+
+	err := cr.scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+
+	return nil, err
+}
+
+// recorder 会话抓包，默认关闭，通过管理接口按用户ID、目标服务器或者采样率开启；
+// 每个包都会调用shouldRecord，没有开启时不加锁
+type recorder struct {
+	// filtering userIDs或者targets不为空时为1
+	filtering int32
+
+	lock sync.RWMutex
+
+	userIDs    map[string]bool
+	targets    map[string]bool
+	sampleRate float64
+
+	cfg    *Config
+	run    string
+	writer atomic.Value // *rotateWriter，第一次录制时创建
+}
+
+func newRecorder(cfg *Config) *recorder {
+	return &recorder{
+		cfg:     cfg,
+		run:     time.Now().Format(captureRunLayout),
+		userIDs: make(map[string]bool),
+		targets: make(map[string]bool),
+	}
+}
+
+// sample 新会话是否被采样录制
+func (rc *recorder) sample() bool {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	return rc.sampleRate > 0 && rand.Float64() < rc.sampleRate
+}
+
+func (rc *recorder) shouldRecord(sess *Session) bool {
+	if sess.sampled {
+		return true
+	}
+
+	if atomic.LoadInt32(&rc.filtering) == 0 {
+		return false
+	}
+
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	return rc.targets[sess.Target] || rc.userIDs[sess.UserID()]
+}
+
+// record 记录一个包，header为nil表示非游戏数据包（例如ping/pong）
+func (rc *recorder) record(sess *Session, pkt *Packet, header *packetHeader) {
+	if !rc.shouldRecord(sess) {
+		return
+	}
+
+	cr := &CaptureRecord{
+		Time:   time.Now(),
+		Run:    rc.run,
+		SID:    sess.ID,
+		UserID: sess.UserID(),
+		Target: sess.Target,
+		Dir:    pkt.Dir.String(),
+		Ops:    pkt.Ops,
+		Data:   pkt.Data,
+	}
+
+	if header != nil {
+		cr.Header = &CaptureHeader{
+			Msg:  header.msg,
+			Flag: header.flag,
+			Size: header.size,
+			Hash: header.hash,
+		}
+	}
+
+	line, err := json.Marshal(cr)
+	if err != nil {
+		log.Println("recorder marshal failed:", err)
+		return
+	}
+
+	line = append(line, '\n')
+	_, err = rc.getWriter().Write(line)
+	if err != nil {
+		log.Println("recorder write failed:", err)
+	}
+}
+
+func (rc *recorder) getWriter() *rotateWriter {
+	if w, ok := rc.writer.Load().(*rotateWriter); ok {
+		return w
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if w, ok := rc.writer.Load().(*rotateWriter); ok {
+		return w
+	}
+
+	filename := filepath.Join(rc.cfg.CaptureDir, fmt.Sprintf("capture-%s.jsonl", rc.cfg.ServerID))
+	w := newRotateWriter(filename, int64(rc.cfg.CaptureMaxSize)<<20, rc.cfg.CaptureMaxFiles)
+	rc.writer.Store(w)
+
+	return w
+}
+
+// close 关闭抓包文件，服务器关闭时调用
+func (rc *recorder) close() error {
+	w, ok := rc.writer.Load().(*rotateWriter)
+	if !ok {
+		return nil
+	}
+
+	return w.Close()
+}
+
+func (rc *recorder) snapshot() map[string]interface{} {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	userIDs := make([]string, 0, len(rc.userIDs))
+	for k := range rc.userIDs {
+		userIDs = append(userIDs, k)
+	}
+
+	targets := make([]string, 0, len(rc.targets))
+	for k := range rc.targets {
+		targets = append(targets, k)
+	}
+
+	return map[string]interface{}{
+		"uids":    userIDs,
+		"targets": targets,
+		"rate":    rc.sampleRate,
+	}
+}
+
+// recorderHandle 抓包管理接口
+// uid=xx或者target=xx，配合enable=1/0开启或者关闭；rate=0.01设置新会话的采样率
+// 返回当前的抓包规则
+func (s *Server) recorderHandle(w http.ResponseWriter, r *http.Request) {
+	capture := s.recorder
+	query := r.URL.Query()
+	enable := query.Get("enable") != "0"
+
+	capture.lock.Lock()
+	if uid := query.Get("uid"); uid != "" {
+		if enable {
+			capture.userIDs[uid] = true
+		} else {
+			delete(capture.userIDs, uid)
+		}
+	}
+
+	if target := query.Get("target"); target != "" {
+		if enable {
+			capture.targets[target] = true
+		} else {
+			delete(capture.targets, target)
+		}
+	}
+
+	if rate := query.Get("rate"); rate != "" {
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil || f < 0 || f > 1 {
+			capture.lock.Unlock()
+			http.Error(w, "invalid rate:"+rate, http.StatusBadRequest)
+			return
+		}
+
+		capture.sampleRate = f
+	}
+
+	var filtering int32
+	if len(capture.userIDs) > 0 || len(capture.targets) > 0 {
+		filtering = 1
+	}
+	atomic.StoreInt32(&capture.filtering, filtering)
+	capture.lock.Unlock()
+
+	buf, _ := json.Marshal(capture.snapshot())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *Server) registerRecorderHandlers() {
+	s.monkeySupportHandlers["/recorder"] = s.recorderHandle
+}
@@ -1,20 +1,22 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
-	"gscfg"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	pool *redis.Pool
-)
+// Redis 代理使用的redis连接来源，*redis.Pool实现了该接口，
+// 测试时可以注入内存实现
+type Redis interface {
+	Get() redis.Conn
+}
 
-// newPool 新建redis连接池
-func newPool(addr string) *redis.Pool {
+// NewRedisPool 新建redis连接池
+func NewRedisPool(addr string) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
@@ -22,47 +24,41 @@ func newPool(addr string) *redis.Pool {
 	}
 }
 
-func redisStartup() {
-	if gscfg.ServerID == "" {
-		log.Panic("Must specify the server ID in config json")
-		return
+// serverRegister 往redis上登记自己
+func (s *Server) serverRegister() error {
+	if s.cfg.ServerID == "" {
+		return errors.New("must specify the server ID")
 	}
 
-	pool = newPool(gscfg.RedisServer)
-
-	serverRegister()
-}
-
-// serverRegister 往redis上登记自己
-func serverRegister() {
 	// 获取redis链接，并退出函数时释放
-	conn := pool.Get()
+	conn := s.redis.Get()
 	defer conn.Close()
 
-	if serverIDSubscriberExist(conn) {
-		log.Panicln("The same UUID server instance exists, failed to startup, server ID:", gscfg.ServerID)
-		return
+	if s.serverIDSubscriberExist(conn) {
+		return fmt.Errorf("the same UUID server instance exists, failed to startup, server ID:%s", s.cfg.ServerID)
 	}
 
-	hashKey := proxyServerInstancePrefix + gscfg.ServerID
+	hashKey := proxyServerInstancePrefix + s.cfg.ServerID
 	conn.Send("MULTI")
-	conn.Send("hmset", hashKey, "roomtype", int(myRoomType), "ver", versionCode, "p", gscfg.ServerPort)
-	conn.Send("SADD", fmt.Sprintf("%s%d", proxyServerInstancePrefix, int(myRoomType)), gscfg.ServerID)
+	conn.Send("hmset", hashKey, "roomtype", int(myRoomType), "ver", versionCode, "p", s.cfg.ServerPort)
+	conn.Send("SADD", fmt.Sprintf("%s%d", proxyServerInstancePrefix, int(myRoomType)), s.cfg.ServerID)
 
 	// conn.Send("HSET", fmt.Sprintf("%s%d", gconst.RoomTypeKey, myRoomType), "type", 1)
 	_, err := conn.Do("EXEC")
 	if err != nil {
-		log.Panicln("failed to register server to redis:", err)
+		return fmt.Errorf("failed to register server to redis:%v", err)
 	}
+
+	return nil
 }
 
-func serverIDSubscriberExist(conn redis.Conn) bool {
-	subCounts, err := redis.Int64Map(conn.Do("PUBSUB", "NUMSUB", gscfg.ServerID))
+func (s *Server) serverIDSubscriberExist(conn redis.Conn) bool {
+	subCounts, err := redis.Int64Map(conn.Do("PUBSUB", "NUMSUB", s.noticeChannel()))
 	if err != nil {
 		log.Println("warning: serverIDSubscriberExist, redis err:", err)
 	}
 
-	count, _ := subCounts[gscfg.ServerID]
+	count, _ := subCounts[s.noticeChannel()]
 	if count > 0 {
 		return true
 	}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotateWriter 按文件大小滚动的文件写入器，
+// 当前文件写满maxSize后重命名为filename.1，旧的依次后移，最多保留maxBackups个
+type rotateWriter struct {
+	lock sync.Mutex
+
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newRotateWriter(filename string, maxSize int64, maxBackups int) *rotateWriter {
+	return &rotateWriter{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+// Write 实现io.Writer，单次写入不会被拆分到两个文件
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// Close 关闭当前文件，之后的Write会重新打开
+func (w *rotateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+func (w *rotateWriter) open() error {
+	err := os.MkdirAll(filepath.Dir(w.filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+
+	return nil
+}
+
+func (w *rotateWriter) rotate() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+
+	if w.maxBackups > 0 {
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(w.backupName(i), w.backupName(i+1))
+		}
+
+		os.Rename(w.filename, w.backupName(1))
+	} else {
+		os.Remove(w.filename)
+	}
+
+	return w.open()
+}
+
+func (w *rotateWriter) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", w.filename, i)
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const defaultRouteTimeout = 5 * time.Second
+
+// routeMethods Method为空的路由注册到以下所有方法
+var routeMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+
+// errNoRoutes 新的转发规则为空，多半是配置写错，保留原来的规则
+var errNoRoutes = errors.New("no forward routes")
+
+// Route 一条http转发规则
+type Route struct {
+	// Method 为空时匹配所有方法
+	Method string
+	// Path httprouter格式的路径，例如"/t9user/Login"、"/pay/:channel"、"/api/*rest"
+	Path string
+	// Upstream 上游的base URL，例如"http://test.5206767.net"，可以带路径前缀
+	Upstream string
+	// Rewrite 转发时的路径，可以引用Path中的参数，例如"/v2/api/*rest"；为空时使用原路径
+	Rewrite string
+	// Timeout 整个转发请求的超时，为0时为5秒
+	Timeout time.Duration
+	// AddHeaders/RemoveHeaders 转发请求时设置以及删除的请求头
+	AddHeaders    map[string]string
+	RemoveHeaders []string
+	// CacheTTL 大于0时缓存GET请求的回复，上游的Cache-Control可以缩短或者禁止缓存
+	CacheTTL time.Duration
+}
+
+// forwardRoute 校验后的转发规则
+type forwardRoute struct {
+	Route
+
+	upstream *url.URL
+	timeout  time.Duration
+}
+
+// DefaultRoutes 没有配置转发规则时，沿用原来的登录转发；target为空时不转发，scheme为空时为http
+func DefaultRoutes(scheme string, target string) []Route {
+	if target == "" {
+		return nil
+	}
+
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return []Route{{
+		Method:   "POST",
+		Path:     "/t9user/Login",
+		Upstream: fmt.Sprintf("%s://%s", scheme, target),
+	}}
+}
+
+// SetRoutes 替换http转发规则，例如重新加载配置之后；规则有错误或者为空时返回错误并保留原来的规则，
+// 没有配置规则时应当由调用者传入新的DefaultRoutes
+func (s *Server) SetRoutes(routes []Route) error {
+	if len(routes) == 0 {
+		return errNoRoutes
+	}
+
+	router, err := s.buildRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	s.forwardRouter.Store(router)
+	return nil
+}
+
+func (s *Server) buildRoutes(routes []Route) (router *httprouter.Router, err error) {
+	// httprouter在路径冲突时panic
+	defer func() {
+		if r := recover(); r != nil {
+			router = nil
+			err = fmt.Errorf("invalid routes: %v", r)
+		}
+	}()
+
+	router = httprouter.New()
+	for i := range routes {
+		fr, err := newForwardRoute(routes[i])
+		if err != nil {
+			return nil, err
+		}
+
+		methods := routeMethods
+		if fr.Method != "" {
+			methods = []string{strings.ToUpper(fr.Method)}
+		}
+
+		for _, m := range methods {
+			router.Handle(m, fr.Path, s.forwardHandle(fr))
+		}
+	}
+
+	return router, nil
+}
+
+func newForwardRoute(rt Route) (*forwardRoute, error) {
+	if !strings.HasPrefix(rt.Path, "/") {
+		return nil, errors.New("route path must begin with '/': " + rt.Path)
+	}
+
+	u, err := url.Parse(rt.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("route upstream must be an absolute url: " + rt.Upstream)
+	}
+
+	timeout := rt.Timeout
+	if timeout <= 0 {
+		timeout = defaultRouteTimeout
+	}
+
+	return &forwardRoute{
+		Route:    rt,
+		upstream: u,
+		timeout:  timeout,
+	}, nil
+}
+
+// serveRoutes 没有匹配到代理自身路由的请求，按转发规则处理
+func (s *Server) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	s.forwardRouter.Load().(*httprouter.Router).ServeHTTP(w, r)
+}
+
+// targetURL 转发的目标地址，按Rewrite改写路径并保留查询参数；
+// 路径中的转义（例如%2F）原样转发，不会被解码成'/'
+func (fr *forwardRoute) targetURL(r *http.Request, ps httprouter.Params) *url.URL {
+	p, rawP := r.URL.Path, r.URL.EscapedPath()
+	if fr.Rewrite != "" {
+		p, rawP = rewritePath(fr.Rewrite, ps, rawP)
+	}
+
+	u := *fr.upstream
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + rawP
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawQuery = r.URL.RawQuery
+
+	return &u
+}
+
+// applyHeaders 按规则删除以及设置转发请求的请求头
+func (fr *forwardRoute) applyHeaders(h http.Header) {
+	for _, k := range fr.RemoveHeaders {
+		h.Del(k)
+	}
+
+	for k, v := range fr.AddHeaders {
+		h.Set(k, v)
+	}
+}
+
+// rewritePath 把模板中":name"以及"*name"段替换为路径参数，同时返回解码后的路径以及转义后的路径；
+// rawPath为请求的转义路径，catch-all参数尽量取其中对应的原始部分
+func rewritePath(tmpl string, ps httprouter.Params, rawPath string) (string, string) {
+	segs := strings.Split(tmpl, "/")
+	rawSegs := make([]string, len(segs))
+	for i, seg := range segs {
+		rawSegs[i] = seg
+		if len(seg) < 2 || (seg[0] != ':' && seg[0] != '*') {
+			continue
+		}
+
+		v := ps.ByName(seg[1:])
+		if seg[0] == ':' {
+			segs[i] = v
+			rawSegs[i] = url.PathEscape(v)
+			continue
+		}
+
+		// catch-all参数带有开头的'/'
+		raw, ok := rawSuffix(rawPath, v)
+		if !ok {
+			raw = escapeSegments(v)
+		}
+		segs[i] = strings.TrimPrefix(v, "/")
+		rawSegs[i] = strings.TrimPrefix(raw, "/")
+	}
+
+	return strings.Join(segs, "/"), strings.Join(rawSegs, "/")
+}
+
+// rawSuffix 在转义路径中找到解码后等于suffix的结尾部分，suffix以'/'开头
+func rawSuffix(rawPath string, suffix string) (string, bool) {
+	for i := len(rawPath) - 1; i >= 0; i-- {
+		if rawPath[i] != '/' {
+			continue
+		}
+
+		v, err := url.PathUnescape(rawPath[i:])
+		if err == nil && v == suffix {
+			return rawPath[i:], true
+		}
+	}
+
+	return "", false
+}
+
+// escapeSegments 按'/'分段转义
+func escapeSegments(p string) string {
+	segs := strings.Split(p, "/")
+	for i := range segs {
+		segs[i] = url.PathEscape(segs[i])
+	}
+
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rttWindowSize = 16          // 每个会话保留最近的测量次数
+	rttMax        = time.Minute // 超过该值的测量认为无效，例如客户端回复了旧格式的时间戳
+)
+
+// rttBuckets 往返时延直方图的桶上限(毫秒)，最后还有一个+Inf
+var rttBuckets = []int64{10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// RTTStat 会话最近若干次往返时延的统计
+type RTTStat struct {
+	Last    time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	Avg     time.Duration
+	Samples int // 累计测量次数，为0时其他字段无意义
+}
+
+// rttWindow 会话最近rttWindowSize次测量的滚动窗口
+type rttWindow struct {
+	lock    sync.Mutex
+	samples [rttWindowSize]time.Duration
+	count   int
+}
+
+func (w *rttWindow) add(d time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.samples[w.count%rttWindowSize] = d
+	w.count++
+}
+
+func (w *rttWindow) stat() RTTStat {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	st := RTTStat{Samples: w.count}
+	if w.count == 0 {
+		return st
+	}
+
+	n := w.count
+	if n > rttWindowSize {
+		n = rttWindowSize
+	}
+
+	var sum time.Duration
+	st.Min = w.samples[0]
+	for _, d := range w.samples[:n] {
+		sum += d
+		if d < st.Min {
+			st.Min = d
+		}
+		if d > st.Max {
+			st.Max = d
+		}
+	}
+
+	st.Last = w.samples[(w.count-1)%rttWindowSize]
+	st.Avg = sum / time.Duration(n)
+
+	return st
+}
+
+// rttHistogram 服务器所有会话往返时延的直方图，计数只增不减
+type rttHistogram struct {
+	// 原子操作的64位字段放在前面保证对齐
+	sum    int64    // 毫秒
+	counts []uint64 // 与rttBuckets对应，多一个+Inf
+}
+
+func newRTTHistogram() *rttHistogram {
+	return &rttHistogram{counts: make([]uint64, len(rttBuckets)+1)}
+}
+
+func (h *rttHistogram) observe(d time.Duration) {
+	ms := int64(d / time.Millisecond)
+
+	i := 0
+	for i < len(rttBuckets) && ms > rttBuckets[i] {
+		i++
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, ms)
+}
+
+// rttTimestamp 当前时间的毫秒数，8字节小端，作为ping的内容
+func rttTimestamp() []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	return buf
+}
+
+// parseRTT 从pong带回的时间戳计算往返时延，格式不对或者值不合理时返回false
+func parseRTT(data []byte) (time.Duration, bool) {
+	if len(data) != 8 {
+		return 0, false
+	}
+
+	sent := int64(binary.LittleEndian.Uint64(data))
+	rtt := time.Duration(time.Now().UnixNano()/int64(time.Millisecond)-sent) * time.Millisecond
+	if rtt < 0 || rtt > rttMax {
+		return 0, false
+	}
+
+	return rtt, true
+}
+
+// onPong 收到自己发出的ping的回复，记录往返时延，需要时推送给客户端
+func (ph *pairHolder) onPong(data []byte) {
+	rtt, ok := parseRTT(data)
+	if !ok {
+		return
+	}
+
+	ph.session.rtt.add(rtt)
+	ph.server.rttHistogram.observe(rtt)
+
+	if ph.server.cfg.PushRTT {
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, uint32(rtt/time.Millisecond))
+		ph.sendProxyMessage(buf, int(MessageCode_OPRtt))
+	}
+}
@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 可靠UDP（类似KCP的选择重传ARQ），给丢包严重的移动网络使用，避免tcp的队头阻塞：
+// 每个包的头部为 conv(4) cmd(1) frg(1) sn(4) una(4)，大端；
+// conv为客户端选择的会话ID，客户端换了IP或者端口之后仍然按conv找到会话；
+// 大于rudpMSS的消息拆成多段，frg为剩余的段数，0为最后一段，重组时frg必须逐段递减；
+// 每个数据段单独确认(sn)，同时携带累计确认(una，之前的段都已收到)
+
+const (
+	rudpHeaderSize = 14
+	rudpMSS        = 1200 // 每段的最大数据长度，避免IP分片
+	rudpMaxFrags   = 256  // 一个消息最多拆成的段数
+	rudpSndWnd     = 128  // 已发送未确认的段数上限
+	rudpRcvWnd     = 256  // 接收窗口，超出的段不确认，由对端重传
+	rudpMaxQueued  = 1024 // 发送队列的段数上限，超过时结束会话
+	rudpInterval   = 10 * time.Millisecond
+	rudpRTOInit    = 200 * time.Millisecond
+	rudpRTOMin     = 30 * time.Millisecond
+	rudpRTOMax     = 3 * time.Second
+	rudpFastResend = 2  // 后面的段被确认的次数达到该值时立即重传，不等超时
+	rudpFastLimit  = 5  // 同一段最多快速重传的次数，之后只按超时重传
+	rudpDeadLink   = 20 // 同一段的超时重传次数超过该值时认为链路已断开
+
+	rudpCmdSyn    = 1 // 客户端建立会话，内容为查询参数
+	rudpCmdAccept = 2 // 会话已建立
+	rudpCmdData   = 3
+	rudpCmdAck    = 4
+	rudpCmdFin    = 5 // 结束会话，内容为websocket关闭帧格式的原因
+)
+
+var (
+	errRUDPPacket   = errors.New("invalid rudp packet")
+	errRUDPTooBig   = errors.New("rudp message too big")
+	errRUDPDeadLink = errors.New("rudp dead link")
+)
+
+type rudpPacket struct {
+	conv uint32
+	cmd  uint8
+	frg  uint8
+	sn   uint32
+	una  uint32
+	data []byte
+}
+
+func (p *rudpPacket) encode() []byte {
+	buf := make([]byte, rudpHeaderSize+len(p.data))
+	binary.BigEndian.PutUint32(buf, p.conv)
+	buf[4] = p.cmd
+	buf[5] = p.frg
+	binary.BigEndian.PutUint32(buf[6:], p.sn)
+	binary.BigEndian.PutUint32(buf[10:], p.una)
+	copy(buf[rudpHeaderSize:], p.data)
+
+	return buf
+}
+
+// decodeRUDPPacket 解码一个包，data引用buf
+func decodeRUDPPacket(buf []byte) (*rudpPacket, error) {
+	if len(buf) < rudpHeaderSize || buf[4] < rudpCmdSyn || buf[4] > rudpCmdFin {
+		return nil, errRUDPPacket
+	}
+
+	return &rudpPacket{
+		conv: binary.BigEndian.Uint32(buf),
+		cmd:  buf[4],
+		frg:  buf[5],
+		sn:   binary.BigEndian.Uint32(buf[6:]),
+		una:  binary.BigEndian.Uint32(buf[10:]),
+		data: buf[rudpHeaderSize:],
+	}, nil
+}
+
+// seqBefore 序号a是否在b之前，允许回绕
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type rudpSegment struct {
+	sn       uint32
+	frg      uint8
+	data     []byte
+	sentAt   time.Time
+	resendAt time.Time
+	rto      time.Duration
+	xmit     int
+	timeouts int
+	fastack  int
+}
+
+// RUDPStats 可靠UDP会话的统计，时延单位为毫秒
+type RUDPStats struct {
+	// Sent 发送的数据段，不含重传
+	Sent uint64 `json:"sent"`
+	// Retransmits 超时以及快速重传的次数
+	Retransmits uint64 `json:"retransmits"`
+	// Received 收到的数据段，不含重复
+	Received uint64 `json:"received"`
+	// Duplicates 收到的重复数据段，对端的确认丢失时出现
+	Duplicates uint64 `json:"duplicates"`
+	// Loss 重传占所有发出的数据段的比例，估算的丢包率
+	Loss float64 `json:"loss"`
+
+	SRTT   int64 `json:"srtt"`
+	RTTVar int64 `json:"rttvar"`
+	RTO    int64 `json:"rto"`
+}
+
+// rudpConn 可靠UDP一端的状态，客户端以及服务器共用；
+// output发出一个包，调用时持有lock，不能阻塞
+type rudpConn struct {
+	conv   uint32
+	output func(buf []byte) error
+
+	lock     sync.Mutex
+	sndNxt   uint32
+	sndQueue []*rudpSegment // 等待进入发送窗口
+	sndBuf   []*rudpSegment // 已发送未确认，按sn排序
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*rudpSegment
+	partial  [][]byte // 正在重组的消息
+	partLen  int64    // partial的总字节数
+	partFrg  uint8    // partial最后一段的frg
+	rcvQueue [][]byte // 重组完成等待取走的消息
+	rcvErr   error    // 对端的消息超过readLimit或者分段错误，之后不再接收
+	notify   chan struct{}
+
+	// readLimit 重组后的消息大小上限，每收到一段都检查
+	readLimit int64
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	dead   bool
+	stats  RUDPStats
+}
+
+func newRUDPConn(conv uint32, output func(buf []byte) error) *rudpConn {
+	return &rudpConn{
+		conv:      conv,
+		output:    output,
+		rcvBuf:    make(map[uint32]*rudpSegment),
+		notify:    make(chan struct{}, 1),
+		rto:       rudpRTOInit,
+		readLimit: rudpMaxFrags * rudpMSS,
+	}
+}
+
+// send 消息按rudpMSS分段后放入发送队列，窗口允许时立即发出
+func (c *rudpConn) send(msg []byte) error {
+	count := (len(msg) + rudpMSS - 1) / rudpMSS
+	if count == 0 {
+		count = 1
+	}
+	if count > rudpMaxFrags {
+		return errRUDPTooBig
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dead {
+		return errRUDPDeadLink
+	}
+	if len(c.sndQueue)+len(c.sndBuf)+count > rudpMaxQueued {
+		return errDownstreamQueueFull
+	}
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * rudpMSS
+		if end > len(msg) {
+			end = len(msg)
+		}
+		c.sndQueue = append(c.sndQueue, &rudpSegment{
+			frg:  uint8(count - 1 - i),
+			data: append([]byte(nil), msg[i*rudpMSS:end]...),
+		})
+	}
+
+	c.flushLocked(time.Now())
+	return nil
+}
+
+// flush 发送窗口内的新数据段，重传超时或者需要快速重传的段；返回链路是否已断开
+func (c *rudpConn) flush(now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.flushLocked(now)
+	return c.dead
+}
+
+func (c *rudpConn) flushLocked(now time.Time) {
+	for len(c.sndQueue) > 0 && len(c.sndBuf) < rudpSndWnd {
+		seg := c.sndQueue[0]
+		c.sndQueue = c.sndQueue[1:]
+
+		seg.sn = c.sndNxt
+		c.sndNxt++
+		c.sndBuf = append(c.sndBuf, seg)
+	}
+
+	for _, seg := range c.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = c.rto
+			c.stats.Sent++
+		case !now.Before(seg.resendAt):
+			seg.rto *= 2
+			if seg.rto > rudpRTOMax {
+				seg.rto = rudpRTOMax
+			}
+			seg.timeouts++
+			if seg.timeouts > rudpDeadLink {
+				c.dead = true
+			}
+			c.stats.Retransmits++
+		case seg.fastack >= rudpFastResend && seg.xmit <= rudpFastLimit:
+			c.stats.Retransmits++
+		default:
+			continue
+		}
+
+		seg.xmit++
+		seg.fastack = 0
+		seg.sentAt = now
+		seg.resendAt = now.Add(seg.rto)
+
+		pkt := &rudpPacket{conv: c.conv, cmd: rudpCmdData, frg: seg.frg, sn: seg.sn, una: c.rcvNxt, data: seg.data}
+		c.output(pkt.encode())
+	}
+}
+
+// input 处理对端的数据段以及确认；返回会话是否有进展（收到新的段或者确认了未确认的段），
+// 重放的旧包没有进展
+func (c *rudpConn) input(pkt *rudpPacket) (progressed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	switch pkt.cmd {
+	case rudpCmdData:
+		progressed = c.ackUntil(pkt.una)
+		progressed = c.onData(pkt) || progressed
+	case rudpCmdAck:
+		progressed = c.ackUntil(pkt.una)
+		progressed = c.ackSegment(pkt.sn, now) || progressed
+	}
+
+	c.flushLocked(now)
+	return progressed
+}
+
+// onData 接收窗口内的段放入rcvBuf并确认，超出窗口的段丢弃；返回是否是新的段
+func (c *rudpConn) onData(pkt *rudpPacket) (fresh bool) {
+	switch {
+	case c.rcvErr != nil:
+		return false
+	case seqBefore(pkt.sn, c.rcvNxt):
+		c.stats.Duplicates++
+	case !seqBefore(pkt.sn, c.rcvNxt+rudpRcvWnd):
+		return false
+	case c.rcvBuf[pkt.sn] != nil:
+		c.stats.Duplicates++
+	default:
+		c.stats.Received++
+		c.rcvBuf[pkt.sn] = &rudpSegment{sn: pkt.sn, frg: pkt.frg, data: append([]byte(nil), pkt.data...)}
+		c.moveReceived()
+		fresh = true
+	}
+
+	ack := &rudpPacket{conv: c.conv, cmd: rudpCmdAck, sn: pkt.sn, una: c.rcvNxt}
+	c.output(ack.encode())
+	return fresh
+}
+
+// moveReceived 把连续的段按顺序重组为消息；rcvQueue满时暂停，等消息被取走；
+// 每加入一段检查frg以及累计大小，不等整个消息收齐
+func (c *rudpConn) moveReceived() {
+	for c.rcvErr == nil && len(c.rcvQueue) < rudpRcvWnd {
+		seg := c.rcvBuf[c.rcvNxt]
+		if seg == nil {
+			return
+		}
+
+		delete(c.rcvBuf, c.rcvNxt)
+		c.rcvNxt++
+
+		// frg逐段递减，所以一个消息最多rudpMaxFrags段
+		if len(c.partial) > 0 && seg.frg != c.partFrg-1 {
+			c.failReceive(errRUDPPacket)
+			return
+		}
+		if c.partLen+int64(len(seg.data)) > c.readLimit {
+			c.failReceive(errRUDPTooBig)
+			return
+		}
+
+		c.partial = append(c.partial, seg.data)
+		c.partLen += int64(len(seg.data))
+		c.partFrg = seg.frg
+		if seg.frg == 0 {
+			msg := make([]byte, 0, c.partLen)
+			for _, p := range c.partial {
+				msg = append(msg, p...)
+			}
+			c.partial = nil
+			c.partLen = 0
+			c.rcvQueue = append(c.rcvQueue, msg)
+			c.wakeup()
+		}
+	}
+}
+
+// failReceive 停止接收并丢弃缓存的段，由take返回错误后结束会话
+func (c *rudpConn) failReceive(err error) {
+	c.rcvErr = err
+	c.rcvBuf = make(map[uint32]*rudpSegment)
+	c.partial = nil
+	c.partLen = 0
+	c.wakeup()
+}
+
+func (c *rudpConn) wakeup() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ackUntil una之前的段都已被对端收到；返回是否确认了新的段
+func (c *rudpConn) ackUntil(una uint32) bool {
+	i := 0
+	for i < len(c.sndBuf) && seqBefore(c.sndBuf[i].sn, una) {
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+
+	return i > 0
+}
+
+// ackSegment 确认单个段，只用没有重传过的段计算往返时延；之前的段累计快速重传计数
+func (c *rudpConn) ackSegment(sn uint32, now time.Time) bool {
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				c.updateRTT(now.Sub(seg.sentAt))
+			}
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			return true
+		}
+
+		if seqBefore(sn, seg.sn) {
+			return false
+		}
+		seg.fastack++
+	}
+
+	return false
+}
+
+// updateRTT 按RFC 6298估算往返时延以及重传超时
+func (c *rudpConn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+
+	variance := 4 * c.rttvar
+	if variance < rudpInterval {
+		variance = rudpInterval
+	}
+
+	c.rto = c.srtt + variance
+	if c.rto < rudpRTOMin {
+		c.rto = rudpRTOMin
+	}
+	if c.rto > rudpRTOMax {
+		c.rto = rudpRTOMax
+	}
+}
+
+// take 取走重组完成的消息；对端的消息超过readLimit或者分段错误时同时返回错误
+func (c *rudpConn) take() ([][]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	msgs := c.rcvQueue
+	c.rcvQueue = nil
+	c.moveReceived()
+
+	return msgs, c.rcvErr
+}
+
+// snapshot 当前的统计
+func (c *rudpConn) snapshot() RUDPStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	st := c.stats
+	if st.Sent > 0 {
+		st.Loss = float64(st.Retransmits) / float64(st.Sent+st.Retransmits)
+	}
+	st.SRTT = int64(c.srtt / time.Millisecond)
+	st.RTTVar = int64(c.rttvar / time.Millisecond)
+	st.RTO = int64(c.rto / time.Millisecond)
+
+	return st
+}
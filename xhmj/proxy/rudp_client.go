@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	rudpSynInterval = 200 * time.Millisecond
+	rudpDialTimeout = 5 * time.Second
+)
+
+var (
+	errRUDPDialTimeout = errors.New("rudp dial timeout")
+	errRUDPClosed      = errors.New("rudp client closed")
+	errRUDPRecvTimeout = errors.New("rudp recv timeout")
+)
+
+// RUDPClient 可靠udp的客户端，供机器人以及测试使用；
+// 会话由conv标识，Rebind换用新的socket后会话继续
+type RUDPClient struct {
+	addr net.Addr
+	conv *rudpConn
+
+	lock    sync.Mutex
+	pc      net.PacketConn
+	pending [][]byte
+	err     error
+
+	accepted  chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// DialRUDP 通过pc与代理建立会话，query为握手内容，例如"target=127.0.0.1:1234&uid=1"
+func DialRUDP(pc net.PacketConn, addr string, query string) (*RUDPClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [4]byte
+	rand.Read(id[:])
+
+	c := &RUDPClient{
+		addr:     raddr,
+		pc:       pc,
+		accepted: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	c.conv = newRUDPConn(binary.BigEndian.Uint32(id[:])|1, c.output)
+
+	go c.readLoop(pc)
+
+	syn := (&rudpPacket{conv: c.conv.conv, cmd: rudpCmdSyn, data: []byte(query)}).encode()
+	timeout := time.After(rudpDialTimeout)
+	for {
+		c.output(syn)
+
+		select {
+		case <-c.accepted:
+			go c.flushLoop()
+			return c, nil
+		case <-c.closed:
+			return nil, c.err
+		case <-time.After(rudpSynInterval):
+		case <-timeout:
+			c.shutdown(errRUDPDialTimeout)
+			return nil, errRUDPDialTimeout
+		}
+	}
+}
+
+func (c *RUDPClient) output(buf []byte) error {
+	c.lock.Lock()
+	pc := c.pc
+	c.lock.Unlock()
+
+	_, err := pc.WriteTo(buf, c.addr)
+	return err
+}
+
+// Rebind 换用新的socket，模拟客户端的IP或者端口变化
+func (c *RUDPClient) Rebind(pc net.PacketConn) {
+	c.lock.Lock()
+	old := c.pc
+	c.pc = pc
+	c.lock.Unlock()
+
+	old.Close()
+	go c.readLoop(pc)
+}
+
+func (c *RUDPClient) readLoop(pc net.PacketConn) {
+	buf := make([]byte, udpMaxPacket)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		pkt, err := decodeRUDPPacket(buf[:n])
+		if err != nil || pkt.conv != c.conv.conv {
+			continue
+		}
+
+		switch pkt.cmd {
+		case rudpCmdAccept:
+			select {
+			case <-c.accepted:
+			default:
+				close(c.accepted)
+			}
+		case rudpCmdFin:
+			ce := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+			if len(pkt.data) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(pkt.data))
+				ce.Text = string(pkt.data[2:])
+			}
+			c.shutdown(ce)
+			return
+		default:
+			c.conv.input(pkt)
+		}
+	}
+}
+
+func (c *RUDPClient) flushLoop() {
+	ticker := time.NewTicker(rudpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if c.conv.flush(now) {
+				c.shutdown(errRUDPDeadLink)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// shutdown 记录结束原因，之后Recv返回该错误
+func (c *RUDPClient) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		pc := c.pc
+		c.lock.Unlock()
+
+		close(c.closed)
+		pc.Close()
+	})
+}
+
+// Send 发送一个消息
+func (c *RUDPClient) Send(msg []byte) error {
+	select {
+	case <-c.closed:
+		return c.err
+	default:
+	}
+
+	return c.conv.send(msg)
+}
+
+// Recv 按顺序读取下一个消息，会话被代理结束时返回*websocket.CloseError
+func (c *RUDPClient) Recv(timeout time.Duration) ([]byte, error) {
+	deadline := time.After(timeout)
+	for {
+		c.lock.Lock()
+		if len(c.pending) > 0 {
+			msg := c.pending[0]
+			c.pending = c.pending[1:]
+			c.lock.Unlock()
+			return msg, nil
+		}
+		c.lock.Unlock()
+
+		msgs, err := c.conv.take()
+		if len(msgs) > 0 {
+			c.lock.Lock()
+			c.pending = append(c.pending, msgs...)
+			c.lock.Unlock()
+			continue
+		}
+		if err != nil {
+			c.shutdown(err)
+			return nil, err
+		}
+
+		select {
+		case <-c.conv.notify:
+		case <-c.closed:
+			if msgs, _ := c.conv.take(); len(msgs) > 0 {
+				c.lock.Lock()
+				c.pending = append(c.pending, msgs...)
+				c.lock.Unlock()
+				continue
+			}
+			return nil, c.err
+		case <-deadline:
+			return nil, errRUDPRecvTimeout
+		}
+	}
+}
+
+// Stats 会话的丢包以及时延统计
+func (c *RUDPClient) Stats() RUDPStats {
+	return c.conv.snapshot()
+}
+
+// Close 发送FIN结束会话
+func (c *RUDPClient) Close() error {
+	fin := &rudpPacket{conv: c.conv.conv, cmd: rudpCmdFin}
+	for i := 0; i < udpFinRepeat; i++ {
+		c.output(fin.encode())
+	}
+
+	c.shutdown(errRUDPClosed)
+	return nil
+}
@@ -1,60 +1,186 @@
 package proxy
 
 import (
-	"gscfg"
+	"context"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 
 	"fmt"
+	"net/url"
 	"path"
-	"time"
+	"strings"
 
 	"container/list"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	versionCode = 1
 
-	wsReadLimit       = 1024 // 每个websocket的接收数据包长度限制
-	wsReadBufferSize  = 2048 // 每个websocket的接收缓冲限制
-	wsWriteBufferSize = 4096 // 每个websocket的发送缓冲限制
-
 	myRoomType                    = 1
 	gameServerOnlineUserNumPrefix = "wsproxy:"
 	proxyServerInstancePrefix     = "proxyserver:"
+	proxyNoticePrefix             = "proxynotice:" // 每个实例订阅的通知频道
 )
 
-var (
-	upgrader = websocket.Upgrader{ReadBufferSize: wsReadBufferSize,
-		WriteBufferSize: wsWriteBufferSize, CheckOrigin: func(r *http.Request) bool {
+// Server websocket到tcp的代理服务器，一个进程内可以有多个互相独立的实例
+type Server struct {
+	// 会话ID种子以及原子计数，放在最前面保证64位对齐
+	sessionIDSeed uint64
+	// 因消息超过大小限制被关闭的websocket数
+	wsOversizeRejected uint64
+
+	cfg      *Config
+	redis    Redis
+	listener net.Listener
+	// tcp客户端的监听，为nil时不接受tcp客户端
+	tcpListener net.Listener
+	// 可靠udp客户端的socket，为nil时不接受udp客户端
+	udpConn  net.PacketConn
+	upgrader websocket.Upgrader
+
+	// 根router，只有http server看到
+	rootRouter *httprouter.Router
+	httpServer *http.Server
+	// 转发规则的router，可以整体替换；没有匹配到rootRouter的请求交给它
+	forwardRouter    atomic.Value
+	forwardTransport *http.Transport
+	trustedProxies   []*net.IPNet
+	// 转发回复的缓存，以及合并相同的并发请求
+	cache        responseCache
+	cacheFlights flightGroup
+	// 上游的熔断器，没有启用时为nil
+	breakers *breakerSet
+
+	pairLock       sync.Mutex
+	pairHolderList *list.List
+	// http回退传输的会话，按会话ID查找
+	httpLock     sync.Mutex
+	httpSessions map[string]*pairHolder
+	// 可靠udp的会话，按conv查找
+	udpLock     sync.Mutex
+	udpSessions map[uint32]*udpClientConn
+
+	monkeySupportHandlers map[string]monkeySupportHandler
+
+	interceptors   interceptorChain
+	onSessionStart func(sess *Session)
+	onSessionEnd   func(sess *Session)
+
+	tracer trace.Tracer
+
+	recorder     *recorder
+	packetLogger *packetLogger
+	keeper       *aliveKeeper
+	rttHistogram *rttHistogram
+
+	// 服务器的生命周期，所有会话的ctx都由此派生；
+	// wg跟踪服务器启动的所有goroutine，Shutdown等待其全部退出
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New 新建代理服务器，未指定WithRedis时按cfg.RedisServer新建连接池；
+// 不调用Start时也可以通过Handler接入，例如使用httptest
+func New(cfg *Config, opts ...Option) *Server {
+	s := &Server{
+		cfg:            cfg,
+		rootRouter:     httprouter.New(),
+		pairHolderList: list.New(),
+		httpSessions:   make(map[string]*pairHolder),
+		udpSessions:    make(map[uint32]*udpClientConn),
+
+		monkeySupportHandlers: make(map[string]monkeySupportHandler),
+	}
+
+	// 缓冲区大小在接入时按wtype设置
+	s.upgrader = websocket.Upgrader{EnableCompression: cfg.Compression, Subprotocols: subprotocols(),
+		Error: upgradeError, CheckOrigin: func(r *http.Request) bool {
 			return true
 		}}
-	// 根router，只有http server看到
-	rootRouter     = httprouter.New()
-	pairHolderList = list.New()
-)
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.redis == nil {
+		s.redis = NewRedisPool(cfg.RedisServer)
+	}
+
+	if s.tracer == nil {
+		s.tracer = otel.Tracer(tracerName)
+	}
+
+	s.recorder = newRecorder(cfg)
+	s.packetLogger = newPacketLogger(cfg)
+	s.keeper = newAliveKeeper(cfg)
+	s.rttHistogram = newRTTHistogram()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	// 所有模块看到的mainRouter
+	// 外部访问需要形如/game/uuid/play
+	s.rootRouter.Handle("GET", "/game/:uuid/ws/:wtype", s.acceptWebsocket)
+	s.rootRouter.Handle("GET", "/game/:uuid/version", echoVersion)
+
+	// POST和GET都要订阅
+	s.rootRouter.Handle("GET", "/game/:uuid/support/*sp", s.monkeyHTTPHandle)
+	s.rootRouter.Handle("POST", "/game/:uuid/support/*sp", s.monkeyHTTPHandle)
+
+	s.forwardTransport = newForwardTransport()
+	s.trustedProxies = parseTrustedProxies(cfg.TrustedProxies)
+	s.cache = newResponseCache(cfg, s.redis)
+	s.breakers = newBreakerSet(cfg)
+	s.rootRouter.NotFound = http.HandlerFunc(s.serveRoutes)
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		routes = DefaultRoutes(cfg.ProxyScheme, cfg.ProxyTarget)
+	}
+	err := s.SetRoutes(routes)
+	if err != nil {
+		// 配置错误或者没有任何转发规则时不转发任何请求
+		if err != errNoRoutes {
+			log.Errorln("invalid forward routes:", err)
+		}
+		s.forwardRouter.Store(httprouter.New())
+	}
+
+	s.registerRecorderHandlers()
+	s.registerStatsHandlers()
+	s.registerLogHandlers()
+	s.registerCacheHandlers()
+	s.registerNoticeHandlers()
+	s.registerHTTPTransport()
+
+	return s
+}
 
 // 在线玩家数量加1
-func incrOnlinePlayerNum() {
-	conn := pool.Get()
+func (s *Server) incrOnlinePlayerNum() {
+	conn := s.redis.Get()
 	defer conn.Close()
 
 	var key = fmt.Sprintf("%s%d", gameServerOnlineUserNumPrefix, myRoomType)
-	conn.Do("HINCRBY", key, gscfg.ServerID, 1)
+	conn.Do("HINCRBY", key, s.cfg.ServerID, 1)
 }
 
 // 在线玩家数量减1
-func decrOnlinePlayerNum() {
-	conn := pool.Get()
+func (s *Server) decrOnlinePlayerNum() {
+	conn := s.redis.Get()
 	defer conn.Close()
 
 	var key = fmt.Sprintf("%s%d", gameServerOnlineUserNumPrefix, myRoomType)
-	conn.Do("HINCRBY", key, gscfg.ServerID, -1)
+	conn.Do("HINCRBY", key, s.cfg.ServerID, -1)
 }
 
 // GetVersion 版本号
@@ -63,91 +189,160 @@ func GetVersion() int {
 }
 
 func echoVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("X-Proxy-Protocols", strings.Join(subprotocols(), ", "))
 	w.Write([]byte(fmt.Sprintf("version:%d", versionCode)))
 }
 
-func waitWebsocketMessage(holder *pairHolder, r *http.Request) {
-	ws := holder.ws
-
+func waitWebsocketMessage(holder *pairHolder, ws *websocket.Conn) {
 	ws.SetPongHandler(func(msg string) error {
 		//log.Printf("websocket recv ping msg:%s, size:%d\n", msg, len(msg))
-		holder.lastReceivedTime = time.Now()
+		holder.touch()
+		holder.onPong([]byte(msg))
 		return nil
 	})
 
 	ws.SetPingHandler(func(msg string) error {
 		//log.Printf("websocket recv ping msg size:%d\n", len(msg))
-		holder.lastReceivedTime = time.Now()
+		holder.touch()
 		holder.sendPong(msg)
 		return nil
 	})
 
-	// 确保无论出任何情况都会调用onWebsocketClosed，以便房间可以做对玩家做离线处理
-	defer func() {
-		holder.onWebsocketClosed(ws)
-	}()
+	// 确保无论出任何情况都会结束会话，以便房间可以做对玩家做离线处理
+	defer holder.close()
 
-	log.Printf("wait ws msg, peer: %s", r.RemoteAddr)
+	holder.log.Println("wait ws msg")
 	for {
-		mt, message, err := ws.ReadMessage()
+		mt, message, err := holder.readMessage(ws)
+		if err == errMessageTooBig {
+			holder.rejectOversize()
+			break
+		}
+
 		if err != nil {
-			log.Println(" websocket receive error:", err)
-			ws.Close()
+			holder.log.Println("websocket receive error:", err)
 			break
 		}
 
-		holder.lastReceivedTime = time.Now()
+		holder.touch()
 
-		// 只处理BinaryMessage，其他的忽略
-		if message != nil && len(message) > 0 && mt == websocket.BinaryMessage {
-			holder.onWebsocketMessage(ws, message)
+		if len(message) > 0 {
+			holder.onWebsocketMessage(mt, message)
 		}
 
 		// log.Printf("receive from user %s message:%v", user.userID(), message)
 	}
-	log.Printf("ws closed,  peer:%s", r.RemoteAddr)
+	holder.log.Println("ws closed")
 }
 
-// tryAcceptGameUser 游戏玩家接入
-func tryAcceptGameUser(ws *websocket.Conn, r *http.Request) {
+// tryAcceptGameUser 游戏玩家接入，ctx带有接入请求的trace
+func (s *Server) tryAcceptGameUser(ctx context.Context, ws *websocket.Conn, r *http.Request, limits WSLimits) {
 	query := r.URL.Query()
+	holder := s.newGameUserHolder(ws, negotiatedProtocol(ws, r), query, r.RemoteAddr)
+	holder.readLimit = limits.ReadLimit
+
+	holder.log.Println("tryAcceptGameUser, uid:", query.Get("uid"))
+	s.serveSession(ctx, holder, nil, func() {
+		waitWebsocketMessage(holder, ws)
+	})
+}
+
+// newGameUserHolder 按接入参数新建会话：target为游戏服务器地址，uid为用户ID，web=1为浏览器客户端
+func (s *Server) newGameUserHolder(conn clientConn, wire *wireProtocol, query url.Values, peer string) *pairHolder {
 	isFromWeb := query.Get("web") == "1"
-	target := query.Get("target")
-	log.Println("tryAcceptGameUser, target:", target)
+	return newPairHolder(s, conn, wire, isFromWeb, query.Get("target"), peer, query.Get("uid"))
+}
 
-	holder := newPairHolder(ws, isFromWeb, target)
+// serveSession 会话的整个生命周期：登记、连接游戏服务器、等待客户端一端结束，
+// websocket以及http回退传输共用；started不为nil时在连接游戏服务器之后以结果调用，
+// wait阻塞直到客户端一端结束，返回前必须结束会话
+func (s *Server) serveSession(ctx context.Context, holder *pairHolder, started func(error), wait func()) {
+	// 会话整个生命周期一个span，日志带上trace id便于与游戏服务器等关联
+	ctx, span := s.startSpan(ctx, "session", trace.WithAttributes(sessionAttributes(holder.session)...))
+	if sc := span.SpanContext(); sc.IsValid() {
+		holder.log = holder.log.WithField("trace_id", sc.TraceID().String())
+	}
+
+	var err error
+	defer func() {
+		span.SetAttributes(attribute.String("session.uid", holder.session.UserID()))
+		endSpan(span, err)
+	}()
 
-	e := pairHolderList.PushBack(holder)
+	s.pairLock.Lock()
+	e := s.pairHolderList.PushBack(holder)
+	s.pairLock.Unlock()
 
 	defer func() {
-		pairHolderList.Remove(e)
-		decrOnlinePlayerNum()
+		s.pairLock.Lock()
+		s.pairHolderList.Remove(e)
+		s.pairLock.Unlock()
+
+		s.decrOnlinePlayerNum()
 	}()
+	defer holder.stopNotices()
+
+	s.incrOnlinePlayerNum()
+	holder.touch()
+	err = holder.proxyStart(ctx)
+	if started != nil {
+		started(err)
+	}
 
-	incrOnlinePlayerNum()
-	holder.lastReceivedTime = time.Now()
-	err := holder.proxyStart()
 	if err != nil {
-		log.Println("holder.proxyStart failed:", err)
+		holder.log.Warnln("holder.proxyStart failed:", err)
+		holder.close()
 		return
 	}
 
-	waitWebsocketMessage(holder, r)
+	s.keeper.add(holder)
+	defer s.keeper.remove(holder)
+
+	if s.onSessionStart != nil {
+		s.onSessionStart(holder.session)
+	}
+
+	wait()
+
+	// 客户端一端已经结束，等待tcp一端的goroutine退出
+	holder.wait()
+
+	if s.onSessionEnd != nil {
+		s.onSessionEnd(holder.session)
+	}
 }
 
 // acceptWebsocket 把http请求转换为websocket
-func acceptWebsocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (s *Server) acceptWebsocket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	var requestPath = r.URL.Path
 	requestPath = path.Base(requestPath)
 
+	// 服务器正在关闭，不再接入
+	if s.ctx.Err() != nil {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	ctx, span := s.startSpan(extractTrace(r), "ws.accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.path", r.URL.Path), attribute.String("net.peer", r.RemoteAddr)))
+
+	limits := s.wsLimits(ps.ByName("wtype"))
+	upgrader := s.upgrader
+	upgrader.ReadBufferSize = limits.ReadBufferSize
+	upgrader.WriteBufferSize = limits.WriteBufferSize
+
 	ws, err := upgrader.Upgrade(w, r, nil)
+	endSpan(span, err)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// 接收限制
-	ws.SetReadLimit(wsReadLimit)
+	s.setupCompression(ws)
 
 	// 确保 websocket 关闭
 	defer ws.Close()
@@ -155,58 +350,192 @@ func acceptWebsocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	log.Println("accept websocket:", r.URL)
 	switch requestPath {
 	case "play":
-		tryAcceptGameUser(ws, r)
+		s.tryAcceptGameUser(ctx, ws, r, limits)
 		break
 	}
 }
 
-func registerForwardHandlers() {
-	rootRouter.Handle("POST", "/t9user/Login", forwardHTTPHandle)
-}
-
-// CreateHTTPServer 启动服务器
-func CreateHTTPServer() {
-	log.Printf("CreateHTTPServer")
-
-	// 所有模块看到的mainRouter
-	// 外部访问需要形如/game/uuid/play
-	rootRouter.Handle("GET", "/game/:uuid/ws/:wtype", acceptWebsocket)
-	rootRouter.Handle("GET", "/game/:uuid/version", echoVersion)
-
-	// POST和GET都要订阅
-	rootRouter.Handle("GET", "/game/:uuid/support/*sp", monkeyHTTPHandle)
-	rootRouter.Handle("POST", "/game/:uuid/support/*sp", monkeyHTTPHandle)
-
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+// holders 当前所有pairHolder的快照
+func (s *Server) holders() []*pairHolder {
+	s.pairLock.Lock()
+	defer s.pairLock.Unlock()
 
-	registerForwardHandlers()
-	redisStartup()
+	holders := make([]*pairHolder, 0, s.pairHolderList.Len())
+	for e := s.pairHolderList.Front(); e != nil; e = e.Next() {
+		holders = append(holders, e.Value.(*pairHolder))
+	}
 
-	go acceptHTTPRequest()
-	go startAliveKeeper()
+	return holders
 }
 
-// acceptHTTPRequest 监听和接受HTTP
-func acceptHTTPRequest() {
+// Handler 代理的http入口，包括websocket接入以及http转发
+func (s *Server) Handler() http.Handler {
 	c := cors.New(cors.Options{
 		AllowOriginFunc: func(origin string) bool {
 			return true
 		},
 	})
 
-	portStr := fmt.Sprintf(":%d", gscfg.ServerPort)
-	s := &http.Server{
-		Addr:    portStr,
-		Handler: c.Handler(rootRouter),
+	return c.Handler(s.rootRouter)
+}
+
+// Start 登记到redis，然后启动http服务以及保活检查，
+// 未指定WithListener时在cfg.ServerPort上监听；ctx取消等同于调用Shutdown但不等待
+func (s *Server) Start(ctx context.Context) error {
+	log.Printf("Server Start")
+
+	err := s.serverRegister()
+	if err != nil {
+		return err
+	}
+
+	if s.listener == nil {
+		s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.ServerPort))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.httpServer = &http.Server{
+		Handler: s.Handler(),
 		// ReadTimeout:    10 * time.Second,
 		//WriteTimeout:   120 * time.Second,
-		MaxHeaderBytes: 1 << 8,
+		MaxHeaderBytes: s.maxHeaderBytes(),
 	}
 
-	log.Printf("Http server listen at:%d\n", gscfg.ServerPort)
+	if s.tcpListener == nil && s.cfg.ClientTCPAddr != "" {
+		s.tcpListener, err = net.Listen("tcp", s.cfg.ClientTCPAddr)
+		if err != nil {
+			return err
+		}
+	}
 
-	err := s.ListenAndServe()
-	if err != nil {
-		log.Fatalf("Http server ListenAndServe %d failed:%s\n", gscfg.ServerPort, err)
+	if s.udpConn == nil && s.cfg.ClientUDPAddr != "" {
+		s.udpConn, err = net.ListenPacket("udp", s.cfg.ClientUDPAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.wg.Add(4)
+	go s.acceptHTTPRequest()
+	go s.startAliveKeeper()
+	go s.stopOnDone(ctx)
+	go s.listenNotices()
+
+	if s.tcpListener != nil {
+		s.wg.Add(1)
+		go s.acceptTCPClients()
+	}
+
+	if s.udpConn != nil {
+		s.wg.Add(2)
+		go s.acceptUDPClients()
+		go s.flushUDPSessions()
+	}
+
+	return nil
+}
+
+// stopOnDone 外部ctx取消时结束服务器
+func (s *Server) stopOnDone(ctx context.Context) {
+	defer s.wg.Done()
+
+	select {
+	case <-ctx.Done():
+		s.stop()
+	case <-s.ctx.Done():
+	}
+}
+
+// stop 取消服务器ctx，所有会话随之结束，并关闭http server
+func (s *Server) stop() {
+	s.cancel()
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+}
+
+// Shutdown 停止接受新的请求，结束所有会话，并等待所有goroutine退出，
+// ctx超时则返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	// 先结束所有会话，http回退传输的SSE以及长轮询请求随会话结束返回，
+	// 否则httpServer.Shutdown会一直等待这些请求直到ctx超时
+	s.cancel()
+
+	var err error
+	if s.httpServer != nil {
+		// 等待普通的http请求（例如转发）完成，websocket被hijack不受影响
+		err = s.httpServer.Shutdown(ctx)
+	}
+
+	s.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// 所有会话都已结束，不会再有抓包记录
+	cerr := s.recorder.close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Addr 监听地址，Start之后有效
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
+// TCPAddr tcp客户端的监听地址，没有监听时为nil
+func (s *Server) TCPAddr() net.Addr {
+	if s.tcpListener == nil {
+		return nil
+	}
+
+	return s.tcpListener.Addr()
+}
+
+// UDPAddr 可靠udp客户端的监听地址，没有监听时为nil
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+
+	return s.udpConn.LocalAddr()
+}
+
+// acceptHTTPRequest 监听和接受HTTP
+func (s *Server) acceptHTTPRequest() {
+	defer s.wg.Done()
+
+	log.Printf("Http server listen at:%s\n", s.listener.Addr())
+
+	err := s.httpServer.Serve(s.listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("Http server Serve %s failed:%s\n", s.listener.Addr(), err)
 	}
 }
@@ -0,0 +1,2555 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"xhmj/proxy"
+	"xhmj/proxy/proxytest"
+
+	"github.com/gorilla/websocket"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testTimeout = 3 * time.Second
+
+// newTestProxy 启动一个使用内存redis的代理以及一个假游戏服务器
+func newTestProxy(t *testing.T, opts ...proxy.Option) (*httptest.Server, *proxytest.GameServer, *proxytest.Redis) {
+	t.Helper()
+
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gs.Close)
+
+	rds := proxytest.NewRedis()
+	cfg := &proxy.Config{ServerID: "test-server", CaptureDir: t.TempDir()}
+	srv := proxy.New(cfg, append([]proxy.Option{proxy.WithRedis(rds)}, opts...)...)
+
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts, gs, rds
+}
+
+// startTestServer 在随机端口上启动使用指定配置的代理，测试结束时关闭
+func startTestServer(t *testing.T, cfg *proxy.Config, opts ...proxy.Option) *proxy.Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts = append([]proxy.Option{proxy.WithListener(ln)}, opts...)
+	srv := proxy.New(cfg, opts...)
+	err = srv.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	return srv
+}
+
+func TestProxyEcho(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	body := []byte("hello game server")
+	err = c.SendGame(3, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gmsg.GetOps() != 3<<8 || !bytes.Equal(gmsg.GetData(), body) {
+		t.Fatalf("unexpected reply, ops:%d, data:%q", gmsg.GetOps(), gmsg.GetData())
+	}
+}
+
+func TestInterceptorModifyAndDrop(t *testing.T) {
+	dropped := proxy.InterceptorFunc(func(sess *proxy.Session, pkt *proxy.Packet) bool {
+		return pkt.Ops != 9<<8
+	})
+	upper := proxy.InterceptorFunc(func(sess *proxy.Session, pkt *proxy.Packet) bool {
+		if pkt.Dir == proxy.DirDownstream {
+			pkt.Data = bytes.ToUpper(pkt.Data)
+		}
+		return true
+	})
+
+	ts, gs, _ := newTestProxy(t, proxy.WithInterceptors(dropped, upper))
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SendGame(9, []byte("dropped"))
+	c.SendGame(3, []byte("echo"))
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gmsg.GetOps() != 3<<8 || string(gmsg.GetData()) != "ECHO" {
+		t.Fatalf("unexpected reply, ops:%d, data:%q", gmsg.GetOps(), gmsg.GetData())
+	}
+}
+
+func TestInterceptorRetainsData(t *testing.T) {
+	retained := make(chan []byte, 2)
+	keep := proxy.InterceptorFunc(func(sess *proxy.Session, pkt *proxy.Packet) bool {
+		if pkt.Dir == proxy.DirDownstream {
+			retained <- pkt.Data
+		}
+		return true
+	})
+
+	ts, gs, _ := newTestProxy(t, proxy.WithInterceptors(keep))
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第二个包不能覆盖拦截器保留的第一个包
+	gc.Send(7, []byte("first"), false)
+	gc.Send(7, []byte("SECOND"), false)
+	for i := 0; i < 2; i++ {
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if first := <-retained; string(first) != "first" {
+		t.Fatalf("retained data overwritten:%q", first)
+	}
+}
+
+func TestProxyDecompressesDownstream(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("compressed "), 50)
+	err = gc.Send(7, body, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gmsg.GetOps() != 7<<8 || !bytes.Equal(gmsg.GetData(), body) {
+		t.Fatalf("unexpected message, ops:%d, len:%d", gmsg.GetOps(), len(gmsg.GetData()))
+	}
+}
+
+func TestProxyWebPing(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+
+	c, err := proxytest.Dial(ts.URL, "web=1&target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.SendProxyMessage(int32(proxy.MessageCode_OPPing), []byte("12345678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gmsg.GetOps() != int32(proxy.MessageCode_OPPong) || string(gmsg.GetData()) != "12345678" {
+		t.Fatalf("expected pong, got ops:%d", gmsg.GetOps())
+	}
+}
+
+func TestGameServerCloseClosesWebsocket(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.Close()
+
+	_, err = c.ReadProxyMessage(testTimeout)
+	if err == nil {
+		t.Fatal("expected websocket to be closed")
+	}
+}
+
+func TestIndependentServers(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	// 同一进程内同时运行两个实例
+	ids := []string{"server-a", "server-b"}
+	servers := make([]*proxy.Server, len(ids))
+	ended := make([]chan struct{}, len(ids))
+	for i, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		ended[i] = done
+		servers[i] = proxy.New(&proxy.Config{ServerID: id},
+			proxy.WithRedis(proxytest.NewRedis()),
+			proxy.WithListener(ln),
+			proxy.WithSessionHooks(nil, func(sess *proxy.Session) { close(done) }))
+
+		err = servers[i].Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clients := make([]*proxytest.Client, len(ids))
+	for i, srv := range servers {
+		c, err := proxytest.Dial("ws://"+srv.Addr().String(), "target="+gs.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+
+		c.SendGame(1, []byte(ids[i]))
+		gmsg, err := c.ReadProxyMessage(testTimeout)
+		if err != nil || string(gmsg.GetData()) != ids[i] {
+			t.Fatalf("%s: unexpected reply:%v, %v", ids[i], gmsg, err)
+		}
+	}
+
+	// 关闭第一个实例不影响第二个
+	err = servers[0].Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ended[0]:
+	case <-time.After(testTimeout):
+		t.Fatal("session not ended after shutdown")
+	}
+
+	_, err = clients[0].ReadProxyMessage(testTimeout)
+	if err == nil {
+		t.Fatal("expected websocket closed after shutdown")
+	}
+
+	clients[1].SendGame(1, []byte("still alive"))
+	gmsg, err := clients[1].ReadProxyMessage(testTimeout)
+	if err != nil || string(gmsg.GetData()) != "still alive" {
+		t.Fatalf("second server affected by shutdown:%v, %v", gmsg, err)
+	}
+
+	servers[1].Shutdown(context.Background())
+}
+
+func TestStartContextCancelStopsSessions(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := proxy.New(&proxy.Config{ServerID: "ctx-server"},
+		proxy.WithRedis(proxytest.NewRedis()), proxy.WithListener(ln))
+	err = srv.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := proxytest.Dial("ws://"+srv.Addr().String(), "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	_, err = c.ReadProxyMessage(testTimeout)
+	if err == nil {
+		t.Fatal("expected websocket closed after ctx cancel")
+	}
+
+	_, err = gc.Receive(testTimeout)
+	if err == nil {
+		t.Fatal("expected game connection closed after ctx cancel")
+	}
+
+	// 所有goroutine已经或者即将退出，Shutdown应该很快返回
+	sctx, scancel := context.WithTimeout(context.Background(), testTimeout)
+	defer scancel()
+
+	err = srv.Shutdown(sctx)
+	if err != nil {
+		t.Fatal("shutdown:", err)
+	}
+}
+
+func TestOnlinePlayerCount(t *testing.T) {
+	ts, gs, rds := newTestProxy(t)
+
+	c, err := proxytest.Dial(ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := rds.HGet("wsproxy:1", "test-server"); n != "1" {
+		t.Fatalf("online count expected 1, got %q", n)
+	}
+
+	c.Close()
+
+	deadline := time.Now().Add(testTimeout)
+	for rds.HGet("wsproxy:1", "test-server") != "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("online count not decreased after client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepalivePingAndIdleClose(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	cfg := &proxy.Config{
+		ServerID:     "keepalive-server",
+		IdleTimeout:  time.Second,
+		PingIdle:     200 * time.Millisecond,
+		PingInterval: 200 * time.Millisecond,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()))
+
+	c, err := proxytest.Dial("ws://"+srv.Addr().String(), "web=1&target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 空闲超过PingIdle后收到ping
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gmsg.GetOps() != int32(proxy.MessageCode_OPPing) {
+		t.Fatalf("expected ping, got ops:%d", gmsg.GetOps())
+	}
+
+	// 不回复pong，超过IdleTimeout后会话被关闭
+	for {
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			break
+		}
+	}
+}
+
+func TestRTTMeasurement(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+
+	cfg := &proxy.Config{
+		ServerID:     "rtt-server",
+		PingIdle:     100 * time.Millisecond,
+		PingInterval: 100 * time.Millisecond,
+		PushRTT:      true,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(rds))
+
+	c, err := proxytest.Dial("ws://"+srv.Addr().String(), "web=1&target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gmsg.GetOps() != int32(proxy.MessageCode_OPPing) || len(gmsg.GetData()) != 8 {
+		t.Fatalf("expected ping with timestamp, got ops:%d, len:%d", gmsg.GetOps(), len(gmsg.GetData()))
+	}
+
+	// 模拟网络延迟后原样回复
+	time.Sleep(20 * time.Millisecond)
+	c.SendProxyMessage(int32(proxy.MessageCode_OPPong), gmsg.GetData())
+
+	for {
+		gmsg, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gmsg.GetOps() == int32(proxy.MessageCode_OPRtt) {
+			break
+		}
+	}
+
+	rtt := binary.LittleEndian.Uint32(gmsg.GetData())
+	if rtt < 20 || rtt > 1000 {
+		t.Fatalf("unexpected rtt:%dms", rtt)
+	}
+
+	resp, err := http.Get("http://" + srv.Addr().String() + "/game/test/support/sessions?account=admin&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var sessions []struct {
+		RTTLast    uint32 `json:"rttLast"`
+		RTTSamples int    `json:"rttSamples"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].RTTSamples != 1 || sessions[0].RTTLast != rtt {
+		t.Fatalf("unexpected session list:%+v", sessions)
+	}
+
+	resp, err = http.Get("http://" + srv.Addr().String() + "/game/test/support/metrics?account=admin&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Contains(body, []byte("xhproxy_rtt_milliseconds_count 1\n")) {
+		t.Fatalf("rtt histogram not updated:\n%s", body)
+	}
+}
+
+func TestUpstreamHeartbeatAndUnresponsive(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	// 游戏服务器挂起：不回复任何包，也不断开连接
+	gs.Handler = func(conn *proxytest.GameConn, pkt *proxytest.GamePacket) {}
+
+	cfg := &proxy.Config{
+		ServerID:                  "upstream-server",
+		UpstreamReadTimeout:       500 * time.Millisecond,
+		UpstreamHeartbeatMsg:      99,
+		UpstreamHeartbeatInterval: 100 * time.Millisecond,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()))
+
+	c, err := proxytest.Dial("ws://"+srv.Addr().String(), "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, err := gc.Receive(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Msg != 99 || len(pkt.Body) != 0 {
+		t.Fatalf("expected heartbeat, got msg:%d, len:%d", pkt.Msg, len(pkt.Body))
+	}
+
+	_, err = c.ReadProxyMessage(testTimeout)
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseTryAgainLater || ce.Text != "upstream unresponsive" {
+		t.Fatalf("expected upstream unresponsive close, got:%v", err)
+	}
+}
+
+func TestUpstreamHeartbeatReplyNotForwarded(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	cfg := &proxy.Config{
+		ServerID:                  "upstream-server",
+		UpstreamReadTimeout:       500 * time.Millisecond,
+		UpstreamHeartbeatMsg:      99,
+		UpstreamHeartbeatInterval: 100 * time.Millisecond,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()))
+
+	c, err := proxytest.Dial("ws://"+srv.Addr().String(), "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 游戏服务器回显心跳，超过读超时后会话仍然存活，客户端也收不到心跳
+	time.Sleep(time.Second)
+
+	c.SendGame(3, []byte("alive"))
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gmsg.GetOps() != 3<<8 || string(gmsg.GetData()) != "alive" {
+		t.Fatalf("unexpected reply, ops:%d, data:%q", gmsg.GetOps(), gmsg.GetData())
+	}
+}
+
+func TestPacketLogOnlyForSelectedSessions(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	ts, gs, rds := newTestProxy(t)
+	rds.HSet("xhproxy1", "admin", "secret")
+
+	resp, err := http.Get(ts.URL + "/game/test/support/packetlog?account=admin&password=secret&uid=u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, uid := range []string{"u1", "u2"} {
+		c, err := proxytest.Dial(ts.URL, "uid="+uid+"&target="+gs.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.SendGame(3, []byte(uid))
+		_, err = c.ReadProxyMessage(testTimeout)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只有u1的会话输出逐包日志，并且带有会话字段
+	var logged []string
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "sendTCPMessage") {
+			logged = append(logged, fmt.Sprint(e.Data["sid"], e.Data["peer"] != nil, e.Data["target"]))
+		}
+	}
+
+	if len(logged) != 1 || logged[0] != fmt.Sprint(1, true, gs.Addr()) {
+		t.Fatalf("unexpected packet logs:%v", logged)
+	}
+}
+
+func TestTracingSpansAndPropagation(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	var forwardedTrace string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedTrace = r.Header.Get("traceparent")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	ended := make(chan struct{})
+	cfg := &proxy.Config{
+		ServerID:    "trace-server",
+		ProxyScheme: "http",
+		ProxyTarget: strings.TrimPrefix(backend.URL, "http://"),
+	}
+	srv := proxy.New(cfg, proxy.WithRedis(proxytest.NewRedis()), proxy.WithTracerProvider(tp),
+		proxy.WithSessionHooks(nil, func(sess *proxy.Session) { close(ended) }))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	// 转发的http请求沿用调用方的trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("POST", ts.URL+"/t9user/Login", strings.NewReader("{}"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !strings.HasPrefix(forwardedTrace, "00-"+traceID+"-") {
+		t.Fatalf("trace context not propagated, got traceparent:%q", forwardedTrace)
+	}
+
+	c, err := proxytest.Dial(ts.URL, "uid=u1&target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SendGame(1, []byte("ping"))
+	_, err = c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	select {
+	case <-ended:
+	case <-time.After(testTimeout):
+		t.Fatal("session not ended")
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+
+	if s := spans["http.forward"]; s.SpanContext.TraceID().String() != traceID {
+		t.Fatalf("http.forward span not in caller trace:%v", s.SpanContext.TraceID())
+	}
+
+	accept, session, dial := spans["ws.accept"], spans["session"], spans["upstream.dial"]
+	if !accept.SpanContext.IsValid() || !session.SpanContext.IsValid() || !dial.SpanContext.IsValid() {
+		t.Fatalf("missing session spans, got:%v", len(spans))
+	}
+
+	if session.Parent.SpanID() != accept.SpanContext.SpanID() || dial.Parent.SpanID() != session.SpanContext.SpanID() {
+		t.Fatal("session spans not linked as accept -> session -> dial")
+	}
+}
+
+func TestForwardRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "%s %s?%s x-from:%s cookie:%s", r.Method, r.URL.EscapedPath(), r.URL.RawQuery,
+			r.Header.Get("X-From"), r.Header.Get("Cookie"))
+	}))
+	defer backend.Close()
+
+	cfg := &proxy.Config{
+		ServerID: "route-server",
+		Routes: []proxy.Route{
+			{Method: "POST", Path: "/t9user/Login", Upstream: backend.URL},
+			{Path: "/pay/:channel/*rest", Upstream: backend.URL + "/base/", Rewrite: "/v2/:channel/*rest",
+				AddHeaders: map[string]string{"X-From": "proxy"}, RemoveHeaders: []string{"Cookie"}},
+			{Path: "/slow", Upstream: backend.URL, Timeout: 100 * time.Millisecond},
+			{Method: "GET", Path: "/files/*name", Upstream: backend.URL},
+		},
+	}
+	srv := proxy.New(cfg, proxy.WithRedis(proxytest.NewRedis()))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	do := func(method, path string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Cookie", "a=b")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	cases := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"POST", "/t9user/Login?x=1", 200, "POST /t9user/Login?x=1 x-from: cookie:a=b"},
+		{"GET", "/t9user/Login", 405, ""},
+		{"GET", "/pay/wx/order/1?y=2", 200, "GET /base/v2/wx/order/1?y=2 x-from:proxy cookie:"},
+		// 路径中的转义原样转发
+		{"GET", "/pay/wx/a%2Fb/c%20d", 200, "GET /base/v2/wx/a%2Fb/c%20d? x-from:proxy cookie:"},
+		{"GET", "/files/dir%2Fname", 200, "GET /files/dir%2Fname? x-from: cookie:a=b"},
+		{"GET", "/slow", 504, ""},
+		{"GET", "/unknown", 404, ""},
+	}
+
+	for _, c := range cases {
+		code, body := do(c.method, c.path)
+		if code != c.code || (c.body != "" && body != c.body) {
+			t.Fatalf("%s %s: got %d %q, want %d %q", c.method, c.path, code, body, c.code, c.body)
+		}
+	}
+
+	// 替换规则后立即生效，错误的规则不影响原来的规则
+	err := srv.SetRoutes([]proxy.Route{{Path: "/new", Upstream: "not a url"}})
+	if err == nil {
+		t.Fatal("expected invalid route error")
+	}
+
+	err = srv.SetRoutes([]proxy.Route{{Method: "GET", Path: "/new", Upstream: backend.URL, Rewrite: "/renamed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := do("GET", "/new"); code != 200 || !strings.HasPrefix(body, "GET /renamed?") {
+		t.Fatalf("new route: got %d %q", code, body)
+	}
+
+	if code, _ := do("POST", "/t9user/Login"); code != 404 {
+		t.Fatalf("old route still served: %d", code)
+	}
+
+	// 空的规则多半是配置写错，返回错误并保留原来的规则；重新加载时由调用者传入新的默认规则
+	err = srv.SetRoutes(nil)
+	if err == nil {
+		t.Fatal("expected error for empty routes")
+	}
+
+	if code, _ := do("GET", "/new"); code != 200 {
+		t.Fatalf("routes dropped by empty set: %d", code)
+	}
+
+	err = srv.SetRoutes(proxy.DefaultRoutes("", strings.TrimPrefix(backend.URL, "http://")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, body := do("POST", "/t9user/Login"); code != 200 || !strings.HasPrefix(body, "POST /t9user/Login?") {
+		t.Fatalf("reloaded default route: got %d %q", code, body)
+	}
+}
+
+// dropFirstListener 关闭第一个接入的连接，模拟上游连接失败
+type dropFirstListener struct {
+	net.Listener
+	dropped int32
+}
+
+func (l *dropFirstListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt32(&l.dropped, 1) > 1 {
+			return c, err
+		}
+		c.Close()
+	}
+}
+
+func TestForwardReverseProxySemantics(t *testing.T) {
+	var got http.Header
+	var gotBody int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		gotBody = int(n)
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte("ok"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &http.Server{Handler: handler}
+	go backend.Serve(&dropFirstListener{Listener: ln})
+	defer backend.Close()
+
+	cfg := &proxy.Config{
+		ServerID:       "forward-server",
+		ForwardMaxBody: 16,
+		TrustedProxies: []string{"10.1.0.0/16", "127.0.0.1"},
+		Routes:         []proxy.Route{{Path: "/api/*rest", Upstream: "http://" + ln.Addr().String()}},
+	}
+	srv := proxy.New(cfg, proxy.WithRedis(proxytest.NewRedis()))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	// 第一次连接被上游关闭，GET请求重试后成功；hop-by-hop头被去掉，带上X-Forwarded-*
+	req, _ := http.NewRequest("GET", ts.URL+"/api/x", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected retry to succeed, got %d", resp.StatusCode)
+	}
+
+	if got.Get("X-Hop") != "" || got.Get("X-Forwarded-For") != "10.0.0.1, 127.0.0.1" ||
+		got.Get("X-Forwarded-Proto") != "http" || got.Get("X-Forwarded-Host") != strings.TrimPrefix(ts.URL, "http://") {
+		t.Fatalf("unexpected forwarded headers:%v", got)
+	}
+
+	if resp.Header.Get("X-Internal") != "" || resp.Header.Get("Keep-Alive") != "" {
+		t.Fatalf("hop-by-hop response headers leaked:%v", resp.Header)
+	}
+
+	// 对端不是可信的前置代理时，客户端带的X-Forwarded-For被替换为对端地址
+	cfg2 := *cfg
+	cfg2.TrustedProxies = []string{"10.1.0.0/16"}
+	ts2 := httptest.NewServer(proxy.New(&cfg2, proxy.WithRedis(proxytest.NewRedis())).Handler())
+	defer ts2.Close()
+
+	req, _ = http.NewRequest("GET", ts2.URL+"/api/x", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got.Get("X-Forwarded-For") != "127.0.0.1" {
+		t.Fatalf("untrusted X-Forwarded-For kept:%v", got.Get("X-Forwarded-For"))
+	}
+
+	// 请求体不超过限制时流式转发，超过限制返回413
+	resp, err = http.Post(ts.URL+"/api/x", "text/plain", strings.NewReader("small body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || gotBody != len("small body") {
+		t.Fatalf("small body: %d, forwarded %d bytes", resp.StatusCode, gotBody)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/x", "text/plain", strings.NewReader(strings.Repeat("x", 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body: expected 413, got %d", resp.StatusCode)
+	}
+
+	// 不知道长度的请求体在转发过程中超过限制
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(strings.Repeat("y", 64)))
+		pw.Close()
+	}()
+	resp, err = http.Post(ts.URL+"/api/x", "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked large body: expected 413, got %d", resp.StatusCode)
+	}
+}
+
+func TestForwardResponseCache(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			testForwardResponseCache(t, backend)
+		})
+	}
+}
+
+func testForwardResponseCache(t *testing.T, cacheBackend string) {
+	var hits, revalidated int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/session":
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Set-Cookie", fmt.Sprintf("sid=%d", n))
+		case "/lang":
+			w.Header().Set("Vary", "X-Lang")
+			fmt.Fprintf(w, "lang %s", r.Header.Get("X-Lang"))
+			return
+		case "/gz":
+			w.Header().Set("Vary", "Accept-Encoding")
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				fmt.Fprintf(zw, "content of %s", r.URL.Path)
+				zw.Close()
+				return
+			}
+		case "/notice":
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/big":
+			w.Write(bytes.Repeat([]byte("b"), 3<<20))
+			return
+		case "/manifest":
+			w.Header().Set("ETag", `"m1"`)
+			if r.Header.Get("If-None-Match") == `"m1"` {
+				atomic.AddInt32(&revalidated, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		fmt.Fprintf(w, "content of %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	cfg := &proxy.Config{
+		ServerID:     "cache-server",
+		CacheBackend: cacheBackend,
+		Routes: []proxy.Route{
+			{Method: "GET", Path: "/notice", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/private", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/manifest", Upstream: upstream.URL, CacheTTL: 100 * time.Millisecond},
+			{Method: "GET", Path: "/session", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/lang", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/gz", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/big", Upstream: upstream.URL, CacheTTL: time.Minute},
+			{Method: "GET", Path: "/item/*name", Upstream: upstream.URL, CacheTTL: time.Minute},
+		},
+	}
+	srv := proxy.New(cfg, proxy.WithRedis(rds))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	get := func(path string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return nil, ""
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// 并发的相同请求只访问上游一次
+	done := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, body := get("/notice")
+			done <- body
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if body := <-done; body != "content of /notice" {
+			t.Fatalf("unexpected body:%q", body)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected 1 upstream hit for coalesced requests, got %d", n)
+	}
+
+	resp, _ := get("/notice")
+	if resp.Header.Get("X-Cache") != "HIT" || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("expected cache hit, X-Cache:%s hits:%d", resp.Header.Get("X-Cache"), hits)
+	}
+
+	resp, _ = get("/notice", "If-None-Match", `"v1"`)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching etag, got %d", resp.StatusCode)
+	}
+
+	if cacheBackend == "redis" && len(rds.Keys("xhproxy:cache:*")) != 1 {
+		t.Fatalf("expected cached response in redis, keys:%v", rds.Keys("xhproxy:cache:*"))
+	}
+
+	// 上游禁止缓存
+	get("/private")
+	get("/private")
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Fatalf("no-store response should not be cached, hits:%d", n)
+	}
+
+	// 过期后向上游做条件请求，上游回复304时继续使用缓存的内容
+	get("/manifest")
+	time.Sleep(150 * time.Millisecond)
+	resp, body := get("/manifest")
+	if resp.StatusCode != 200 || body != "content of /manifest" || atomic.LoadInt32(&revalidated) != 1 {
+		t.Fatalf("revalidation: %d %q, revalidated:%d", resp.StatusCode, body, revalidated)
+	}
+
+	// 通过管理接口清除缓存后重新访问上游
+	resp, body = get("/game/x/support/cache/purge?account=admin&password=secret&prefix=/notice")
+	if resp.StatusCode != 200 || body != `{"purged":1}` {
+		t.Fatalf("purge: %d %q", resp.StatusCode, body)
+	}
+
+	before := atomic.LoadInt32(&hits)
+	resp, _ = get("/notice")
+	if resp.Header.Get("X-Cache") != "MISS" || atomic.LoadInt32(&hits) != before+1 {
+		t.Fatalf("expected miss after purge, X-Cache:%s", resp.Header.Get("X-Cache"))
+	}
+
+	// 带Cookie的请求不使用缓存
+	resp, _ = get("/notice", "Cookie", "a=b")
+	if resp.Header.Get("X-Cache") != "" || atomic.LoadInt32(&hits) != before+2 {
+		t.Fatalf("request with cookie should bypass cache, X-Cache:%s", resp.Header.Get("X-Cache"))
+	}
+
+	// 不能缓存的回复不共用，每个请求拿到自己的Set-Cookie
+	before = atomic.LoadInt32(&hits)
+	cookies := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			resp, _ := get("/session")
+			cookies <- resp.Header.Get("Set-Cookie")
+		}()
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		seen[<-cookies] = true
+	}
+	if len(seen) != 5 || atomic.LoadInt32(&hits) != before+5 {
+		t.Fatalf("uncacheable response shared between requests, cookies:%v", seen)
+	}
+
+	// Vary中有其他请求头时不缓存
+	_, body = get("/lang", "X-Lang", "en")
+	_, body2 := get("/lang", "X-Lang", "zh")
+	if body != "lang en" || body2 != "lang zh" {
+		t.Fatalf("vary response cached: %q %q", body, body2)
+	}
+
+	// 缓存的总是未压缩的内容，不管第一个请求是否接受gzip
+	resp, body = get("/gz", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || body != "content of /gz" {
+		t.Fatalf("gzip: encoding:%q body:%q", resp.Header.Get("Content-Encoding"), body)
+	}
+
+	resp, body = get("/gz")
+	if resp.Header.Get("X-Cache") != "HIT" || body != "content of /gz" {
+		t.Fatalf("gzip cached: X-Cache:%s body:%q", resp.Header.Get("X-Cache"), body)
+	}
+
+	// 超过缓存上限的回复直接转发，不缓存
+	for i := 0; i < 2; i++ {
+		before = atomic.LoadInt32(&hits)
+		resp, body = get("/big")
+		if resp.Header.Get("X-Cache") != "MISS" || len(body) != 3<<20 || atomic.LoadInt32(&hits) != before+1 {
+			t.Fatalf("big response: X-Cache:%s len:%d", resp.Header.Get("X-Cache"), len(body))
+		}
+	}
+
+	// 清除的前缀中的*按原样匹配
+	get("/item/a*x")
+	get("/item/abc")
+	resp, body = get("/game/x/support/cache/purge?account=admin&password=secret&prefix=/item/a*")
+	if resp.StatusCode != 200 || body != `{"purged":1}` {
+		t.Fatalf("purge with glob: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ = get("/item/abc"); resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("purge with glob removed other keys, X-Cache:%s", resp.Header.Get("X-Cache"))
+	}
+
+	// 重新加载后上游变了，不再使用原来的缓存
+	upstream2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "new content of %s", r.URL.Path)
+	}))
+	defer upstream2.Close()
+
+	err := srv.SetRoutes([]proxy.Route{{Method: "GET", Path: "/notice", Upstream: upstream2.URL, CacheTTL: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body = get("/notice")
+	if resp.Header.Get("X-Cache") != "MISS" || body != "new content of /notice" {
+		t.Fatalf("cache served after upstream changed: X-Cache:%s body:%q", resp.Header.Get("X-Cache"), body)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var hits int32
+	var healthy int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	// 没有监听的端口，拨号立即失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	cfg := &proxy.Config{
+		ServerID:        "breaker-server",
+		BreakerFailures: 2,
+		BreakerCooldown: 200 * time.Millisecond,
+		Routes:          []proxy.Route{{Path: "/login", Upstream: upstream.URL}},
+	}
+	srv := proxy.New(cfg, proxy.WithRedis(rds))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	// 连续失败2次后熔断，之后的请求不再访问上游
+	get("/login")
+	get("/login")
+	code, body := get("/login")
+	if code != http.StatusServiceUnavailable || body != "upstream circuit open" || atomic.LoadInt32(&hits) != 2 {
+		t.Fatalf("expected fast fail while open, got %d %q, hits:%d", code, body, hits)
+	}
+
+	_, body = get("/game/x/support/breakers?account=admin&password=secret")
+	if !strings.Contains(body, `"upstream":"`+upstream.URL+`","state":"open"`) {
+		t.Fatalf("unexpected breakers:%s", body)
+	}
+
+	_, body = get("/game/x/support/metrics?account=admin&password=secret")
+	if !strings.Contains(body, `xhproxy_breaker_state{upstream="`+upstream.URL+`"} 1`) ||
+		!strings.Contains(body, `xhproxy_breaker_rejected_total{upstream="`+upstream.URL+`"} 1`) {
+		t.Fatalf("unexpected metrics:%s", body)
+	}
+
+	// 冷却后放行探测请求，成功后恢复
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(250 * time.Millisecond)
+	if code, _ := get("/login"); code != 200 {
+		t.Fatalf("expected probe to succeed, got %d", code)
+	}
+	if code, _ := get("/login"); code != 200 {
+		t.Fatalf("expected breaker closed, got %d", code)
+	}
+
+	// 游戏服务器拨号失败2次后熔断，拨号失败与熔断以不同的关闭码告知客户端
+	for i := 0; i < 3; i++ {
+		c, err := proxytest.Dial(ts.URL, "target="+deadAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.ReadProxyMessage(testTimeout)
+		c.Close()
+
+		ce, ok := err.(*websocket.CloseError)
+		if i < 2 && (!ok || ce.Code != websocket.CloseTryAgainLater || ce.Text != "upstream dial failed") {
+			t.Fatalf("dial %d: expected dial failed close, got %v", i, err)
+		}
+		if i == 2 && (!ok || ce.Code != 4503 || ce.Text != "upstream circuit open") {
+			t.Fatalf("expected circuit open close, got %v", err)
+		}
+	}
+
+	// http回退传输熔断时返回503，拨号失败时返回502
+	resp, err := http.Post(ts.URL+"/game/x/http/play/open?target="+deadAddr, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while open, got %d", resp.StatusCode)
+	}
+
+	// 管理接口只能恢复已有的熔断器，未知的地址不会新建
+	code, body = get("/game/x/support/breakers?account=admin&password=secret&reset=tcp://" + deadAddr)
+	if code != 200 || !strings.Contains(body, `"upstream":"tcp://`+deadAddr+`","state":"closed"`) {
+		t.Fatalf("reset breaker: %d %s", code, body)
+	}
+
+	code, _ = get("/game/x/support/breakers?account=admin&password=secret&reset=tcp://127.0.0.1:1")
+	if code != http.StatusNotFound {
+		t.Fatalf("reset unknown breaker: %d", code)
+	}
+
+	_, body = get("/game/x/support/breakers?account=admin&password=secret")
+	if strings.Contains(body, "127.0.0.1:1\"") {
+		t.Fatalf("unknown breaker created by reset: %s", body)
+	}
+}
+
+// countingConn 统计从代理收到的字节数
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// newCountingDialer 开启压缩协商并统计收到字节数的Dialer
+func newCountingDialer(read *int64) *websocket.Dialer {
+	return &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: c, read: read}, nil
+		},
+	}
+}
+
+// tablePayload 模拟牌桌状态的游戏消息，压缩率接近真实数据
+func tablePayload(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, `{"seat":%d,"uid":"%08d","score":%d,"tiles":[%d,%d,%d,%d],"ready":true},`,
+			i%4, 100000+i*37, i*113%997, i%34, (i+5)%34, (i+11)%34, (i+17)%34)
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func TestWebsocketCompression(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	cfg := &proxy.Config{ServerID: "deflate-server", Compression: true, CompressionThreshold: 256}
+	srv := proxy.New(cfg, proxy.WithRedis(proxytest.NewRedis()))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	var read int64
+	c, err := proxytest.DialWith(newCountingDialer(&read), ts.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(body []byte) int64 {
+		before := atomic.LoadInt64(&read)
+		err := gc.Send(9, body, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gmsg, err := c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(gmsg.GetData(), body) {
+			t.Fatalf("unexpected data, len:%d", len(gmsg.GetData()))
+		}
+
+		return atomic.LoadInt64(&read) - before
+	}
+
+	// 大消息被压缩，小于阈值的消息原样发送
+	large := tablePayload(4096)
+	if n := receive(large); n > int64(len(large))/2 {
+		t.Fatalf("large message not compressed, %d bytes on wire", n)
+	}
+
+	small := bytes.Repeat([]byte("a"), 128)
+	if n := receive(small); n < int64(len(small)) {
+		t.Fatalf("small message should not be compressed, %d bytes on wire", n)
+	}
+}
+
+// BenchmarkWebsocketCompression 不同压缩级别下每条消息的流量(wire-B/op)以及耗时
+func BenchmarkWebsocketCompression(b *testing.B) {
+	payload := tablePayload(2048)
+	levels := []struct {
+		name    string
+		enabled bool
+		level   int
+	}{
+		{"off", false, 0},
+		{"level1", true, 1},
+		{"level6", true, 6},
+		{"level9", true, 9},
+	}
+
+	for _, lv := range levels {
+		b.Run(lv.name, func(b *testing.B) {
+			gs, err := proxytest.NewGameServer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer gs.Close()
+
+			cfg := &proxy.Config{ServerID: "bench-server", Compression: lv.enabled, CompressionLevel: lv.level}
+			srv := proxy.New(cfg, proxy.WithRedis(proxytest.NewRedis()))
+			ts := httptest.NewServer(srv.Handler())
+			defer ts.Close()
+
+			var read int64
+			c, err := proxytest.DialWith(newCountingDialer(&read), ts.URL, "target="+gs.Addr())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			gc, err := gs.Accept(testTimeout)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			atomic.StoreInt64(&read, 0)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = gc.Send(9, payload, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				_, err = c.ReadProxyMessage(testTimeout)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(atomic.LoadInt64(&read))/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func TestWebsocketMessageLimits(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	cfg := &proxy.Config{
+		ServerID: "limit-server",
+		WS:       proxy.WSLimits{ReadLimit: 1024},
+		WSRoutes: map[string]proxy.WSLimits{"play": {ReadLimit: 4096}},
+		// 默认256字节（http.Server另外有4KB余量）
+		MaxHeaderBytes: 1 << 14,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(rds))
+	serverURL := "http://" + srv.Addr().String()
+
+	// wtype的配置覆盖全局配置，超过1KB但是不超过4KB的消息正常转发
+	c, err := proxytest.Dial(serverURL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("x"), 2048)
+	err = c.SendGame(3, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil || !bytes.Equal(gmsg.GetData(), body) {
+		t.Fatalf("expected 2KB message to be echoed, err:%v", err)
+	}
+
+	// 超过限制时以1009关闭
+	err = c.SendGame(3, bytes.Repeat([]byte("x"), 8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ReadProxyMessage(testTimeout)
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseMessageTooBig || ce.Text != "message too big" {
+		t.Fatalf("expected 1009 close, got %v", err)
+	}
+
+	resp, err := http.Get(serverURL + "/game/x/support/metrics?account=admin&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(metrics), "xhproxy_ws_oversize_rejected_total 1\n") {
+		t.Fatalf("unexpected metrics:%s", metrics)
+	}
+
+	// 调大请求头限制后可以容纳较大的cookie
+	req, _ := http.NewRequest("GET", serverURL+"/game/x/version", nil)
+	req.Header.Set("Cookie", "session="+strings.Repeat("c", 8192))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("request with large cookie rejected: %d", resp.StatusCode)
+	}
+}
+
+func TestJSONMode(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+	wsURL := strings.Replace(ts.URL, "http://", "ws://", 1) + "/game/x/ws/play?target=" + gs.Addr()
+
+	dialers := map[string]func() (*websocket.Conn, error){
+		"subprotocol": func() (*websocket.Conn, error) {
+			d := &websocket.Dialer{Subprotocols: []string{"xhproxy.json"}}
+			ws, _, err := d.Dial(wsURL, nil)
+			if err == nil && ws.Subprotocol() != "xhproxy.json" {
+				t.Fatalf("subprotocol not negotiated:%q", ws.Subprotocol())
+			}
+			return ws, err
+		},
+		"query": func() (*websocket.Conn, error) {
+			ws, _, err := websocket.DefaultDialer.Dial(wsURL+"&mode=json", nil)
+			return ws, err
+		},
+	}
+
+	for name, dial := range dialers {
+		t.Run(name, func(t *testing.T) {
+			ws, err := dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			roundTrip := func(req string) map[string]interface{} {
+				err := ws.WriteMessage(websocket.TextMessage, []byte(req))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ws.SetReadDeadline(time.Now().Add(testTimeout))
+				mt, reply, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if mt != websocket.TextMessage {
+					t.Fatalf("expected text reply, got type %d", mt)
+				}
+
+				var m map[string]interface{}
+				err = json.Unmarshal(reply, &m)
+				if err != nil {
+					t.Fatalf("invalid json reply %q:%v", reply, err)
+				}
+				return m
+			}
+
+			// 游戏消息经过游戏服务器回显
+			m := roundTrip(`{"ops":768,"data":"aGVsbG8="}`)
+			if m["ops"] != float64(768) || m["data"] != "aGVsbG8=" {
+				t.Fatalf("unexpected echo:%v", m)
+			}
+
+			// 代理自身的消息
+			m = roundTrip(fmt.Sprintf(`{"ops":%d,"data":"cGluZw=="}`, proxy.MessageCode_OPPing))
+			if m["ops"] != float64(proxy.MessageCode_OPPong) || m["data"] != "cGluZw==" {
+				t.Fatalf("unexpected pong:%v", m)
+			}
+		})
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	cfg := &proxy.Config{
+		ServerID:     "protocol-server",
+		PingIdle:     200 * time.Millisecond,
+		PingInterval: 200 * time.Millisecond,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()))
+	wsURL := "ws://" + srv.Addr().String() + "/game/x/ws/play?target=" + gs.Addr()
+
+	resp, err := http.Get("http://" + srv.Addr().String() + "/game/x/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if h := resp.Header.Get("X-Proxy-Protocols"); h != "xhproxy.v2, xhproxy.v1, xhproxy.json" {
+		t.Fatalf("unexpected protocols header:%q", h)
+	}
+
+	// 客户端同时支持时选择v2
+	d := &websocket.Dialer{Subprotocols: []string{"xhproxy.v1", "xhproxy.v2"}}
+	ws, _, err := d.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if ws.Subprotocol() != "xhproxy.v2" {
+		t.Fatalf("expected xhproxy.v2, got %q", ws.Subprotocol())
+	}
+
+	// v2帧为4字节大端ops加上数据
+	frame := append([]byte{0, 0, 3, 0}, "hello"...)
+	err = ws.WriteMessage(websocket.BinaryMessage, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	_, reply, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, frame) {
+		t.Fatalf("unexpected v2 echo:%v", reply)
+	}
+
+	// v2没有web=1也使用OPPing保活
+	_, reply, err = ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 12 || binary.BigEndian.Uint32(reply) != uint32(proxy.MessageCode_OPPing) {
+		t.Fatalf("expected in-band ping, got %v", reply)
+	}
+
+	// 只支持v1的客户端仍然使用protobuf
+	d = &websocket.Dialer{Subprotocols: []string{"xhproxy.v1"}}
+	c, err := proxytest.DialWith(d, "ws://"+srv.Addr().String(), "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Subprotocol() != "xhproxy.v1" {
+		t.Fatalf("expected xhproxy.v1, got %q", c.Subprotocol())
+	}
+
+	err = c.SendGame(3, []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil || gmsg.GetOps() != 3<<8 || string(gmsg.GetData()) != "v1" {
+		t.Fatalf("unexpected v1 echo:%v %v", gmsg, err)
+	}
+}
+
+func TestHTTPFallbackTransport(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	cfg := &proxy.Config{
+		ServerID:     "fallback-server",
+		PingIdle:     200 * time.Millisecond,
+		PingInterval: 200 * time.Millisecond,
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(rds))
+
+	// 模拟拦截了Upgrade的网络
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Upgrade")
+		r.Header.Del("Connection")
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer blocked.Close()
+
+	gc, err := proxytest.DialAuto(blocked.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := gc.(*proxytest.HTTPClient); !ok {
+		t.Fatalf("expected http fallback client, got %T", gc)
+	}
+
+	err = gc.SendGame(3, []byte("over http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := gc.ReadProxyMessage(testTimeout)
+	if err != nil || gmsg.GetOps() != 3<<8 || string(gmsg.GetData()) != "over http" {
+		t.Fatalf("unexpected echo:%v %v", gmsg, err)
+	}
+
+	// 保活使用OPPing，回复OPPong后会话保持
+	gmsg, err = gc.ReadProxyMessage(testTimeout)
+	if err != nil || gmsg.GetOps() != int32(proxy.MessageCode_OPPing) {
+		t.Fatalf("expected in-band ping:%v %v", gmsg, err)
+	}
+	gc.SendProxyMessage(int32(proxy.MessageCode_OPPong), gmsg.GetData())
+
+	// 与websocket会话在同一个会话列表中
+	resp, err := http.Get(blocked.URL + "/game/x/support/sessions?account=admin&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"protocol":"xhproxy.http"`) {
+		t.Fatalf("http session not listed:%s", body)
+	}
+
+	// 游戏服务器断开时客户端收到关闭事件
+	conn, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	for {
+		_, err = gc.ReadProxyMessage(testTimeout)
+		if err != nil {
+			break
+		}
+	}
+	if _, ok := err.(*websocket.CloseError); !ok {
+		t.Fatalf("expected close event, got %v", err)
+	}
+
+	// Upgrade在到达代理之前就被拦截，没有X-Proxy-Fallback头，客户端自行回退
+	rejected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		srv.Handler().ServeHTTP(w, r)
+	}))
+	defer rejected.Close()
+
+	gc, err = proxytest.DialAuto(rejected.URL, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc.Close()
+
+	if _, ok := gc.(*proxytest.HTTPClient); !ok {
+		t.Fatalf("expected http fallback client, got %T", gc)
+	}
+}
+
+func TestShutdownWithHTTPStreams(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	srv := startTestServer(t, &proxy.Config{ServerID: "shutdown-server"}, proxy.WithRedis(proxytest.NewRedis()))
+	serverURL := "http://" + srv.Addr().String()
+	base := serverURL + "/game/x/http/play"
+
+	sse, err := proxytest.DialHTTP(serverURL, "/game/x/http/play", "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sse.Close()
+
+	resp, err := http.Post(base+"/open?target="+gs.Addr(), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened struct {
+		SID string `json:"sid"`
+	}
+	json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+
+	// 没有消息的长轮询请求等待中
+	polled := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/events?sid=" + opened.SID)
+		if err != nil {
+			polled <- 0
+			return
+		}
+		resp.Body.Close()
+		polled <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// SSE以及长轮询请求不会让Shutdown一直等到超时
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = srv.Shutdown(ctx)
+	if err != nil || time.Since(start) > time.Second {
+		t.Fatalf("shutdown took %v, err:%v", time.Since(start), err)
+	}
+
+	if _, err = sse.ReadProxyMessage(testTimeout); err == nil {
+		t.Fatal("expected sse stream to end")
+	}
+
+	select {
+	case code := <-polled:
+		if code != http.StatusGone && code != http.StatusOK {
+			t.Fatalf("unexpected long poll status:%d", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("long poll not returned")
+	}
+}
+
+func TestHTTPFallbackLongPoll(t *testing.T) {
+	ts, gs, _ := newTestProxy(t)
+	base := ts.URL + "/game/x/http/play"
+
+	resp, err := http.Post(base+"/open?target="+gs.Addr(), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened struct {
+		SID string `json:"sid"`
+	}
+	json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || opened.SID == "" {
+		t.Fatalf("open failed: %d", resp.StatusCode)
+	}
+
+	// 一次上行多个消息
+	resp, err = http.Post(base+"/send?sid="+opened.SID, "application/json",
+		strings.NewReader(`[{"ops":768,"data":"YQ=="},{"ops":768,"data":"Yg=="}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("send failed: %d", resp.StatusCode)
+	}
+
+	var got []string
+	for len(got) < 2 {
+		resp, err = http.Get(base + "/events?sid=" + opened.SID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msgs []map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&msgs)
+		resp.Body.Close()
+		for _, m := range msgs {
+			got = append(got, m["data"].(string))
+		}
+	}
+
+	if got[0] != "YQ==" || got[1] != "Yg==" {
+		t.Fatalf("unexpected messages:%v", got)
+	}
+
+	// 同一会话新的events请求替换正在等待的旧请求，旧请求回复409，消息只发给新的请求
+	polled := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/events?sid=" + opened.SID)
+		if err != nil {
+			polled <- 0
+			return
+		}
+		resp.Body.Close()
+		polled <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", base+"/events?sid="+opened.SID, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	select {
+	case code := <-polled:
+		if code != http.StatusConflict {
+			t.Fatalf("expected replaced poll to get 409, got %d", code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("replaced poll not returned")
+	}
+
+	resp, err = http.Post(base+"/send?sid="+opened.SID, "application/json",
+		strings.NewReader(`{"ops":768,"data":"Yw=="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	found := false
+	scanner := bufio.NewScanner(stream.Body)
+	for !found && scanner.Scan() {
+		found = strings.Contains(scanner.Text(), `"data":"Yw=="`)
+	}
+	if !found {
+		t.Fatalf("message not delivered to the newer events request: %v", scanner.Err())
+	}
+
+	// 客户端结束会话后会话ID失效
+	resp, err = http.Post(base+"/close?sid="+opened.SID, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for {
+		resp, err = http.Get(base + "/events?sid=" + opened.SID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			break
+		}
+	}
+}
+
+func TestTCPClient(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	cfg := &proxy.Config{
+		ServerID:      "tcp-server",
+		ClientTCPAddr: "127.0.0.1:0",
+		PingIdle:      200 * time.Millisecond,
+		PingInterval:  200 * time.Millisecond,
+		WSRoutes:      map[string]proxy.WSLimits{"tcp": {ReadLimit: 512}},
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()))
+
+	var c proxytest.GameClient
+	c, err = proxytest.DialTCP(srv.TCPAddr().String(), "target="+gs.Addr()+"&uid=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	body := []byte("hello over tcp")
+	err = c.SendGame(3, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gmsg.GetOps() != 3<<8 || !bytes.Equal(gmsg.GetData(), body) {
+		t.Fatalf("unexpected echo:%v", gmsg)
+	}
+
+	// tcp客户端使用OPPing保活
+	gmsg, err = c.ReadProxyMessage(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gmsg.GetOps() != int32(proxy.MessageCode_OPPing) {
+		t.Fatalf("expected ping, got %v", gmsg)
+	}
+
+	// 超过tcp路由的大小限制时以OPClose告知1009后断开
+	err = c.SendGame(3, make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			break
+		}
+	}
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseMessageTooBig || ce.Text != "message too big" {
+		t.Fatalf("expected 1009 close, got %v", err)
+	}
+}
+
+func TestUDPClientLoss(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := proxytest.NewLossyConn(pc, 0.2)
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	cfg := &proxy.Config{
+		ServerID: "udp-server",
+		WSRoutes: map[string]proxy.WSLimits{"udp": {ReadLimit: 16 << 10}},
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(rds), proxy.WithUDPConn(serverConn))
+
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn := proxytest.NewLossyConn(cpc, 0.2)
+
+	c, err := proxytest.DialUDP(clientConn, srv.UDPAddr().String(), "target="+gs.Addr()+"&uid=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 两个方向都丢包时按顺序收到所有消息，大于一段的消息分段后重组
+	const count = 50
+	for i := 0; i < count; i++ {
+		err = c.SendGame(3, bytes.Repeat([]byte{byte(i)}, 100+i*60))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		gmsg, err := c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gmsg.GetData(), bytes.Repeat([]byte{byte(i)}, 100+i*60)) {
+			t.Fatalf("message %d out of order or corrupted", i)
+		}
+	}
+
+	if serverConn.Dropped() == 0 || clientConn.Dropped() == 0 || c.Stats().Retransmits == 0 {
+		t.Fatalf("expected simulated loss, dropped %d/%d", serverConn.Dropped(), clientConn.Dropped())
+	}
+
+	// 会话列表中带有丢包以及时延统计
+	resp, err := http.Get("http://" + srv.Addr().String() + "/game/test/support/sessions?account=admin&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []struct {
+		Protocol string           `json:"protocol"`
+		UDP      *proxy.RUDPStats `json:"udp"`
+	}
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 1 || sessions[0].Protocol != "xhproxy.udp" || sessions[0].UDP == nil ||
+		sessions[0].UDP.Sent < count || sessions[0].UDP.Retransmits == 0 || sessions[0].UDP.Loss <= 0 {
+		t.Fatalf("unexpected sessions:%+v", sessions)
+	}
+
+	// 换了端口之后会话继续
+	npc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Rebind(npc)
+
+	err = c.SendGame(3, []byte("after rebind"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gmsg, err := c.ReadProxyMessage(testTimeout)
+	if err != nil || string(gmsg.GetData()) != "after rebind" {
+		t.Fatalf("unexpected echo after rebind:%v %v", gmsg, err)
+	}
+
+	// 游戏服务器断开时客户端收到关闭原因（FIN不重传，这里不再丢包）
+	serverConn.SetLoss(0)
+	conn, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = c.ReadProxyMessage(testTimeout)
+	if _, ok := err.(*websocket.CloseError); !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+}
+
+// rudpPacket 按代理的可靠udp格式编码一个包：conv(4) cmd(1) frg(1) sn(4) una(4)
+func rudpPacket(conv uint32, cmd, frg byte, sn uint32, data []byte) []byte {
+	buf := make([]byte, 14, 14+len(data))
+	binary.BigEndian.PutUint32(buf, conv)
+	buf[4] = cmd
+	buf[5] = frg
+	binary.BigEndian.PutUint32(buf[6:], sn)
+
+	return append(buf, data...)
+}
+
+// readRUDPCmd 读取下一个指定cmd的包，超时返回nil
+func readRUDPCmd(pc net.PacketConn, cmd byte, timeout time.Duration) []byte {
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		if n >= 14 && buf[4] == cmd {
+			return append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+func TestUDPClientReject(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	upc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &proxy.Config{
+		ServerID: "udp-reject",
+		WSRoutes: map[string]proxy.WSLimits{"udp": {ReadLimit: 4096}},
+	}
+	srv := startTestServer(t, cfg, proxy.WithRedis(proxytest.NewRedis()), proxy.WithUDPConn(upc))
+	addr := srv.UDPAddr()
+
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	open := func(pc net.PacketConn, conv uint32) {
+		pc.WriteTo(rudpPacket(conv, 1, 0, 0, []byte("target="+gs.Addr()+"&uid=1")), addr)
+		if readRUDPCmd(pc, 2, testTimeout) == nil {
+			t.Fatal("udp session not accepted")
+		}
+	}
+	expectFin := func(pc net.PacketConn, code int) {
+		t.Helper()
+		fin := readRUDPCmd(pc, 5, testTimeout)
+		if len(fin) < 16 || int(binary.BigEndian.Uint16(fin[14:])) != code {
+			t.Fatalf("expected fin %d, got %x", code, fin)
+		}
+	}
+
+	// 不存在的会话：确认包不回复，数据包回复FIN但限制速率
+	attacker := listen()
+	attacker.WriteTo(rudpPacket(99, 4, 0, 0, nil), addr)
+	if readRUDPCmd(attacker, 5, 200*time.Millisecond) != nil {
+		t.Fatal("unexpected fin for ack of unknown session")
+	}
+	for i := 0; i < 100; i++ {
+		attacker.WriteTo(rudpPacket(99, 3, 0, uint32(i), []byte("x")), addr)
+	}
+	fins := 0
+	for readRUDPCmd(attacker, 5, 200*time.Millisecond) != nil {
+		fins++
+	}
+	if fins == 0 || fins > 40 {
+		t.Fatalf("expected rate limited fins, got %d", fins)
+	}
+
+	// 消息共11段，累计超过4096字节时就结束会话，不等收齐；
+	// 其他地址重放的旧包以及伪造的FIN不能迁移或者结束会话
+	client := listen()
+	open(client, 7)
+	seg := bytes.Repeat([]byte{1}, 1200)
+	client.WriteTo(rudpPacket(7, 3, 10, 0, seg), addr)
+	if readRUDPCmd(client, 4, testTimeout) == nil {
+		t.Fatal("segment not acked")
+	}
+
+	attacker.WriteTo(rudpPacket(7, 3, 10, 0, seg), addr)
+	attacker.WriteTo(rudpPacket(7, 5, 0, 0, nil), addr)
+	if readRUDPCmd(attacker, 4, 200*time.Millisecond) != nil {
+		t.Fatal("replayed packet migrated the session")
+	}
+	if readRUDPCmd(client, 4, testTimeout) == nil {
+		t.Fatal("duplicate segment not acked to the client")
+	}
+
+	for sn := uint32(1); sn < 4; sn++ {
+		client.WriteTo(rudpPacket(7, 3, byte(10-sn), sn, seg), addr)
+	}
+	expectFin(client, websocket.CloseMessageTooBig)
+
+	// frg没有逐段递减
+	client = listen()
+	open(client, 9)
+	client.WriteTo(rudpPacket(9, 3, 5, 0, []byte("a")), addr)
+	client.WriteTo(rudpPacket(9, 3, 5, 1, []byte("b")), addr)
+	expectFin(client, websocket.CloseProtocolError)
+
+	// 客户端发来FIN时代理也回复FIN
+	client = listen()
+	open(client, 11)
+	client.WriteTo(rudpPacket(11, 5, 0, 0, nil), addr)
+	expectFin(client, websocket.CloseNormalClosure)
+}
+
+func TestNoticePush(t *testing.T) {
+	gs1, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs1.Close()
+
+	gs2, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs2.Close()
+
+	// 两个实例共用一个redis
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	a := startTestServer(t, &proxy.Config{ServerID: "notice-a"}, proxy.WithRedis(rds))
+	b := startTestServer(t, &proxy.Config{ServerID: "notice-b"}, proxy.WithRedis(rds))
+
+	// 等待两个实例订阅各自的频道
+	for deadline := time.Now().Add(testTimeout); ; {
+		reply, _ := rds.Get().Do("PUBSUB", "NUMSUB", "proxynotice:notice-a", "proxynotice:notice-b")
+		if r, ok := reply.([]interface{}); ok && len(r) == 4 && r[1] == int64(1) && r[3] == int64(1) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("notice subscriptions not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 订阅之后同一个ServerID的实例不能再启动
+	err = proxy.New(&proxy.Config{ServerID: "notice-a"}, proxy.WithRedis(rds)).Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "same UUID") {
+		t.Fatalf("expected duplicate server ID rejected, got %v", err)
+	}
+
+	c1, err := proxytest.Dial("http://"+a.Addr().String(), "target="+gs1.Addr()+"&uid=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	c2, err := proxytest.Dial("http://"+b.Addr().String(), "target="+gs2.Addr()+"&uid=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	c3, err := proxytest.Dial("http://"+b.Addr().String(), "target="+gs1.Addr()+"&uid=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+
+	// 等待会话建立
+	for _, c := range []*proxytest.Client{c1, c2, c3} {
+		c.SendGame(3, []byte("ready"))
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push := func(query string, instances int) {
+		t.Helper()
+
+		resp, err := http.Get("http://" + a.Addr().String() + "/game/test/support/notice?account=admin&password=secret&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			Instances int `json:"instances"`
+			Receivers int `json:"receivers"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if resp.StatusCode != http.StatusOK || result.Instances != instances || result.Receivers != instances {
+			t.Fatalf("unexpected notice result: %d %+v", resp.StatusCode, result)
+		}
+	}
+
+	expect := func(c *proxytest.Client, message string) {
+		t.Helper()
+
+		gmsg, err := c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gmsg.GetOps() != int32(proxy.MessageCode_OPNotice) || string(gmsg.GetData()) != message {
+			t.Fatalf("expected notice %q, got %v", message, gmsg)
+		}
+	}
+
+	push("message=maintenance", 2)
+	expect(c1, "maintenance")
+	expect(c2, "maintenance")
+	expect(c3, "maintenance")
+
+	// 按游戏服务器以及用户过滤，其余会话收不到
+	push("message=by-target&target="+gs2.Addr(), 2)
+	push("message=by-uid&uid=3", 2)
+	push("message=bye", 2)
+
+	expect(c1, "bye")
+	expect(c2, "by-target")
+	expect(c2, "bye")
+	expect(c3, "by-uid")
+	expect(c3, "bye")
+}
+
+func TestNoticeSlowClient(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	srv := startTestServer(t, &proxy.Config{ServerID: "notice-slow"}, proxy.WithRedis(rds))
+	url := "http://" + srv.Addr().String()
+
+	for deadline := time.Now().Add(testTimeout); ; {
+		reply, _ := rds.Get().Do("PUBSUB", "NUMSUB", "proxynotice:notice-slow")
+		if r, ok := reply.([]interface{}); ok && len(r) == 2 && r[1] == int64(1) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("notice subscription not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slow, err := proxytest.Dial(url, "target="+gs.Addr()+"&uid=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	c, err := proxytest.Dial(url, "target="+gs.Addr()+"&uid=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, cc := range []*proxytest.Client{slow, c} {
+		cc.SendGame(3, []byte("ready"))
+		_, err = cc.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish := func(n map[string]string) {
+		buf, _ := json.Marshal(n)
+		_, err := rds.Get().Do("PUBLISH", "proxynotice:notice-slow", buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// slow不读，几个大通知填满socket缓冲区后写阻塞，不能耽误其他会话的通知
+	big := strings.Repeat("x", 1<<20)
+	for i := 0; i < 8; i++ {
+		publish(map[string]string{"message": big, "uid": "1"})
+	}
+	publish(map[string]string{"message": "hello", "uid": "2"})
+
+	gmsg, err := c.ReadProxyMessage(time.Second)
+	if err != nil || gmsg.GetOps() != int32(proxy.MessageCode_OPNotice) || string(gmsg.GetData()) != "hello" {
+		t.Fatalf("expected notice not blocked by slow client, got %v %v", gmsg, err)
+	}
+}
+
+// readCapture 读取抓包文件中的所有记录
+func readCapture(t *testing.T, filename string) []*proxy.CaptureRecord {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*proxy.CaptureRecord
+	cr := proxy.NewCaptureReader(f)
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRecorderFilters(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	dir := t.TempDir()
+	srv := startTestServer(t, &proxy.Config{ServerID: "recorder", CaptureDir: dir}, proxy.WithRedis(rds))
+	base := "http://" + srv.Addr().String()
+
+	admin := func(query string) {
+		t.Helper()
+
+		resp, err := http.Get(base + "/game/test/support/recorder?account=admin&password=secret&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("recorder admin failed:%d", resp.StatusCode)
+		}
+	}
+
+	echo := func(query string, body string) {
+		t.Helper()
+
+		c, err := proxytest.Dial(base, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.SendGame(3, []byte(body))
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只录制开启的用户；关闭之后不再录制
+	admin("uid=u1")
+	echo("uid=u1&target="+gs.Addr(), "u1")
+	echo("uid=u2&target="+gs.Addr(), "u2")
+	admin("uid=u1&enable=0")
+	echo("uid=u1&target="+gs.Addr(), "u1 off")
+
+	// 按目标服务器录制
+	admin("target=" + gs.Addr())
+	echo("uid=u3&target="+gs.Addr(), "u3")
+	admin("target=" + gs.Addr() + "&enable=0")
+
+	// 采样率为1时录制所有新会话
+	admin("rate=1")
+	echo("uid=u4&target="+gs.Addr(), "u4")
+
+	// 关闭服务器时关闭抓包文件
+	srv.Shutdown(context.Background())
+
+	var got []string
+	runs := map[string]bool{}
+	keys := map[string]bool{}
+	for _, rec := range readCapture(t, filepath.Join(dir, "capture-recorder.jsonl")) {
+		if rec.Dir == "up" {
+			got = append(got, string(rec.Data))
+		}
+		runs[rec.Run] = true
+		keys[rec.SessionKey()] = true
+	}
+
+	if strings.Join(got, ",") != "u1,u3,u4" {
+		t.Fatalf("unexpected recorded sessions:%v", got)
+	}
+	if len(runs) != 1 || runs[""] || len(keys) != 3 {
+		t.Fatalf("unexpected session keys:%v", keys)
+	}
+
+	// 重启之后追加到同一个文件，会话标识不重复
+	time.Sleep(2 * time.Millisecond)
+	srv = startTestServer(t, &proxy.Config{ServerID: "recorder", CaptureDir: dir}, proxy.WithRedis(rds))
+	base = "http://" + srv.Addr().String()
+	admin("rate=1")
+	echo("uid=u1&target="+gs.Addr(), "again")
+	srv.Shutdown(context.Background())
+
+	for _, rec := range readCapture(t, filepath.Join(dir, "capture-recorder.jsonl")) {
+		if string(rec.Data) == "again" && keys[rec.SessionKey()] {
+			t.Fatalf("session key reused across restarts:%s", rec.SessionKey())
+		}
+	}
+}
+
+func TestRecorderRotation(t *testing.T) {
+	gs, err := proxytest.NewGameServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close()
+
+	rds := proxytest.NewRedis()
+	rds.HSet("xhproxy1", "admin", "secret")
+	dir := t.TempDir()
+	cfg := &proxy.Config{ServerID: "rotate", CaptureDir: dir, CaptureMaxSize: 1, CaptureMaxFiles: 1}
+	srv := startTestServer(t, cfg, proxy.WithRedis(rds))
+	base := "http://" + srv.Addr().String()
+
+	resp, err := http.Get(base + "/game/test/support/recorder?account=admin&password=secret&rate=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	c, err := proxytest.Dial(base, "target="+gs.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	gc, err := gs.Accept(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每条记录约410KB，每个文件最多两条，只保留一个旧文件
+	for i := 0; i < 5; i++ {
+		gc.Send(7, bytes.Repeat([]byte{byte('a' + i)}, 300<<10), false)
+		_, err = c.ReadProxyMessage(testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Shutdown(context.Background())
+
+	current := readCapture(t, filepath.Join(dir, "capture-rotate.jsonl"))
+	backup := readCapture(t, filepath.Join(dir, "capture-rotate.jsonl.1"))
+	if len(current) != 1 || len(backup) != 2 || current[0].Data[0] != 'e' || backup[0].Data[0] != 'c' {
+		t.Fatalf("unexpected rotation, current:%d backup:%d", len(current), len(backup))
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "capture-rotate.jsonl.2"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected only one backup, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// sessionInfo 会话列表中的一项，时延单位为毫秒
+type sessionInfo struct {
+	ID        uint64    `json:"id"`
+	UserID    string    `json:"uid"`
+	Peer      string    `json:"peer"`
+	Target    string    `json:"target"`
+	IsFromWeb bool      `json:"web"`
+	Protocol  string    `json:"protocol"`
+	CreatedAt time.Time `json:"created"`
+
+	RTTLast    int64 `json:"rttLast"`
+	RTTMin     int64 `json:"rttMin"`
+	RTTMax     int64 `json:"rttMax"`
+	RTTAvg     int64 `json:"rttAvg"`
+	RTTSamples int   `json:"rttSamples"`
+
+	// UDP 可靠udp客户端的丢包以及时延统计
+	UDP *RUDPStats `json:"udp,omitempty"`
+}
+
+// sessionsHandle 当前所有会话以及其往返时延
+func (s *Server) sessionsHandle(w http.ResponseWriter, r *http.Request) {
+	holders := s.holders()
+	infos := make([]sessionInfo, 0, len(holders))
+	for _, ph := range holders {
+		sess := ph.session
+		rtt := sess.RTT()
+		info := sessionInfo{
+			ID:         sess.ID,
+			UserID:     sess.UserID(),
+			Peer:       sess.Peer,
+			Target:     sess.Target,
+			IsFromWeb:  sess.IsFromWeb,
+			Protocol:   sess.Protocol,
+			CreatedAt:  sess.CreatedAt,
+			RTTLast:    int64(rtt.Last / time.Millisecond),
+			RTTMin:     int64(rtt.Min / time.Millisecond),
+			RTTMax:     int64(rtt.Max / time.Millisecond),
+			RTTAvg:     int64(rtt.Avg / time.Millisecond),
+			RTTSamples: rtt.Samples,
+		}
+		if uc, ok := ph.ws.(*udpClientConn); ok {
+			st := uc.Stats()
+			info.UDP = &st
+		}
+		infos = append(infos, info)
+	}
+
+	buf, _ := json.Marshal(infos)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// metricsHandle 以prometheus文本格式输出统计
+func (s *Server) metricsHandle(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# HELP xhproxy_sessions Current websocket sessions.\n")
+	fmt.Fprintf(&buf, "# TYPE xhproxy_sessions gauge\n")
+	fmt.Fprintf(&buf, "xhproxy_sessions %d\n", len(s.holders()))
+
+	h := s.rttHistogram
+	fmt.Fprintf(&buf, "# HELP xhproxy_rtt_milliseconds Round-trip time between proxy and clients.\n")
+	fmt.Fprintf(&buf, "# TYPE xhproxy_rtt_milliseconds histogram\n")
+
+	var cumulative uint64
+	for i, le := range rttBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(&buf, "xhproxy_rtt_milliseconds_bucket{le=\"%d\"} %d\n", le, cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(rttBuckets)])
+	fmt.Fprintf(&buf, "xhproxy_rtt_milliseconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(&buf, "xhproxy_rtt_milliseconds_sum %d\n", atomic.LoadInt64(&h.sum))
+	fmt.Fprintf(&buf, "xhproxy_rtt_milliseconds_count %d\n", cumulative)
+
+	fmt.Fprintf(&buf, "# HELP xhproxy_ws_oversize_rejected_total Websocket sessions closed for oversize messages.\n")
+	fmt.Fprintf(&buf, "# TYPE xhproxy_ws_oversize_rejected_total counter\n")
+	fmt.Fprintf(&buf, "xhproxy_ws_oversize_rejected_total %d\n", atomic.LoadUint64(&s.wsOversizeRejected))
+
+	infos := s.breakers.infos()
+	fmt.Fprintf(&buf, "# HELP xhproxy_breaker_state Circuit breaker state per upstream (0 closed, 1 open, 2 half-open).\n")
+	fmt.Fprintf(&buf, "# TYPE xhproxy_breaker_state gauge\n")
+	for _, bi := range infos {
+		fmt.Fprintf(&buf, "xhproxy_breaker_state{upstream=%q} %d\n", bi.Upstream, bi.state)
+	}
+
+	fmt.Fprintf(&buf, "# HELP xhproxy_breaker_rejected_total Requests rejected by open circuit breakers.\n")
+	fmt.Fprintf(&buf, "# TYPE xhproxy_breaker_rejected_total counter\n")
+	for _, bi := range infos {
+		fmt.Fprintf(&buf, "xhproxy_breaker_rejected_total{upstream=%q} %d\n", bi.Upstream, bi.Rejected)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) registerStatsHandlers() {
+	s.monkeySupportHandlers["/sessions"] = s.sessionsHandle
+	s.monkeySupportHandlers["/metrics"] = s.metricsHandle
+	s.monkeySupportHandlers["/breakers"] = s.breakersHandle
+}
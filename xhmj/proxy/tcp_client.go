@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// 原生客户端以及机器人可以不用websocket，直接通过tcp连接代理：
+// 每帧为4字节大端长度加上内容；第一帧为握手，内容与websocket接入的查询参数相同，
+// 例如"target=1.2.3.4:5000&uid=xx"，之后每帧为protobuf编码的ProxyMessage，
+// 保活使用OPPing/OPPong；代理结束会话时最后一帧为OPClose，带有关闭码以及原因
+
+const (
+	protocolTCP = "xhproxy.tcp"
+
+	// tcpClientWType tcp客户端的消息大小限制使用Config.WSRoutes中该wtype的配置
+	tcpClientWType = "tcp"
+
+	tcpHandshakeTimeout = 10 * time.Second
+	tcpHandshakeMaxSize = 4096
+
+	// 会话结束时先关闭写方向，读取的goroutine退出后在tcpLingerTimeout内丢弃客户端还在发送的数据，
+	// 避免有未读数据时直接关闭产生reset，使客户端收不到OPClose
+	tcpLingerTimeout  = 500 * time.Millisecond
+	tcpLingerMaxBytes = 64 << 10
+)
+
+var (
+	errFrameTooBig = errors.New("frame too big")
+
+	// tcpProtocol tcp客户端的协议
+	tcpProtocol = &wireProtocol{name: protocolTCP, version: 1, codec: protobufCodec{}, inBandPing: true}
+)
+
+// tcpClientConn tcp客户端的连接，实现clientConn
+type tcpClientConn struct {
+	conn net.Conn
+
+	closeSent int32
+	closeOnce sync.Once
+}
+
+// WriteMessage 只发送二进制消息，加上长度前缀
+func (c *tcpClientConn) WriteMessage(mt int, data []byte) error {
+	if mt != websocket.BinaryMessage {
+		return nil
+	}
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// WriteControl 关闭帧转换为OPClose消息，Data与websocket关闭帧的内容相同；其他控制帧忽略
+func (c *tcpClientConn) WriteControl(mt int, data []byte, deadline time.Time) error {
+	if mt != websocket.CloseMessage || !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return nil
+	}
+
+	_, buf, err := tcpProtocol.codec.encode(int32(MessageCode_OPClose), data)
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetWriteDeadline(deadline)
+	defer c.conn.SetWriteDeadline(time.Time{})
+
+	return c.WriteMessage(websocket.BinaryMessage, buf)
+}
+
+func (c *tcpClientConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *tcpClientConn) EnableWriteCompression(bool) {
+}
+
+// Close 会话结束时由closeOnDone调用：关闭写方向并使阻塞中的读取立即返回，连接由release关闭
+func (c *tcpClientConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		tc, ok := c.conn.(*net.TCPConn)
+		if !ok {
+			err = c.conn.Close()
+			return
+		}
+
+		tc.CloseWrite()
+		err = tc.SetReadDeadline(time.Now())
+	})
+
+	return err
+}
+
+// release 读取的goroutine已经退出，丢弃客户端还在发送的数据后关闭连接
+func (c *tcpClientConn) release() {
+	c.Close()
+
+	if tc, ok := c.conn.(*net.TCPConn); ok {
+		tc.SetReadDeadline(time.Now().Add(tcpLingerTimeout))
+		io.CopyN(ioutil.Discard, tc, tcpLingerMaxBytes)
+	}
+
+	c.conn.Close()
+}
+
+// readFrame 读取一帧，超过limit时返回errFrameTooBig
+func readFrame(r io.Reader, limit int64) ([]byte, error) {
+	var head [4]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	if int64(size) > limit {
+		return nil, errFrameTooBig
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// acceptTCPClients 接受tcp客户端，直到监听被关闭
+func (s *Server) acceptTCPClients() {
+	defer s.wg.Done()
+
+	log.Printf("Tcp client listen at:%s\n", s.tcpListener.Addr())
+
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Println("tcp client accept failed:", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveTCPClient(conn)
+	}
+}
+
+// serveTCPClient 读取握手后与websocket客户端一样建立会话
+func (s *Server) serveTCPClient(conn net.Conn) {
+	defer s.wg.Done()
+
+	cc := &tcpClientConn{conn: conn}
+	defer cc.release()
+
+	conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+	handshake, err := readFrame(conn, tcpHandshakeMaxSize)
+	if err != nil {
+		log.Println("tcp client handshake failed:", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	query, err := url.ParseQuery(string(handshake))
+	if err != nil {
+		log.Println("tcp client invalid handshake:", conn.RemoteAddr(), err)
+		return
+	}
+
+	holder := s.newGameUserHolder(cc, tcpProtocol, query, conn.RemoteAddr().String())
+	holder.readLimit = s.wsLimits(tcpClientWType).ReadLimit
+
+	holder.log.Println("tcp client accepted, uid:", query.Get("uid"))
+	s.serveSession(context.Background(), holder, nil, func() {
+		waitTCPClientMessage(holder, conn)
+	})
+}
+
+// waitTCPClientMessage 读取tcp客户端的消息，直到出错或者会话结束（closeOnDone使读取返回）
+func waitTCPClientMessage(holder *pairHolder, conn net.Conn) {
+	defer holder.close()
+
+	for {
+		frame, err := readFrame(conn, holder.readLimit)
+		if err == errFrameTooBig {
+			holder.rejectOversize()
+			return
+		}
+
+		if err != nil {
+			if !holder.closed() {
+				holder.log.Println("tcp client receive error:", err)
+			}
+			return
+		}
+
+		holder.touch()
+
+		if len(frame) > 0 {
+			holder.onWebsocketMessage(websocket.BinaryMessage, frame)
+		}
+	}
+}
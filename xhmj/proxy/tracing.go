@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "xhmj/proxy"
+	serviceName = "xhproxy"
+)
+
+// tracePropagator 在转发的http请求以及接入的websocket请求中使用W3C trace context
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// SetupTracing 把span通过OTLP/HTTP导出到endpoint（例如"otel-collector:4318"），
+// 设置为全局TracerProvider，返回的函数在退出前调用以导出剩余的span
+func SetupTracing(ctx context.Context, endpoint string, serverID string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceInstanceID(serverID))
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(tracePropagator)
+
+	return tp.Shutdown, nil
+}
+
+// startSpan 以服务器的tracer开始一个span
+func (s *Server) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, opts...)
+}
+
+// extractTrace 从http请求头中取出调用方的trace context
+func extractTrace(r *http.Request) context.Context {
+	return tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// injectTrace 把ctx中的trace context写入转发请求的请求头
+func injectTrace(ctx context.Context, header http.Header) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// endSpan 结束span，err不为nil时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// sessionAttributes 会话span的属性
+func sessionAttributes(sess *Session) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("session.id", int64(sess.ID)),
+		attribute.String("session.uid", sess.UserID()),
+		attribute.String("session.peer", sess.Peer),
+		attribute.String("session.target", sess.Target),
+		attribute.Bool("session.web", sess.IsFromWeb),
+	}
+}
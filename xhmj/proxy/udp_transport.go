@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// 可靠UDP的客户端接入：客户端随机选择conv后发送SYN，内容与websocket接入的查询参数相同，
+// 例如"target=1.2.3.4:5000&uid=xx"，收到ACCEPT之前按rudpSynInterval重发；
+// 之后每个消息为protobuf编码的ProxyMessage，保活使用OPPing/OPPong
+
+const (
+	protocolUDP = "xhproxy.udp"
+
+	// udpClientWType udp客户端的消息大小限制使用Config.WSRoutes中该wtype的配置
+	udpClientWType = "udp"
+
+	udpMaxPacket  = 2048
+	udpFinRepeat  = 3   // FIN不重传，多发几次
+	udpRejectRate = 20  // 每秒最多回复多少个会话不存在的FIN，避免被用来反射流量
+	udpSynRate    = 200 // 每秒最多新建多少个会话，来源地址可以伪造，避免大量连接游戏服务器；客户端会重发SYN
+)
+
+var (
+	// udpProtocol udp客户端的协议
+	udpProtocol = &wireProtocol{name: protocolUDP, version: 1, codec: protobufCodec{}, inBandPing: true}
+)
+
+// udpClientConn udp客户端的会话，实现clientConn
+type udpClientConn struct {
+	pc   net.PacketConn
+	conv *rudpConn
+
+	lock        sync.Mutex
+	addr        net.Addr
+	accepted    bool
+	closeCode   int
+	closeReason string
+
+	closeOnce  sync.Once // 发送FIN
+	closedOnce sync.Once // 关闭closed
+	closed     chan struct{}
+}
+
+func newUDPClientConn(pc net.PacketConn, conv uint32, addr net.Addr) *udpClientConn {
+	uc := &udpClientConn{
+		pc:        pc,
+		addr:      addr,
+		closeCode: websocket.CloseNormalClosure,
+		closed:    make(chan struct{}),
+	}
+	uc.conv = newRUDPConn(conv, uc.output)
+
+	return uc
+}
+
+// output 发给客户端最近一次使用的地址
+func (uc *udpClientConn) output(buf []byte) error {
+	uc.lock.Lock()
+	addr := uc.addr
+	uc.lock.Unlock()
+
+	_, err := uc.pc.WriteTo(buf, addr)
+	return err
+}
+
+func (uc *udpClientConn) fromAddr(addr net.Addr) bool {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+
+	return uc.addr.String() == addr.String()
+}
+
+// setAddr 客户端换了IP或者端口后，之后的包发到新的地址
+func (uc *udpClientConn) setAddr(addr net.Addr) (migrated bool) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+
+	if uc.addr.String() == addr.String() {
+		return false
+	}
+
+	uc.addr = addr
+	return true
+}
+
+// accept 会话已建立，回复ACCEPT；重复的SYN也调用
+func (uc *udpClientConn) accept() {
+	uc.lock.Lock()
+	uc.accepted = true
+	uc.lock.Unlock()
+
+	pkt := &rudpPacket{conv: uc.conv.conv, cmd: rudpCmdAccept}
+	uc.output(pkt.encode())
+}
+
+func (uc *udpClientConn) isAccepted() bool {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+
+	return uc.accepted
+}
+
+// WriteMessage 只发送二进制消息
+func (uc *udpClientConn) WriteMessage(mt int, data []byte) error {
+	if mt != websocket.BinaryMessage {
+		return nil
+	}
+
+	return uc.conv.send(data)
+}
+
+// WriteControl 只记录关闭帧的原因，在FIN中告知客户端
+func (uc *udpClientConn) WriteControl(mt int, data []byte, _ time.Time) error {
+	if mt != websocket.CloseMessage || len(data) < 2 {
+		return nil
+	}
+
+	uc.lock.Lock()
+	uc.closeCode = int(data[0])<<8 | int(data[1])
+	uc.closeReason = string(data[2:])
+	uc.lock.Unlock()
+
+	return nil
+}
+
+func (uc *udpClientConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (uc *udpClientConn) EnableWriteCompression(bool) {
+}
+
+// markClosed 客户端发来FIN或者链路已断开，waitUDPClientMessage随后结束会话
+func (uc *udpClientConn) markClosed() {
+	uc.closedOnce.Do(func() { close(uc.closed) })
+}
+
+// Close 发送FIN告知客户端关闭原因，客户端已经发来FIN或者链路断开时也发送
+func (uc *udpClientConn) Close() error {
+	uc.closeOnce.Do(func() {
+		uc.markClosed()
+
+		uc.lock.Lock()
+		msg := websocket.FormatCloseMessage(uc.closeCode, uc.closeReason)
+		uc.lock.Unlock()
+
+		pkt := &rudpPacket{conv: uc.conv.conv, cmd: rudpCmdFin, data: msg}
+		buf := pkt.encode()
+		for i := 0; i < udpFinRepeat; i++ {
+			uc.output(buf)
+		}
+	})
+
+	return nil
+}
+
+// Stats 会话的丢包以及时延统计
+func (uc *udpClientConn) Stats() RUDPStats {
+	return uc.conv.snapshot()
+}
+
+// udpRateLimiter 每秒最多允许rate次，只在acceptUDPClients中使用，不加锁
+type udpRateLimiter struct {
+	rate  int
+	start time.Time
+	count int
+}
+
+func (l *udpRateLimiter) allow(now time.Time) bool {
+	if now.Sub(l.start) >= time.Second {
+		l.start = now
+		l.count = 0
+	}
+
+	if l.count >= l.rate {
+		return false
+	}
+
+	l.count++
+	return true
+}
+
+func (s *Server) udpSession(conv uint32) *udpClientConn {
+	s.udpLock.Lock()
+	defer s.udpLock.Unlock()
+
+	return s.udpSessions[conv]
+}
+
+// acceptUDPClients 接收所有udp客户端的包，按conv分发到会话，直到监听被关闭
+func (s *Server) acceptUDPClients() {
+	defer s.wg.Done()
+
+	log.Printf("Udp client listen at:%s\n", s.udpConn.LocalAddr())
+
+	rejects := &udpRateLimiter{rate: udpRejectRate}
+	syns := &udpRateLimiter{rate: udpSynRate}
+
+	buf := make([]byte, udpMaxPacket)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Println("udp client read failed:", err)
+			}
+			return
+		}
+
+		pkt, err := decodeRUDPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		uc := s.udpSession(pkt.conv)
+		if uc == nil {
+			switch pkt.cmd {
+			case rudpCmdSyn:
+				if syns.allow(time.Now()) {
+					s.openUDPSession(pkt, addr)
+				}
+			case rudpCmdData:
+				// 会话已经不存在（例如代理重启过），告知客户端重新建立；来源地址可以伪造，限制回复的速率
+				if !rejects.allow(time.Now()) {
+					continue
+				}
+
+				fin := &rudpPacket{conv: pkt.conv, cmd: rudpCmdFin,
+					data: websocket.FormatCloseMessage(websocket.CloseGoingAway, "session not found")}
+				s.udpConn.WriteTo(fin.encode(), addr)
+			}
+			continue
+		}
+
+		switch pkt.cmd {
+		case rudpCmdSyn:
+			if uc.isAccepted() {
+				uc.accept()
+			}
+		case rudpCmdFin:
+			// 只接受当前地址的FIN，其他地址的可能是伪造的
+			if uc.fromAddr(addr) {
+				uc.markClosed()
+			}
+		default:
+			// 知道conv就能伪造来源地址，只有带来新的段或者新的确认时才迁移，重放的旧包不迁移
+			if uc.conv.input(pkt) && uc.setAddr(addr) {
+				log.Println("udp client migrated, conv:", pkt.conv, "addr:", addr)
+			}
+		}
+	}
+}
+
+// openUDPSession 新建会话，连接游戏服务器成功后回复ACCEPT
+func (s *Server) openUDPSession(pkt *rudpPacket, addr net.Addr) {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	query, err := url.ParseQuery(string(pkt.data))
+	if err != nil {
+		log.Println("udp client invalid handshake:", addr, err)
+		return
+	}
+
+	uc := newUDPClientConn(s.udpConn, pkt.conv, addr)
+	holder := s.newGameUserHolder(uc, udpProtocol, query, addr.String())
+	holder.readLimit = s.wsLimits(udpClientWType).ReadLimit
+	uc.conv.readLimit = holder.readLimit
+
+	s.udpLock.Lock()
+	s.udpSessions[pkt.conv] = uc
+	s.udpLock.Unlock()
+
+	holder.log.Println("udp client accepted, uid:", query.Get("uid"))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.udpLock.Lock()
+			delete(s.udpSessions, pkt.conv)
+			s.udpLock.Unlock()
+		}()
+		defer uc.Close()
+
+		// 连接游戏服务器失败时proxyStart已经记录了关闭原因，随FIN告知客户端
+		s.serveSession(context.Background(), holder, func(err error) {
+			if err == nil {
+				uc.accept()
+			}
+		}, func() {
+			waitUDPClientMessage(holder, uc)
+		})
+	}()
+}
+
+// waitUDPClientMessage 处理重组完成的消息，直到客户端发来FIN或者会话结束
+func waitUDPClientMessage(holder *pairHolder, uc *udpClientConn) {
+	defer holder.close()
+
+	for {
+		select {
+		case <-uc.conv.notify:
+		case <-uc.closed:
+			holder.log.Println("udp client closed")
+			return
+		case <-holder.ctx.Done():
+			return
+		}
+
+		msgs, err := uc.conv.take()
+		for _, msg := range msgs {
+			holder.touch()
+			holder.onWebsocketMessage(websocket.BinaryMessage, msg)
+		}
+
+		switch err {
+		case nil:
+		case errRUDPTooBig:
+			holder.rejectOversize()
+			return
+		default:
+			holder.closeWithReason(websocket.CloseProtocolError, err.Error())
+			return
+		}
+	}
+}
+
+// flushUDPSessions 定时重传以及发送窗口内的数据，链路断开的会话结束
+func (s *Server) flushUDPSessions() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(rudpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.udpLock.Lock()
+			sessions := make([]*udpClientConn, 0, len(s.udpSessions))
+			for _, uc := range s.udpSessions {
+				sessions = append(sessions, uc)
+			}
+			s.udpLock.Unlock()
+
+			for _, uc := range sessions {
+				if uc.conv.flush(now) {
+					// 客户端多半已经收不到，FIN仍然带上原因
+					uc.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, errRUDPDeadLink.Error()), time.Time{})
+					uc.markClosed()
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultUpstreamHeartbeatInterval = 15 * time.Second
+
+	// closeUpstreamUnresponsive 游戏服务器无响应时的websocket关闭码(1013 Try Again Later)，
+	// 1014 Bad Gateway更贴切但是不少客户端（包括gorilla/websocket）不认
+	closeUpstreamUnresponsive = websocket.CloseTryAgainLater
+
+	// closeCircuitOpen 游戏服务器熔断时的关闭码（应用自定义），客户端应等待熔断冷却后再重连，
+	// 与1013区分开
+	closeCircuitOpen = 4503
+)
+
+var (
+	errUpstreamUnresponsive = errors.New("upstream unresponsive")
+	errUpstreamDialFailed   = errors.New("upstream dial failed")
+)
+
+// 以下函数只在serveTCP的goroutine中调用，lastUpstreamRead以及lastHeartbeat不需要加锁
+
+// upstreamHeartbeatInterval 没有配置心跳消息码时返回0
+func (ph *pairHolder) upstreamHeartbeatInterval() time.Duration {
+	cfg := ph.server.cfg
+	if cfg.UpstreamHeartbeatMsg == 0 {
+		return 0
+	}
+
+	if cfg.UpstreamHeartbeatInterval <= 0 {
+		return defaultUpstreamHeartbeatInterval
+	}
+
+	return cfg.UpstreamHeartbeatInterval
+}
+
+// nextHeartbeat 游戏服务器空闲超过心跳间隔，并且距离上次心跳也超过心跳间隔时发送下一个心跳
+func (ph *pairHolder) nextHeartbeat() time.Time {
+	last := ph.lastUpstreamRead
+	if ph.lastHeartbeat.After(last) {
+		last = ph.lastHeartbeat
+	}
+
+	return last.Add(ph.upstreamHeartbeatInterval())
+}
+
+// setUpstreamReadDeadline 按读超时以及心跳时间设置tcp读的截止时间，都没有配置时不设置，
+// 读阻塞直到游戏服务器断开或者会话结束
+func (ph *pairHolder) setUpstreamReadDeadline() {
+	var deadline time.Time
+	if timeout := ph.server.cfg.UpstreamReadTimeout; timeout > 0 {
+		deadline = ph.lastUpstreamRead.Add(timeout)
+	}
+
+	if ph.upstreamHeartbeatInterval() > 0 {
+		hb := ph.nextHeartbeat()
+		if deadline.IsZero() || hb.Before(deadline) {
+			deadline = hb
+		}
+	}
+
+	if !deadline.IsZero() {
+		ph.tcpConn.SetReadDeadline(deadline)
+	}
+}
+
+// onUpstreamIdle tcp读超时：游戏服务器空闲超过读超时则告知客户端并结束会话，
+// 否则在需要时发送心跳，返回nil表示继续读
+func (ph *pairHolder) onUpstreamIdle() error {
+	now := time.Now()
+	if timeout := ph.server.cfg.UpstreamReadTimeout; timeout > 0 && now.Sub(ph.lastUpstreamRead) >= timeout {
+		ph.log.Warnf("upstream not response exceed %v, close session", timeout)
+		ph.closeWithReason(closeUpstreamUnresponsive, errUpstreamUnresponsive.Error())
+		return errUpstreamUnresponsive
+	}
+
+	if ph.upstreamHeartbeatInterval() > 0 && !now.Before(ph.nextHeartbeat()) {
+		ph.lastHeartbeat = now
+		pkt := &Packet{Dir: DirUpstream, Ops: int32(ph.server.cfg.UpstreamHeartbeatMsg) << 8}
+		return ph.sendTCPMessage(pkt)
+	}
+
+	return nil
+}
+
+// isUpstreamHeartbeat 游戏服务器对心跳的回复，不转发给客户端
+func (ph *pairHolder) isUpstreamHeartbeat(msg uint16) bool {
+	hb := ph.server.cfg.UpstreamHeartbeatMsg
+	return hb != 0 && msg == hb
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultWSReadLimit       = 1024   // 每个websocket的接收数据包长度限制
+	defaultWSReadBufferSize  = 2048   // 每个websocket的接收缓冲限制
+	defaultWSWriteBufferSize = 4096   // 每个websocket的发送缓冲限制
+	defaultMaxHeaderBytes    = 1 << 8 // http请求头的大小限制，客户端的cookie较大时需要调大
+)
+
+var (
+	errMessageTooBig = errors.New("message too big")
+)
+
+// WSLimits websocket的消息大小以及缓冲区大小(字节)，为0的字段使用默认值
+type WSLimits struct {
+	// ReadLimit 客户端单个消息的大小限制，超过时以1009关闭连接，为0时为1KB
+	ReadLimit int64
+	// ReadBufferSize/WriteBufferSize 读写缓冲区大小，为0时为2KB/4KB
+	ReadBufferSize  int
+	WriteBufferSize int
+}
+
+// merge 用o中不为0的字段覆盖l
+func (l WSLimits) merge(o WSLimits) WSLimits {
+	if o.ReadLimit > 0 {
+		l.ReadLimit = o.ReadLimit
+	}
+
+	if o.ReadBufferSize > 0 {
+		l.ReadBufferSize = o.ReadBufferSize
+	}
+
+	if o.WriteBufferSize > 0 {
+		l.WriteBufferSize = o.WriteBufferSize
+	}
+
+	return l
+}
+
+// wsLimits 按/game/:uuid/ws/:wtype中wtype的配置覆盖全局配置
+func (s *Server) wsLimits(wtype string) WSLimits {
+	l := WSLimits{
+		ReadLimit:       defaultWSReadLimit,
+		ReadBufferSize:  defaultWSReadBufferSize,
+		WriteBufferSize: defaultWSWriteBufferSize,
+	}
+
+	return l.merge(s.cfg.WS).merge(s.cfg.WSRoutes[wtype])
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.cfg.MaxHeaderBytes > 0 {
+		return s.cfg.MaxHeaderBytes
+	}
+
+	return defaultMaxHeaderBytes
+}
+
+// readMessage 读取客户端的下一个消息，超过大小限制时返回errMessageTooBig；
+// 不使用gorilla/websocket的SetReadLimit，以便自己发送带有原因的关闭帧并计数
+func (ph *pairHolder) readMessage(ws *websocket.Conn) (int, []byte, error) {
+	mt, r, err := ws.NextReader()
+	if err != nil {
+		return mt, nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(r, ph.readLimit+1))
+	if err != nil {
+		return mt, nil, err
+	}
+
+	if int64(len(message)) > ph.readLimit {
+		return mt, nil, errMessageTooBig
+	}
+
+	return mt, message, nil
+}
+
+// rejectOversize 客户端消息超过大小限制，以1009关闭会话
+func (ph *pairHolder) rejectOversize() {
+	atomic.AddUint64(&ph.server.wsOversizeRejected, 1)
+	ph.log.Warnf("websocket message exceed %d bytes, close session", ph.readLimit)
+	ph.closeWithReason(websocket.CloseMessageTooBig, errMessageTooBig.Error())
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"gscfg"
 	"os"
 	"os/signal"
 	"syscall"
@@ -23,7 +22,7 @@ func waitForSignal() {
 		}
 
 		if s == syscall.SIGUSR2 {
-			gscfg.ReLoadConfigFile()
+			reloadConfig()
 			continue
 		}
 